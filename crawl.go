@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/temoto/http-client.go/fetcher" // Temporary location
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"regexp"
+	"sync"
+)
+
+// urlSet is set of normalized URLs already sent to urls, shared by
+// input reader and crawler. Safe for concurrent use.
+type urlSet struct {
+	lk   sync.Mutex
+	keys map[string]bool
+}
+
+func newURLSet() *urlSet {
+	return &urlSet{keys: make(map[string]bool)}
+}
+
+// Add adds key and returns false if it was added before.
+func (s *urlSet) Add(key string) bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.keys[key] {
+		return false
+	}
+	s.keys[key] = true
+	return true
+}
+
+// crawler feeds links of HTML pages back to urls, see -crawl. Links go
+// through the same robots.txt checks and limits as input URLs. Found links
+// wait in urls without bound, their number is limited by maxDepth and scope.
+type crawler struct {
+	// Links are followed this many steps from input URL.
+	maxDepth int
+	// If not nil, links matching it are followed. Otherwise only links
+	// to the same host:port as page they are on.
+	allow *regexp.Regexp
+	// Links already seen are not followed again.
+	seen *urlSet
+}
+
+// follow adds new links of result of r to urls, one step deeper than r.
+func (c *crawler) follow(r *fetcher.Request, result *heroshi.FetchResult) {
+	if r.Depth >= c.maxDepth {
+		return
+	}
+	host := fetcher.NormalizeURL(r.Url).Host
+	for _, u := range fetcher.ResultLinks(result) {
+		key := fetcher.NormalizeURL(u)
+		if c.allow != nil {
+			if !c.allow.MatchString(u.String()) {
+				continue
+			}
+		} else if key.Host != host {
+			continue
+		}
+		if !c.seen.Add(key.String()) {
+			continue
+		}
+		link := &fetcher.Request{Url: u, Depth: r.Depth + 1}
+		if u.Host == r.Url.Host {
+			link.ConnectTo = r.ConnectTo
+		}
+		index := addInput(u.String(), u)
+		if !urls.Add(link, 0, index) {
+			sendReport(index, nil)
+		}
+	}
+}
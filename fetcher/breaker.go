@@ -0,0 +1,76 @@
+package fetcher
+
+import (
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"sync"
+	"time"
+)
+
+// Circuit breaker state of one host.
+type breakerEntry struct {
+	failures uint      // consecutive
+	openTill time.Time // zero while closed
+	probing  bool      // half-open, one request is in progress
+}
+
+// hostBreaker stops requests to hosts failing threshold times in a row
+// for cooldown, then lets one request through to check if host is back.
+// Safe for concurrent use.
+type hostBreaker struct {
+	lk      sync.Mutex
+	entries map[string]*breakerEntry
+}
+
+func newHostBreaker() *hostBreaker {
+	return &hostBreaker{entries: make(map[string]*breakerEntry)}
+}
+
+// allow tells whether request to host may be sent now.
+// Caller must pass result of allowed request to record.
+func (b *hostBreaker) allow(host string, now time.Time) bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	e, ok := b.entries[host]
+	if !ok || e.openTill.IsZero() {
+		return true
+	}
+	if now.Before(e.openTill) || e.probing {
+		return false
+	}
+	e.probing = true
+	return true
+}
+
+// record counts result of request to host. Host with threshold consecutive
+// failures is not allowed until cooldown passes. Aborted requests don't count.
+func (b *hostBreaker) record(host string, failed, aborted bool, threshold uint, cooldown time.Duration, now time.Time) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	e, ok := b.entries[host]
+	if aborted {
+		if ok {
+			// Let another request probe.
+			e.probing = false
+		}
+		return
+	}
+	if !failed {
+		delete(b.entries, host)
+		return
+	}
+	if !ok {
+		e = new(breakerEntry)
+		b.entries[host] = e
+	}
+	e.failures++
+	e.probing = false
+	if e.failures >= threshold {
+		e.openTill = now.Add(cooldown)
+	}
+}
+
+// breakerFailure tells whether result means host is in trouble:
+// no response or server error.
+func breakerFailure(result *heroshi.FetchResult) bool {
+	return !result.Success || result.StatusCode >= 500
+}
@@ -0,0 +1,85 @@
+package fetcher
+
+import (
+	"container/list"
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"net/http"
+	"sync"
+)
+
+// Cache keeps fetch results by URL. Implementations must be safe for concurrent use.
+// Worker gives Set a result it won't modify and copies results returned by Get.
+type Cache interface {
+	Get(key string) (*heroshi.FetchResult, bool)
+	Set(key string, r *heroshi.FetchResult)
+}
+
+// Only plain GET requests without credentials, cookies or validators are cached.
+func cacheableRequest(r *Request) bool {
+	return (r.Method == "" || r.Method == "GET") && len(r.Body) == 0 && r.BodyFile == "" &&
+		r.user == nil && r.Header.Get("Authorization") == "" &&
+		r.Header.Get("Cookie") == "" && (r.jar == nil || len(r.jar.Cookies(r.Url)) == 0) &&
+		r.IfNoneMatch == "" && r.IfModifiedSince == "" &&
+		r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == ""
+}
+
+// Status codes cacheable by default, RFC 7231 section 6.1.
+func cacheableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusPartialContent, http.StatusMultipleChoices, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+		http.StatusRequestURITooLong, http.StatusNotImplemented:
+		//
+		return true
+	}
+	return false
+}
+
+// LRUCache is in-memory Cache that holds up to size recently used results.
+type LRUCache struct {
+	lk    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // front is most recently used
+}
+
+type lruItem struct {
+	key    string
+	result *heroshi.FetchResult
+}
+
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:  size,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (c *LRUCache) Get(key string) (*heroshi.FetchResult, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruItem).result, true
+}
+
+func (c *LRUCache) Set(key string, r *heroshi.FetchResult) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruItem).result = r
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key, r})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem).key)
+	}
+}
@@ -0,0 +1,211 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"github.com/temoto/http-client.go/heroshi"  // Temporary location
+	"github.com/temoto/http-client.go/limitmap" // Temporary location
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Resolved addresses of one host. Connections are spread over addrs round-robin.
+type dnsEntry struct {
+	addrs   []string
+	next    int
+	expires time.Time
+}
+
+// dnsCache keeps results of host name lookups. Safe for concurrent use.
+type dnsCache struct {
+	lk      sync.Mutex
+	entries map[string]*dnsEntry
+
+	// Limits concurrent lookups, nil means unlimited. Set before use.
+	slots *limitmap.Semaphore
+	// Replaces net.DefaultResolver.LookupIP if not nil.
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]*dnsEntry)}
+}
+
+// get returns cached addresses of host starting with next one in round-robin
+// order, or false if there are none or they have expired.
+func (c *dnsCache) get(host string, now time.Time) ([]string, bool) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	e, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.expires) {
+		delete(c.entries, host)
+		return nil, false
+	}
+	start := e.next % len(e.addrs)
+	e.next++
+	addrs := make([]string, 0, len(e.addrs))
+	addrs = append(addrs, e.addrs[start:]...)
+	return append(addrs, e.addrs[:start]...), true
+}
+
+func (c *dnsCache) set(host string, addrs []string, expires time.Time) {
+	c.lk.Lock()
+	// Next get returns second address, first one is used by caller of lookup.
+	c.entries[host] = &dnsEntry{addrs: addrs, next: 1, expires: expires}
+	c.lk.Unlock()
+}
+
+func (c *dnsCache) evict(host string) {
+	c.lk.Lock()
+	delete(c.entries, host)
+	c.lk.Unlock()
+}
+
+// lookup resolves host with resolver, nil means system one, and caches
+// all its addresses for ttl, 0 or less means don't cache. Returns all
+// addresses. netw is "tcp", "tcp4" or "tcp6", the latter two keep only
+// addresses of that family. Waiting for free lookup slot counts against
+// timeout.
+func (c *dnsCache) lookup(netw, host string, resolver *net.Resolver, ttl, timeout time.Duration) ([]string, error) {
+	ctx := context.Background()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ipNetwork := "ip"
+	switch netw {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+	if c.slots != nil {
+		if _, err := c.slots.AcquireContext(ctx); err != nil {
+			return nil, &net.DNSError{Err: "timeout waiting for lookup slot", Name: host, IsTimeout: true}
+		}
+	}
+	lookupIP := net.DefaultResolver.LookupIP
+	if resolver != nil {
+		lookupIP = resolver.LookupIP
+	}
+	if c.lookupIP != nil {
+		lookupIP = c.lookupIP
+	}
+	ips, err := lookupIP(ctx, ipNetwork, host)
+	if c.slots != nil {
+		c.slots.Release()
+	}
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("DNS lookup: no addresses for " + host)
+	}
+	if ttl > 0 {
+		c.set(host, addrs, time.Now().Add(ttl))
+	}
+	return addrs, nil
+}
+
+// Dial function with connect timeout, 0 means no timeout.
+type dialFunc func(netw, addr string, timeout time.Duration) (net.Conn, error)
+
+// dialCached is Dial that resolves host names through w.dns, separately
+// from connect. All addresses of host are tried within timeout, see dialSequential.
+// If none of cached addresses connects, they are evicted and host is resolved again.
+// With DNSTTL 0 or less nothing is cached, lookups are still limited.
+// Time spent on lookup goes to stat.DNSTime if stat is not nil.
+func (w *Worker) dialCached(netw, addr string, dial dialFunc, timeout time.Duration, stat *heroshi.RequestStat) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(netw, addr, timeout)
+	}
+
+	if ips, ok := w.dns.get(host, time.Now()); ok {
+		conn, err := dialSequential(netw, ips, port, dial, timeout)
+		if err == nil {
+			return conn, nil
+		}
+		w.dns.evict(host)
+	}
+
+	started := time.Now()
+	ips, err := w.dns.lookup(netw, host, w.Resolver, w.DNSTTL, timeout)
+	if stat != nil {
+		stat.DNSTime = time.Since(started)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialSequential(netw, ips, port, dial, timeout)
+	if err != nil {
+		w.dns.evict(host)
+	}
+	return conn, err
+}
+
+// dialSequential tries ips in order until one connects and returns error
+// of the first one if none does. Non-zero timeout is shared: each attempt
+// gets equal part of what's left, so one dead address can't take it all.
+func dialSequential(netw string, ips []string, port string, dial dialFunc, timeout time.Duration) (net.Conn, error) {
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	var firstErr error
+	for i, ip := range ips {
+		var attempt time.Duration
+		if timeout != 0 {
+			attempt = time.Until(deadline) / time.Duration(len(ips)-i)
+			if attempt <= 0 {
+				break
+			}
+		}
+		conn, err := dial(netw, net.JoinHostPort(ip, port), attempt)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// NewResolver returns resolver that sends all queries to DNS server at
+// udp://host[:port] or tcp://host[:port], port defaults to 53. With udp,
+// truncated answers are still retried over TCP to the same server.
+func NewResolver(server string) (*net.Resolver, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Hostname() == "" {
+		return nil, errors.New("NewResolver: expected udp://host:port or tcp://host:port, got: " + server)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "53")
+	}
+	scheme := u.Scheme
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if scheme == "tcp" {
+				network = "tcp"
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
@@ -0,0 +1,90 @@
+package fetcher
+
+import (
+	"bytes"
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"golang.org/x/net/html"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ExtractLinks returns absolute http and https URLs of <a href> links in
+// HTML document r, in document order, repeated ones included. Relative links
+// are resolved against base, or <base href> of document. Fragments are removed.
+func ExtractLinks(base *url.URL, r io.Reader) []*url.URL {
+	var links []*url.URL
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			if !hasAttr || (tag != "a" && tag != "base") {
+				continue
+			}
+			href, ok := tagAttr(z, "href")
+			if !ok {
+				continue
+			}
+			u, err := url.Parse(strings.TrimSpace(href))
+			if err != nil {
+				continue
+			}
+			u = base.ResolveReference(u)
+			if tag == "base" {
+				base = u
+				continue
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				continue
+			}
+			u.Fragment = ""
+			u.RawFragment = ""
+			links = append(links, u)
+		}
+	}
+}
+
+// tagAttr returns value of attribute key of current tag.
+func tagAttr(z *html.Tokenizer, key string) (string, bool) {
+	for {
+		k, v, more := z.TagAttr()
+		if string(k) == key {
+			return string(v), true
+		}
+		if !more {
+			return "", false
+		}
+	}
+}
+
+// ResultLinks returns links of successful HTML result, see ExtractLinks.
+// Body is read from result.Body or BodyPath file, which is left in place.
+// Relative links are resolved against FinalUrl if it is set.
+func ResultLinks(result *heroshi.FetchResult) []*url.URL {
+	if !result.Success || result.StatusCode/100 != 2 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(result.Headers.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+	base := result.Url
+	if result.FinalUrl != nil {
+		base = result.FinalUrl
+	}
+	if result.BodyPath == "" {
+		return ExtractLinks(base, bytes.NewReader(result.Body))
+	}
+	f, err := os.Open(result.BodyPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return ExtractLinks(base, f)
+}
@@ -0,0 +1,175 @@
+package fetcher
+
+import (
+	"fmt"
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts worker activity. Safe for concurrent use.
+// ServeHTTP writes them in Prometheus text format.
+type Metrics struct {
+	// Accessed atomically.
+	fetched          uint64 // HTTP requests completed by Download
+	successes        uint64
+	redirects        uint64 // redirects followed by FetchRequest
+	robotsDisallowed uint64
+	inFlight         int64 // Downloads in progress
+
+	errorsLk sync.Mutex
+	errors   map[string]uint64 // FetchResult.ErrorKind -> count
+
+	hostsLk sync.RWMutex
+	hosts   map[string]*hostCounters // host:port -> counters, see Worker.HostStats
+}
+
+// HostStat aggregates HTTP requests to one host, see Worker.HostStats.
+type HostStat struct {
+	Requests      uint64
+	Successes     uint64
+	Errors        map[string]uint64 // FetchResult.ErrorKind -> count, nil if none
+	BytesReceived uint64            // on the wire, see heroshi.RequestStat
+	TotalTime     time.Duration     // sum over all Requests
+}
+
+// MeanTime returns average time of one request.
+func (s HostStat) MeanTime() time.Duration {
+	if s.Requests == 0 {
+		return 0
+	}
+	return s.TotalTime / time.Duration(s.Requests)
+}
+
+// Counters of one host. Accessed atomically, except errors.
+type hostCounters struct {
+	requests  uint64
+	successes uint64
+	bytes     uint64
+	nanos     int64
+
+	errorsLk sync.Mutex
+	errors   map[string]uint64
+}
+
+// addDownload counts result of HTTP request to host that took elapsed.
+func (m *Metrics) addDownload(result *heroshi.FetchResult, host string, elapsed time.Duration) {
+	atomic.AddUint64(&m.fetched, 1)
+	c := m.host(host)
+	atomic.AddUint64(&c.requests, 1)
+	atomic.AddInt64(&c.nanos, int64(elapsed))
+	if result.Stat != nil && result.Stat.BytesReceived > 0 {
+		atomic.AddUint64(&c.bytes, uint64(result.Stat.BytesReceived))
+	}
+	if result.Success {
+		atomic.AddUint64(&m.successes, 1)
+		atomic.AddUint64(&c.successes, 1)
+		return
+	}
+	category := result.ErrorKind
+	if category == "" {
+		category = "other"
+	}
+	m.errorsLk.Lock()
+	if m.errors == nil {
+		m.errors = make(map[string]uint64)
+	}
+	m.errors[category]++
+	m.errorsLk.Unlock()
+	c.errorsLk.Lock()
+	if c.errors == nil {
+		c.errors = make(map[string]uint64)
+	}
+	c.errors[category]++
+	c.errorsLk.Unlock()
+}
+
+// host returns counters of host, creating them on first use.
+func (m *Metrics) host(host string) *hostCounters {
+	m.hostsLk.RLock()
+	c := m.hosts[host]
+	m.hostsLk.RUnlock()
+	if c != nil {
+		return c
+	}
+	m.hostsLk.Lock()
+	defer m.hostsLk.Unlock()
+	if m.hosts == nil {
+		m.hosts = make(map[string]*hostCounters)
+	}
+	if c = m.hosts[host]; c == nil {
+		c = &hostCounters{}
+		m.hosts[host] = c
+	}
+	return c
+}
+
+// write outputs all metrics, keys and total are LimitMap.Size of host limits.
+func (m *Metrics) write(w io.Writer, keys, total int) {
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+
+	counter("heroshi_fetched_total", "HTTP requests completed.", atomic.LoadUint64(&m.fetched))
+	counter("heroshi_success_total", "HTTP requests with response.", atomic.LoadUint64(&m.successes))
+	counter("heroshi_redirects_total", "Redirects followed.", atomic.LoadUint64(&m.redirects))
+	counter("heroshi_robots_disallowed_total", "URLs disallowed by robots.txt.", atomic.LoadUint64(&m.robotsDisallowed))
+
+	m.errorsLk.Lock()
+	categories := make([]string, 0, len(m.errors))
+	for category := range m.errors {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	fmt.Fprintf(w, "# HELP heroshi_errors_total HTTP requests without response by error category.\n# TYPE heroshi_errors_total counter\n")
+	for _, category := range categories {
+		fmt.Fprintf(w, "heroshi_errors_total{category=%q} %d\n", category, m.errors[category])
+	}
+	m.errorsLk.Unlock()
+
+	gauge("heroshi_in_flight", "HTTP requests in progress.", atomic.LoadInt64(&m.inFlight))
+	gauge("heroshi_host_limit_keys", "Hosts with active connections.", int64(keys))
+	gauge("heroshi_host_limit_total", "Active connections counted against per-host limits.", int64(total))
+}
+
+// HostStats returns copy of per-host aggregates of all HTTP requests made
+// so far, including robots.txt and redirects, keyed by host:port of URL.
+// Unlike HostConnections, hosts stay there after downloads are over.
+func (w *Worker) HostStats() map[string]HostStat {
+	m := &w.Metrics
+	m.hostsLk.RLock()
+	defer m.hostsLk.RUnlock()
+	stats := make(map[string]HostStat, len(m.hosts))
+	for host, c := range m.hosts {
+		stat := HostStat{
+			Requests:      atomic.LoadUint64(&c.requests),
+			Successes:     atomic.LoadUint64(&c.successes),
+			BytesReceived: atomic.LoadUint64(&c.bytes),
+			TotalTime:     time.Duration(atomic.LoadInt64(&c.nanos)),
+		}
+		c.errorsLk.Lock()
+		if len(c.errors) != 0 {
+			stat.Errors = make(map[string]uint64, len(c.errors))
+			for kind, n := range c.errors {
+				stat.Errors[kind] = n
+			}
+		}
+		c.errorsLk.Unlock()
+		stats[host] = stat
+	}
+	return stats
+}
+
+// ServeMetrics is http.HandlerFunc writing w.Metrics in Prometheus text format.
+func (w *Worker) ServeMetrics(rw http.ResponseWriter, req *http.Request) {
+	keys, total := w.hostLimits.Size()
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Metrics.write(rw, keys, total)
+}
@@ -0,0 +1,87 @@
+package fetcher
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// NormalizeURL returns copy of u in canonical form for comparison: scheme and host
+// are lowercased, default port is removed, empty path of bare host becomes "/",
+// dot segments are resolved, query parameters are sorted and fragment is removed.
+// Normalization does not change meaning of URL for the server:
+// percent-encoding and trailing slashes in path are preserved.
+func NormalizeURL(u *url.URL) *url.URL {
+	u2 := *u
+	u2.Fragment = ""
+	u2.Scheme = strings.ToLower(u.Scheme)
+	if u2.Opaque != "" {
+		return &u2
+	}
+
+	u2.Host = strings.ToLower(u.Host)
+	if port := u2.Port(); (port == "80" && u2.Scheme == "http") || (port == "443" && u2.Scheme == "https") {
+		u2.Host = u2.Host[:len(u2.Host)-len(port)-1]
+	}
+
+	if u2.Path == "" && u2.Host != "" {
+		u2.Path = "/"
+		u2.RawPath = ""
+	} else {
+		u2.Path = removeDotSegments(u.Path)
+		if u.RawPath != "" {
+			u2.RawPath = removeDotSegments(u.RawPath)
+		}
+	}
+
+	u2.ForceQuery = false
+	if u.RawQuery != "" {
+		var params []string
+		for _, p := range strings.Split(u.RawQuery, "&") {
+			if p != "" {
+				params = append(params, p)
+			}
+		}
+		// Stable, so that repeated keys keep their order.
+		sort.SliceStable(params, func(i, j int) bool {
+			return queryKey(params[i]) < queryKey(params[j])
+		})
+		u2.RawQuery = strings.Join(params, "&")
+	}
+	return &u2
+}
+
+func queryKey(param string) string {
+	if i := strings.IndexByte(param, '='); i != -1 {
+		return param[:i]
+	}
+	return param
+}
+
+// removeDotSegments implements RFC 3986 section 5.2.4.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch s {
+		case ".":
+		case "..":
+			// Root segment (empty string before leading slash) can't be removed.
+			if len(out) > 1 || (len(out) == 1 && out[0] != "") {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, s)
+			continue
+		}
+		// "/a/." and "/a/b/.." both mean directory "/a/".
+		if last {
+			out = append(out, "")
+		}
+	}
+	return strings.Join(out, "/")
+}
@@ -0,0 +1,85 @@
+package fetcher
+
+import (
+	"crypto/tls"
+	"net/url"
+)
+
+// Option changes settings of Worker made by NewWorkerOptions.
+type Option func(w *Worker) error
+
+// NewWorkerOptions returns Worker with default settings changed by opts
+// in order. Error of any option is returned as is, without Worker.
+// Call Close when Worker is no longer needed.
+func NewWorkerOptions(opts ...Option) (*Worker, error) {
+	w := NewWorker()
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	// Options may set UserAgent field directly.
+	w.SetUserAgent(w.UserAgent)
+	if w.cleanIdle {
+		go w.CleanIdleConnections(nil)
+	}
+	return w, nil
+}
+
+// Configure returns Option calling fn, which may set any exported field
+// of Worker, e.g. FetchTimeout or OnResult.
+func Configure(fn func(w *Worker)) Option {
+	return func(w *Worker) error {
+		fn(w)
+		return nil
+	}
+}
+
+// WithProxy is Option calling SetProxy.
+func WithProxy(u *url.URL) Option {
+	return func(w *Worker) error { return w.SetProxy(u) }
+}
+
+// WithTLSConfig is Option calling SetTLSConfig.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(w *Worker) error {
+		w.SetTLSConfig(config)
+		return nil
+	}
+}
+
+// WithMaxIdleConns is Option calling SetMaxIdleConns. It uses HostConcurrency
+// set by preceding options.
+func WithMaxIdleConns(n int) Option {
+	return func(w *Worker) error {
+		w.SetMaxIdleConns(n)
+		return nil
+	}
+}
+
+// WithMaxDNSConcurrency is Option calling SetMaxDNSConcurrency.
+func WithMaxDNSConcurrency(n uint) Option {
+	return func(w *Worker) error {
+		w.SetMaxDNSConcurrency(n)
+		return nil
+	}
+}
+
+// WithMaxConns is Option calling SetMaxConns.
+func WithMaxConns(n uint) Option {
+	return func(w *Worker) error {
+		w.SetMaxConns(n)
+		return nil
+	}
+}
+
+// WithIdleCleanup is Option running CleanIdleConnections in a goroutine
+// until Close or Abort. It uses ReapInterval and KeepaliveTimeout of all
+// options, regardless of order.
+func WithIdleCleanup() Option {
+	return func(w *Worker) error {
+		w.cleanIdle = true
+		return nil
+	}
+}
@@ -0,0 +1,328 @@
+package fetcher
+
+import (
+	"fmt"
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"github.com/temoto/robotstxt.go"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Redirects of robots.txt followed at most, as RFC 9309 recommends.
+// More redirects make robots.txt unavailable.
+const MaxRobotsRedirects = 5
+
+// Failed robots.txt download is cached at most this long, instead of
+// Worker.RobotsTTL, so that host recovers from network errors sooner.
+// 5xx status is cached for RobotsTTL like any other robots.txt.
+const RobotsErrorTTL = time.Minute
+
+// Values of Worker.RobotsUnavailable.
+const (
+	RobotsUnavailableError = "error" // URL fails with robots.txt download error
+	RobotsUnavailableDeny  = "deny"  // URL is disallowed, as by "Disallow: /", with ErrorKind of failure
+	RobotsUnavailableAllow = "allow" // URL is allowed, as by empty robots.txt
+)
+
+// Cached robots.txt of one host. ready is closed when download is complete,
+// after that other fields are read-only.
+type robotsEntry struct {
+	ready   chan bool
+	robots  *robotstxt.RobotsData
+	body    []byte               // robots.txt as downloaded, for RobotsRule
+	result  *heroshi.FetchResult // download or parse error or 5xx, robots is nil
+	expires time.Time
+}
+
+func (e *robotsEntry) expired(now time.Time) bool {
+	select {
+	case <-e.ready:
+		return now.After(e.expires)
+	default:
+		// Download in progress.
+		return false
+	}
+}
+
+// AskRobots returns whether robots.txt allows url, and result to report
+// instead of fetching url if it doesn't. When robots.txt is unavailable and
+// allowed by RobotsUnavailableAllow, result describes download failure.
+func (w *Worker) AskRobots(url *url.URL) (bool, *heroshi.FetchResult) {
+	allow, _, result := w.AskRobotsRule(url)
+	return allow, result
+}
+
+// AskRobotsRule is AskRobots that also returns robots.txt directive
+// deciding for url, like "Disallow: /private". Empty rule means that no
+// directive matched, robots.txt is missing, or the directive found by
+// RobotsRule disagrees with allow.
+func (w *Worker) AskRobotsRule(url *url.URL) (allow bool, rule string, result *heroshi.FetchResult) {
+	return w.askRobotsRule(url, nil)
+}
+
+// askRobotsRule is AskRobotsRule that downloads robots.txt the same way
+// as via, connecting to Request.ConnectTo. via may be nil.
+func (w *Worker) askRobotsRule(url *url.URL, via *Request) (allow bool, rule string, result *heroshi.FetchResult) {
+	e, result := w.getRobots(url, via)
+	if result != nil {
+		result.RobotsStatus = heroshi.RobotsStatusUnavailable
+		switch w.RobotsUnavailable {
+		case RobotsUnavailableAllow:
+			return true, "", result
+		case RobotsUnavailableDeny:
+			// ErrorKind tells network error from 5xx, it's not counted
+			// as disallowed by robots.txt.
+			kind, status := result.ErrorKind, result.Status
+			result = heroshi.ErrorKindResult(url, kind, "Robots unavailable, disallow: "+status)
+			result.RobotsStatus = heroshi.RobotsStatusUnavailable
+		}
+		return false, "", result
+	}
+
+	allow = e.robots.TestAgent(url.Path, w.robotsAgent)
+	if group := e.robots.FindGroup(w.robotsAgent); group != nil {
+		// Rule of the group robotstxt decided by, it matches agents its own way.
+		rule = RobotsRule(e.body, group.Agent, url.Path)
+	}
+	if rule != "" && strings.HasPrefix(rule, "Allow:") != allow {
+		// Path patterns are matched differently too, never report rule
+		// contradicting the decision.
+		rule = ""
+	}
+	if !allow {
+		result = heroshi.ErrorKindResult(url, heroshi.ErrorKindRobots, "Robots disallow")
+		result.RobotsStatus = heroshi.RobotsStatusDisallowed
+		return allow, rule, result
+	}
+
+	return allow, rule, nil
+}
+
+// CheckRobots returns result of robots.txt check of url without fetching it.
+// Allowed URL gets successful result with Status "Robots allow".
+// FetchResult.RobotsRule is set in both cases.
+func (w *Worker) CheckRobots(url *url.URL) *heroshi.FetchResult {
+	if url.Scheme == "" || url.Host == "" {
+		return heroshi.ErrorKindResult(url, heroshi.ErrorKindInvalidURL, "Incorrect URL: "+url.String())
+	}
+	allow, rule, result := w.AskRobotsRule(url)
+	if allow {
+		robotsStatus := heroshi.RobotsStatusAllowed
+		if result != nil {
+			robotsStatus = result.RobotsStatus
+		}
+		result = &heroshi.FetchResult{Url: url, Success: true, Status: "Robots allow", RobotsStatus: robotsStatus}
+	}
+	result.RequestedUrl = url
+	result.RobotsRule = rule
+	return result
+}
+
+// getRobots returns robots.txt for url host from cache or downloads it.
+// Simultaneous misses for the same host wait for single download.
+func (w *Worker) getRobots(url *url.URL, via *Request) (*robotsEntry, *heroshi.FetchResult) {
+	key := url.Scheme + "://" + url.Host
+
+	w.robotsLk.Lock()
+	e := w.robotsCache[key]
+	if e == nil || e.expired(time.Now()) {
+		e = &robotsEntry{ready: make(chan bool)}
+		w.robotsCache[key] = e
+		w.robotsLk.Unlock()
+
+		e.robots, e.body, e.result = w.downloadRobots(url, via)
+		ttl := w.RobotsTTL
+		if e.result != nil && e.result.ErrorKind != heroshi.ErrorKindRobots5xx {
+			if e.result.ErrorKind == heroshi.ErrorKindAborted {
+				// Says nothing about host, next request tries again.
+				ttl = 0
+			} else if ttl > RobotsErrorTTL {
+				ttl = RobotsErrorTTL
+			}
+		}
+		e.expires = time.Now().Add(ttl)
+		close(e.ready)
+	} else {
+		w.robotsLk.Unlock()
+		<-e.ready
+	}
+
+	if e.result != nil {
+		// Callers modify result, give each its own copy.
+		result := *e.result
+		return nil, &result
+	}
+	return e, nil
+}
+
+// downloadRobots returns parsed robots.txt of url host and its body if status was successful.
+func (w *Worker) downloadRobots(url *url.URL, via *Request) (*robotstxt.RobotsData, []byte, *heroshi.FetchResult) {
+	robots_url_str := fmt.Sprintf("%s://%s/robots.txt", url.Scheme, url.Host)
+	robots_url, err := url.Parse(robots_url_str)
+	if err != nil {
+		return nil, nil, heroshi.ErrorKindResult(url, heroshi.ErrorKindInvalidURL, err.Error())
+	}
+
+	robots_request := &Request{Url: robots_url, internal: true}
+	if via != nil {
+		robots_request.ConnectTo, robots_request.connectHost = via.ConnectTo, via.connectHost
+	}
+	fetch_result := w.fetchRobots(robots_request)
+
+	if !fetch_result.Success {
+		fetch_result.Status = "Robots download error: " + fetch_result.Status
+		return nil, nil, fetch_result
+	}
+
+	// By convention, robots.txt with client error status means no restrictions,
+	// server error means it is unavailable, see Worker.RobotsUnavailable.
+	statusCode := fetch_result.StatusCode
+	if statusCode >= 500 {
+		return nil, nil, heroshi.ErrorKindResult(url, heroshi.ErrorKindRobots5xx, "Robots download error: "+fetch_result.Status)
+	}
+	if statusCode >= 400 {
+		statusCode = 404
+	}
+	var robots *robotstxt.RobotsData
+	robots, err = robotstxt.FromStatusAndBytes(statusCode, fetch_result.Body)
+	if err != nil {
+		fetch_result.Status = "Robots parse error: " + err.Error()
+		return nil, nil, fetch_result
+	}
+
+	if group := robots.FindGroup(w.robotsAgent); group != nil {
+		w.setCrawlDelay(url.Host, group.CrawlDelay)
+	}
+
+	var body []byte
+	if statusCode < 300 {
+		body = fetch_result.Body
+	}
+	return robots, body, nil
+}
+
+// RobotsRule finds Allow or Disallow directive of robots.txt body that
+// applies to path for agent: the longest matching one in group of agent,
+// or of "*" if there is no such group. Returns empty string if none matches.
+// Paths may contain "*" wildcards and end with "$".
+func RobotsRule(body []byte, agent, path string) string {
+	type group struct {
+		agents []string
+		rules  [][2]string // directive, path
+	}
+	var groups []*group
+	var current *group
+	for _, line := range strings.Split(string(body), "\n") {
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "user-agent":
+			// Consecutive User-agent lines start one group.
+			if current == nil || len(current.rules) != 0 {
+				current = new(group)
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if current != nil && value != "" {
+				directive := "Allow"
+				if key == "disallow" {
+					directive = "Disallow"
+				}
+				current.rules = append(current.rules, [2]string{directive, value})
+			}
+		}
+	}
+
+	// Most specific agent wins.
+	agent = strings.ToLower(agent)
+	var found, star *group
+	foundLen := 0
+	for _, g := range groups {
+		for _, a := range g.agents {
+			if a == "*" {
+				if star == nil {
+					star = g
+				}
+			} else if len(a) > foundLen && strings.Contains(agent, a) {
+				found, foundLen = g, len(a)
+			}
+		}
+	}
+	if found == nil {
+		found = star
+	}
+	if found == nil {
+		return ""
+	}
+
+	best := ""
+	bestLen := -1
+	for _, rule := range found.rules {
+		if len(rule[1]) > bestLen && robotsPathMatch(rule[1], path) {
+			best = rule[0] + ": " + rule[1]
+			bestLen = len(rule[1])
+		}
+	}
+	return best
+}
+
+// robotsPathMatch matches path against robots.txt pattern.
+func robotsPathMatch(pattern, path string) bool {
+	expr := "^" + strings.Replace(regexp.QuoteMeta(strings.TrimSuffix(pattern, "$")), `\*`, ".*", -1)
+	if strings.HasSuffix(pattern, "$") {
+		expr += "$"
+	}
+	matched, _ := regexp.MatchString(expr, path)
+	return matched
+}
+
+// fetchRobots downloads robots.txt request r following up to
+// MaxRobotsRedirects redirects, within RobotsTimeout for the whole chain.
+// Unlike FetchRequest, it never asks robots.txt itself, so a redirect to
+// another path on the same host can't wait for its own download.
+func (w *Worker) fetchRobots(r *Request) *heroshi.FetchResult {
+	r.deadline = new(time.Time)
+	r.timeout = w.RobotsTimeout
+	visited := map[string]bool{visitKey(r.Url): true}
+	for redirects := 0; ; redirects++ {
+		result := w.Download(r)
+		if result.BodyPath != "" {
+			// Large robots.txt went to BodyDir, it is parsed from memory anyway.
+			body, err := ioutil.ReadFile(result.BodyPath)
+			os.Remove(result.BodyPath)
+			if err != nil {
+				return heroshi.ErrorResult(r.Url, err.Error())
+			}
+			result.Body, result.BodyPath = body, ""
+		}
+		if !ShouldRedirect(result.StatusCode) {
+			return result
+		}
+		if redirects == MaxRobotsRedirects {
+			return heroshi.ErrorKindResult(r.Url, heroshi.ErrorKindRedirectLoop,
+				fmt.Sprintf("Too many redirects: %d", MaxRobotsRedirects))
+		}
+		next_url, err := r.Url.Parse(result.Headers.Get("Location"))
+		if err != nil {
+			return heroshi.ErrorKindResult(r.Url, heroshi.ErrorKindInvalidURL, err.Error())
+		}
+		if visited[visitKey(next_url)] {
+			return heroshi.ErrorKindResult(r.Url, heroshi.ErrorKindRedirectLoop, "Redirect loop detected: "+next_url.String())
+		}
+		visited[visitKey(next_url)] = true
+		r = &Request{Url: next_url, internal: true, ctx: r.ctx, deadline: r.deadline, timeout: r.timeout,
+			ConnectTo: r.ConnectTo, connectHost: r.connectHost}
+	}
+}
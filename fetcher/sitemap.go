@@ -0,0 +1,106 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Sitemap index may point to other indexes. Sitemap at depth
+// greater than this is not downloaded.
+const MaxSitemapDepth = 3
+
+// Either <urlset> or <sitemapindex>, see https://www.sitemaps.org/protocol.html
+type sitemapXML struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// SitemapSeed downloads /sitemap.xml of host and sitemaps listed in its robots.txt,
+// following sitemap indexes up to MaxSitemapDepth, and returns all page URLs found.
+// Only scheme and host of host URL are used. Sitemaps that fail to download
+// or parse are skipped.
+func (w *Worker) SitemapSeed(host *url.URL) []*url.URL {
+	root := &url.URL{Scheme: host.Scheme, Host: host.Host}
+	sitemaps := []string{root.String() + "/sitemap.xml"}
+	if !w.SkipRobots {
+		if e, _ := w.getRobots(root, nil); e != nil {
+			sitemaps = append(sitemaps, e.robots.Sitemaps...)
+		}
+	}
+
+	var urls []*url.URL
+	seen := make(map[string]bool)
+	for depth := 0; depth <= MaxSitemapDepth && len(sitemaps) != 0; depth++ {
+		var next []string
+		for _, loc := range sitemaps {
+			if seen[loc] {
+				continue
+			}
+			seen[loc] = true
+			sitemap := w.downloadSitemap(loc)
+			if sitemap == nil {
+				continue
+			}
+			for _, entry := range sitemap.URLs {
+				if u, err := url.Parse(strings.TrimSpace(entry.Loc)); err == nil && u.Host != "" {
+					urls = append(urls, u)
+				}
+			}
+			for _, entry := range sitemap.Sitemaps {
+				next = append(next, strings.TrimSpace(entry.Loc))
+			}
+		}
+		sitemaps = next
+	}
+	return urls
+}
+
+// downloadSitemap returns parsed sitemap at loc or nil on any error.
+// Body may be gzipped, either with Content-Encoding or as .xml.gz file.
+func (w *Worker) downloadSitemap(loc string) *sitemapXML {
+	u, err := url.Parse(loc)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	result := w.Download(&Request{Url: u, internal: true})
+	body := result.Body
+	if result.BodyPath != "" {
+		body, err = ioutil.ReadFile(result.BodyPath)
+		os.Remove(result.BodyPath)
+		if err != nil {
+			return nil
+		}
+	}
+	if !result.Success || result.StatusCode != 200 {
+		return nil
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil
+		}
+		r = gz
+	}
+	if w.ReadLimit != 0 {
+		// Protect from gzip bombs.
+		r = io.LimitReader(r, int64(w.ReadLimit))
+	}
+
+	sitemap := new(sitemapXML)
+	if err = xml.NewDecoder(r).Decode(sitemap); err != nil {
+		return nil
+	}
+	return sitemap
+}
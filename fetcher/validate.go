@@ -0,0 +1,61 @@
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"io"
+	"os"
+)
+
+// validate fails successful result that doesn't meet ExpectStatus and
+// ExpectBodyContains of r.
+func validate(result *heroshi.FetchResult, r *Request) {
+	var reason string
+	switch {
+	case r.ExpectStatus != 0 && result.StatusCode != r.ExpectStatus:
+		reason = fmt.Sprintf("Expected status %d, got %d", r.ExpectStatus, result.StatusCode)
+	case r.ExpectBodyContains != "":
+		found, err := bodyContains(result, []byte(r.ExpectBodyContains))
+		if err != nil {
+			reason = "Read body file: " + err.Error()
+		} else if !found {
+			reason = fmt.Sprintf("Body doesn't contain %q", r.ExpectBodyContains)
+		}
+	}
+	if reason != "" {
+		result.Success = false
+		result.ErrorKind = heroshi.ErrorKindValidation
+		result.ValidationError = reason
+	}
+}
+
+// bodyContains searches s in result body, either in memory or in BodyPath file.
+func bodyContains(result *heroshi.FetchResult, s []byte) (bool, error) {
+	if result.BodyPath == "" {
+		return bytes.Contains(result.Body, s), nil
+	}
+	f, err := os.Open(result.BodyPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	// Keep tail of previous chunk, s may be split between chunks.
+	buf := make([]byte, 0, 64<<10+len(s))
+	for {
+		n, err := f.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if bytes.Contains(buf, s) {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if keep := len(s) - 1; len(buf) > keep {
+			buf = buf[:copy(buf, buf[len(buf)-keep:])]
+		}
+	}
+}
@@ -0,0 +1,1363 @@
+// Package fetcher is crawler worker: it downloads URLs with heroshi
+// transport, following robots.txt, redirects and per-host limits.
+// The http-client command is a thin wrapper reading URLs and writing results.
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/temoto/http-client.go/heroshi"  // Temporary location
+	"github.com/temoto/http-client.go/limitmap" // Temporary location
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+const DefaultUserAgent = "HeroshiBot/1 (unknown_owner; +http://temoto.github.com/heroshi/)"
+const DefaultReadLimit = 10 << 20      // 10MB
+const DefaultBodyInlineLimit = 1 << 20 // 1MB
+const DefaultMaxHeaderBytes = 1 << 20  // 1MB
+const DefaultMaxHeaderLines = 1000
+
+// TCPOptions are socket options set on every TCP connection.
+type TCPOptions struct {
+	// Seconds to keep sending unsent data after Close. Negative leaves
+	// it to OS: graceful close in background. 0 resets connection at once.
+	Linger int
+	// Interval between keep-alive probes, 0 means OS default.
+	// Negative disables keep-alive.
+	KeepAlivePeriod time.Duration
+	// Disable Nagle's algorithm.
+	NoDelay bool
+}
+
+// DefaultTCPOptions reset connection on close to release it quickly.
+var DefaultTCPOptions = TCPOptions{Linger: 0, NoDelay: true}
+
+type Worker struct {
+	// When false (default), worker will obey /robots.txt
+	// when true, any URL is allowed to visit.
+	SkipRobots bool
+
+	// When false (default) worker will fetch and return response body
+	// when true only status and headers are read, see RequestOptions.SkipBody.
+	// robots.txt and sitemaps are read anyway.
+	SkipBody bool
+
+	// When false (default) worker will ask for gzip, deflate or brotli encoding
+	// and return decompressed body, when true body is returned as sent by server.
+	NoDecompress bool
+
+	// When true, gzip body of HTML or unknown type sent without
+	// Content-Encoding is decompressed, see FetchResult.SniffedGzip.
+	// Ignored with NoDecompress.
+	SniffGzip bool
+
+	// When true, text bodies are converted to UTF-8 from charset of
+	// Content-Type header or HTML <meta> tag, see FetchResult.Charset.
+	TranscodeUTF8 bool
+
+	// When true, results carry hash of decoded body, see FetchResult.ContentHash.
+	// Result of FetchRequest with the same body as earlier one gets
+	// DuplicateOf with that earlier final URL. Hashes are kept for whole run.
+	HashBodies  bool
+	contentLk   sync.Mutex
+	contentSeen map[string]string // ContentHash -> first final URL
+
+	// When true, results keep request and response headers as they were
+	// sent and received, see RequestStat.RawRequest. Costs memory.
+	Dump bool
+
+	// When true, HTTP/1 response that can't be parsed, e.g. body without
+	// status line, is result with status 200 and FetchResult.Malformed
+	// instead of error. Off by default not to hide protocol errors.
+	LenientParse bool
+
+	// When true, response with body shorter than its Content-Length fails
+	// with ErrorKindTruncated. Otherwise it's FetchResult.Incomplete with
+	// body received so far.
+	StrictLength bool
+
+	// How many redirects to follow. Default is 1.
+	FollowRedirects uint
+
+	// Status codes of responses whose Location is followed by FetchRequest,
+	// others are returned as is. nil means codes of ShouldRedirect.
+	// Method and body are repeated for 307 and 308, others are followed
+	// with GET without body, or HEAD for HEAD request.
+	RedirectCodes []int
+
+	// When true, GET requests are preceded by Probe and skipped if
+	// size or type of resource doesn't pass MaxBodySize and ContentTypes policy.
+	ProbeFirst bool
+
+	// When true, redirects to other host than of requested URL and from https
+	// to http are not followed, redirect response is returned instead.
+	SameHostRedirects bool
+
+	// If not nil, requested URLs and redirect targets for which Allow returns
+	// false fail with ErrorKindFiltered and are never downloaded.
+	// robots.txt and sitemap downloads are not filtered.
+	Allow func(*url.URL) bool
+
+	// Options of outgoing TCP connections, including to proxy.
+	// Default is DefaultTCPOptions.
+	TCP TCPOptions
+
+	// Timeout to resolve domain name (if needed) and establish TCP.
+	// Default is 1 second. 0 disables timeout.
+	ConnectTimeout time.Duration
+
+	// Timeout for single socket read or write.
+	// Default is 1 second. 0 disables timeout.
+	IOTimeout time.Duration
+	// Override IOTimeout for reading response and writing request
+	// respectively. 0 (default) means IOTimeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Timeout for whole download. This includes establishing connection,
+	// sending request, receiving response.
+	// Redirects followed by FetchRequest share this timeout.
+	// Default is 1 minute. DO NOT use 0.
+	FetchTimeout time.Duration
+
+	ReadLimit uint64
+
+	// Response with larger header block fails before body is read,
+	// see RequestOptions.MaxHeaderBytes. Default is DefaultMaxHeaderBytes
+	// and DefaultMaxHeaderLines, 0 means no limit.
+	MaxHeaderBytes int64
+	MaxHeaderLines int
+
+	// Response body is truncated at this many bytes, see FetchResult.Truncated.
+	// Default is 0, no limit.
+	MaxBodySize int64
+
+	// Body of redirect response is truncated at this many bytes when
+	// FollowRedirects is not 0, only Location matters. Default is 0, same as MaxBodySize.
+	RedirectBodyLimit int64
+
+	// Body of response with Content-Type not in ContentTypes (if not empty)
+	// or in SkipContentTypes is not downloaded, see FetchResult.Skipped.
+	// Items are media types ("text/html") or prefixes ending with slash ("image/").
+	ContentTypes     []string
+	SkipContentTypes []string
+
+	// If not empty, bodies larger than BodyInlineLimit are stored
+	// in temporary files in this directory, see FetchResult.BodyPath.
+	BodyDir string
+	// Default is 1MB.
+	BodyInlineLimit int64
+
+	// How long to keep persistent connections. Default is 60 seconds.
+	KeepaliveTimeout time.Duration
+	// How often CleanIdleConnections looks for connections idle longer than
+	// KeepaliveTimeout. 0 means half of KeepaliveTimeout, but at least a second.
+	ReapInterval time.Duration
+
+	// Maximum number of connections per domain:port pair. Default is 1.
+	// 0 means unlimited.
+	HostConcurrency uint
+
+	// Maximum number of downloads started per second to one host and in total.
+	// Default is 0, unlimited.
+	HostRateLimit float64
+	RateLimit     float64
+	hostRates     *limitmap.RateMap
+	rate          limitmap.RateLimiter
+
+	// Bytes per second of response bodies received by all downloads
+	// together. Default is 0, unlimited. Headers are not counted.
+	MaxBandwidth float64
+	bandwidth    limitmap.RateLimiter
+
+	// Results of https requests get CertExpiresSoon if server certificate
+	// expires within this time. Default is 0, no warnings.
+	CertWarnWindow time.Duration
+
+	// Headers sent with every request, including robots.txt. They override
+	// built-in User-Agent and Accept-Encoding, and are overridden by
+	// Request.Header and conditional request headers of Request.
+	DefaultHeaders http.Header
+
+	// User-Agent as it's sent to server. Empty means DefaultUserAgent.
+	// robotsAgent (product token of UserAgent) is verified against robots.txt.
+	// Call SetUserAgent after changing UserAgent directly.
+	UserAgent   string
+	robotsAgent string
+
+	// Upper bound for Crawl-delay requested in robots.txt.
+	// Default is 30 seconds. 0 disables Crawl-delay.
+	MaxCrawlDelay time.Duration
+
+	// How long to keep parsed robots.txt of a host. Default is 10 minutes.
+	// 0 disables caching, but concurrent requests still share one download.
+	RobotsTTL time.Duration
+
+	// Timeout for robots.txt download, including up to MaxRobotsRedirects
+	// redirects. 0 (default) means FetchTimeout.
+	RobotsTimeout time.Duration
+
+	// What happens to URL when robots.txt of its host can't be fetched:
+	// download failed or status is 5xx. See RobotsUnavailable* constants.
+	// Other 4xx statuses mean there is no robots.txt and everything is allowed.
+	// Result has ErrorKind of download failure, or ErrorKindRobots5xx.
+	// Failure is cached like robots.txt, see RobotsErrorTTL.
+	// Default is RobotsUnavailableDeny.
+	RobotsUnavailable string
+
+	robotsLk    sync.Mutex
+	robotsCache map[string]*robotsEntry // scheme://host -> robots.txt
+
+	// Maximum number of fetched URLs of one host in whole run, counted by
+	// host of requested URL. Further URLs fail with ErrorKindHostLimit.
+	// Default is 0, no limit. robots.txt downloads are not counted.
+	MaxPerHost  uint
+	perHostLk   sync.Mutex
+	perHostDone map[string]uint // host -> number of fetched URLs
+
+	// After this many failed downloads in a row from one host (no response
+	// or 5xx status), its URLs fail with ErrorKindCircuitOpen for BreakerCooldown.
+	// Then one download is let through, and success closes the circuit.
+	// robots.txt downloads count too. Default is 0, disabled.
+	BreakerThreshold uint
+	BreakerCooldown  time.Duration
+	breaker          *hostBreaker
+
+	crawlLk    sync.Mutex
+	crawlDelay map[string]time.Duration // host -> Crawl-delay from robots.txt
+	nextFetch  map[string]time.Time     // host -> earliest time of next download
+
+	// Results of GET requests are looked up here before download.
+	// nil (default) disables caching.
+	Cache Cache
+
+	// How long to keep resolved addresses of hosts. Default is 0, resolve
+	// for each new connection. Not used with SOCKS5 proxy, it resolves names itself.
+	DNSTTL time.Duration
+	dns    *dnsCache
+
+	// Resolves host names instead of system resolver if not nil,
+	// e.g. NewResolver for specific DNS server. Not used with SOCKS5 proxy.
+	Resolver *net.Resolver
+
+	// Address family of connections to servers: "ipv4", "ipv6" or
+	// empty (default) for any. With any, IPv6 and IPv4 addresses are raced
+	// (Happy Eyeballs, RFC 6555) unless DNSTTL, Resolver or SetMaxDNSConcurrency
+	// is set.
+	// Not used with SOCKS5 proxy.
+	IPVersion string
+
+	// Maps host:port of URLs to host:port to connect to instead, like curl
+	// --connect-to. Host header and TLS server name are not changed.
+	// Request.ConnectTo takes precedence. Not used with HTTP proxy.
+	ConnectTo map[string]string
+
+	// If not nil, all connections are made with DialContext instead of
+	// TCP dialer, e.g. over unix socket. IPVersion, DNSTTL, Resolver and SOCKS5
+	// proxy are not used then, HTTP proxy address is passed as addr.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Proxy for all requests, set with SetProxy. nil means direct connections.
+	proxy *url.URL
+
+	// Done after Abort.
+	abortCtx context.Context
+	abort    context.CancelFunc
+
+	// Set by WithIdleCleanup, NewWorkerOptions starts CleanIdleConnections then.
+	cleanIdle bool
+
+	// Cookies set by responses are sent with following requests of the same
+	// FetchRequest, i.e. redirects. If CookieJar is not nil, it's shared by all
+	// requests instead. robots.txt downloads never use cookies.
+	CookieJar http.CookieJar
+
+	// If not nil, called with final result of each FetchRequest (and Fetch),
+	// including errors, once per requested URL regardless of redirects.
+	// Not called for robots.txt and sitemap downloads. It's called in goroutine
+	// of FetchRequest before it returns, so concurrent requests call it
+	// concurrently in order of completion, not of request.
+	OnResult func(*heroshi.FetchResult)
+
+	// Counters exposed by ServeMetrics.
+	Metrics Metrics
+
+	hostLimits *limitmap.LimitMap
+	transport  *heroshi.Transport
+	// Open connections to all hosts, see SetMaxConns. nil means unlimited.
+	conns *limitmap.Semaphore
+}
+
+// Request describes one URL to fetch along with optional method, body and headers.
+// Zero Method means GET.
+type Request struct {
+	Url    *url.URL
+	Method string
+	Body   []byte
+	Header http.Header
+	// If not empty, request body is streamed from this file instead of Body.
+	// File is opened by Download, missing file is ErrorKindInput result.
+	BodyFile string
+
+	// If not empty, host:port to connect to instead of Url host, see
+	// Worker.ConnectTo. Applies to robots.txt and redirects of the same host:port.
+	ConnectTo string
+	// host:port of Url ConnectTo was given for, set by FetchRequest.
+	connectHost string
+
+	// If not zero or empty, final response must have this status code and
+	// body must contain this text, after decompression and transcoding.
+	// Otherwise result fails with ErrorKindValidation, see heroshi.FetchResult.ValidationError.
+	ExpectStatus       int
+	ExpectBodyContains string
+
+	// Validators from previous download for conditional request.
+	// Unchanged resource gets 304 reply, see FetchResult.NotModified.
+	IfNoneMatch     string
+	IfModifiedSince string
+
+	// Number of links followed from input URL to this one by caller's
+	// crawl, see ExtractLinks. Passed to FetchResult.Depth as is.
+	Depth int
+
+	// Credentials from Url userinfo, sent as basic auth.
+	user *url.Userinfo
+
+	// Request made by worker itself for robots.txt or sitemap.
+	// Content-Type filters don't apply.
+	internal bool
+
+	// Cookies of this redirect chain, set by FetchRequest.
+	jar http.CookieJar
+
+	// If not zero, overrides Worker.MaxBodySize.
+	maxBodySize int64
+
+	// Set by FetchRequestContext, nil means context.Background.
+	ctx context.Context
+
+	// End of FetchTimeout shared by redirect chain, set by FetchRequest.
+	// Zero until first download of chain starts.
+	deadline *time.Time
+
+	// If not zero, overrides Worker.FetchTimeout, see Worker.RobotsTimeout.
+	timeout time.Duration
+}
+
+// withoutUserinfo returns copy of r with credentials moved from Url to user,
+// so that they never appear in results.
+func (r *Request) withoutUserinfo() *Request {
+	if r.Url.User == nil {
+		return r
+	}
+	r2 := *r
+	u := *r.Url
+	r2.user = u.User
+	u.User = nil
+	r2.Url = &u
+	return &r2
+}
+
+// context returns ctx of r that is also done after Worker.Abort.
+// Caller must call cancel when download is over.
+func (w *Worker) context(r *Request) (context.Context, context.CancelFunc) {
+	if r.ctx == nil {
+		return w.abortCtx, func() {}
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	stop := context.AfterFunc(w.abortCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// NewWorker returns Worker with default settings, which may be changed
+// before first download. See NewWorkerOptions.
+func NewWorker() *Worker {
+	w := &Worker{
+		FollowRedirects:   1,
+		TCP:               DefaultTCPOptions,
+		ConnectTimeout:    1 * time.Second,
+		IOTimeout:         1 * time.Second,
+		FetchTimeout:      60 * time.Second,
+		ReadLimit:         DefaultReadLimit,
+		MaxHeaderBytes:    DefaultMaxHeaderBytes,
+		MaxHeaderLines:    DefaultMaxHeaderLines,
+		BodyInlineLimit:   DefaultBodyInlineLimit,
+		KeepaliveTimeout:  60 * time.Second,
+		HostConcurrency:   1,
+		UserAgent:         DefaultUserAgent,
+		MaxCrawlDelay:     30 * time.Second,
+		RobotsTTL:         10 * time.Minute,
+		RobotsUnavailable: RobotsUnavailableDeny,
+		robotsCache:       make(map[string]*robotsEntry),
+		perHostDone:       make(map[string]uint),
+		contentSeen:       make(map[string]string),
+		crawlDelay:        make(map[string]time.Duration),
+		nextFetch:         make(map[string]time.Time),
+		dns:               newDNSCache(),
+		hostLimits:        limitmap.NewLimitMap(),
+		hostRates:         limitmap.NewRateMap(),
+		breaker:           newHostBreaker(),
+		transport: &heroshi.Transport{
+			MaxIdleConnsPerHost: 1,
+		},
+	}
+	w.transport.Dial = w.Dial
+	w.abortCtx, w.abort = context.WithCancel(context.Background())
+	w.SetUserAgent(w.UserAgent)
+	return w
+}
+
+// SetProxy routes all requests via proxy at u, which is
+// http://[user:password@]host:port or socks5://[user:password@]host:port.
+// nil u means direct connections.
+func (w *Worker) SetProxy(u *url.URL) error {
+	if u == nil {
+		w.proxy = nil
+		w.transport.Proxy = nil
+		return nil
+	}
+	if u.Host == "" {
+		return errors.New("SetProxy: proxy host is empty: " + u.String())
+	}
+	switch u.Scheme {
+	case "http":
+		w.transport.Proxy = http.ProxyURL(u)
+	case "socks5":
+		// Requests are sent as usual, tunnel is set up in Dial.
+		w.transport.Proxy = nil
+	default:
+		return errors.New("SetProxy: unsupported proxy scheme: " + u.Scheme)
+	}
+	w.proxy = u
+	return nil
+}
+
+// SetTLSConfig sets configuration of https connections, e.g. to trust
+// custom CA or skip certificate verification. nil means default configuration.
+func (w *Worker) SetTLSConfig(config *tls.Config) {
+	w.transport.TLSClientConfig = config
+}
+
+// Transport returns connection pool used by w, e.g. to tune it
+// or close idle connections at exit.
+func (w *Worker) Transport() *heroshi.Transport {
+	return w.transport
+}
+
+// HostConnections returns number of hosts with downloads in progress
+// and number of those downloads, counted against HostConcurrency.
+func (w *Worker) HostConnections() (hosts, conns int) {
+	return w.hostLimits.Size()
+}
+
+// SetMaxIdleConns sets how many idle connections to each host are kept for
+// reuse until KeepaliveTimeout. 0 means HostConcurrency, or transport default
+// if that is unlimited too. Default is 1. Call before first download.
+func (w *Worker) SetMaxIdleConns(n int) {
+	if n == 0 {
+		n = int(w.HostConcurrency)
+	}
+	w.transport.MaxIdleConnsPerHost = n
+}
+
+// SetMaxDNSConcurrency limits number of host name lookups in progress,
+// connects are not limited by it. 0 (default) means unlimited.
+// Not used with SOCKS5 proxy. Call before first download.
+func (w *Worker) SetMaxDNSConcurrency(n uint) {
+	w.dns.slots = nil
+	if n != 0 {
+		w.dns.slots = limitmap.NewSemaphore(n)
+	}
+}
+
+// SetMaxConns limits number of open connections to all hosts together,
+// idle ones included, e.g. to stay within limit of file descriptors.
+// Connecting past the limit closes idle connections and waits until some
+// connection is closed, rather than failing. 0 (default) means unlimited.
+// Call before first download.
+func (w *Worker) SetMaxConns(n uint) {
+	w.conns = nil
+	if n != 0 {
+		w.conns = limitmap.NewSemaphore(n)
+	}
+}
+
+// SetUserAgent sets User-Agent header value and robots.txt agent derived from it.
+// Empty ua means DefaultUserAgent.
+func (w *Worker) SetUserAgent(ua string) {
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	w.UserAgent = ua
+	w.robotsAgent = ProductToken(ua)
+}
+
+// Downloads url and returns whatever result was.
+// This function WILL NOT follow redirects.
+// Every download, including /robots.txt, counts against HostConcurrency.
+// FetchTimeout starts after waiting for per-host slot, Crawl-delay and rate limits.
+// In FetchRequest it starts with first download and is shared by redirects.
+func (w *Worker) Download(r *Request) (result *heroshi.FetchResult) {
+	url := r.Url
+	ctx, cancel := w.context(r)
+	defer cancel()
+	if ctx.Err() != nil {
+		return heroshi.ErrorKindResult(url, heroshi.ErrorKindAborted, "Fetch aborted")
+	}
+	if w.HostConcurrency != 0 {
+		if w.hostLimits.AcquireContext(ctx, url.Host, w.HostConcurrency) != nil {
+			return heroshi.ErrorKindResult(url, heroshi.ErrorKindAborted, "Fetch aborted")
+		}
+		defer w.hostLimits.Release(url.Host)
+	}
+	crawlDelay := w.waitCrawlDelay(ctx, url.Host)
+	if w.hostRates.Wait(ctx, url.Host, w.HostRateLimit) != nil || w.rate.Wait(ctx, w.RateLimit) != nil {
+		return heroshi.ErrorKindResult(url, heroshi.ErrorKindAborted, "Fetch aborted")
+	}
+	if w.BreakerThreshold != 0 {
+		if !w.breaker.allow(url.Host, time.Now()) {
+			return heroshi.ErrorKindResult(url, heroshi.ErrorKindCircuitOpen, "Circuit open: "+url.Host)
+		}
+		defer func() {
+			w.breaker.record(url.Host, breakerFailure(result), result.ErrorKind == heroshi.ErrorKindAborted,
+				w.BreakerThreshold, w.BreakerCooldown, time.Now())
+		}()
+	}
+
+	atomic.AddInt64(&w.Metrics.inFlight, 1)
+	started := time.Now()
+	defer func() {
+		atomic.AddInt64(&w.Metrics.inFlight, -1)
+		w.Metrics.addDownload(result, url.Host, time.Since(started))
+	}()
+
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+	var body io.Reader
+	var bodySize int64
+	if r.BodyFile != "" {
+		f, size, err := openBodyFile(r.BodyFile)
+		if err != nil {
+			result = heroshi.ErrorKindResult(url, heroshi.ErrorKindInput, "Body file: "+err.Error())
+			result.Method = method
+			return result
+		}
+		defer f.Close()
+		body, bodySize = f, size
+	} else if len(r.Body) != 0 {
+		body = bytes.NewReader(r.Body)
+	}
+	req, err := http.NewRequest(method, url.String(), body)
+	if err != nil {
+		result = heroshi.ErrorKindResult(url, heroshi.ErrorKindInvalidURL, err.Error())
+		result.Method = method
+		return result
+	}
+	if r.BodyFile != "" {
+		// Known size is sent as Content-Length instead of chunked.
+		req.ContentLength = bodySize
+	}
+	req.Header.Set("User-Agent", w.UserAgent)
+	if r.user != nil {
+		password, _ := r.user.Password()
+		req.SetBasicAuth(r.user.Username(), password)
+	}
+	if !w.NoDecompress {
+		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	}
+	for k, v := range w.DefaultHeaders {
+		req.Header[k] = v
+	}
+	if r.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", r.IfNoneMatch)
+	}
+	if r.IfModifiedSince != "" {
+		req.Header.Set("If-Modified-Since", r.IfModifiedSince)
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	cookiesUsed := false
+	if r.jar != nil {
+		for _, cookie := range r.jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+			cookiesUsed = true
+		}
+	}
+
+	options := &heroshi.RequestOptions{
+		ConnectTo:        w.connectTo(r, url),
+		ConnectTimeout:   w.ConnectTimeout,
+		ReadTimeout:      orDefault(w.ReadTimeout, w.IOTimeout),
+		WriteTimeout:     orDefault(w.WriteTimeout, w.IOTimeout),
+		ReadLimit:        w.ReadLimit,
+		MaxHeaderBytes:   w.MaxHeaderBytes,
+		MaxHeaderLines:   w.MaxHeaderLines,
+		KeepaliveTimeout: w.KeepaliveTimeout,
+		Stat:             new(heroshi.RequestStat),
+		Decompress:       !w.NoDecompress,
+		TranscodeUTF8:    w.TranscodeUTF8,
+		SniffGzip:        w.SniffGzip,
+		HashBody:         w.HashBodies,
+		Dump:             w.Dump,
+		Lenient:          w.LenientParse,
+		StrictLength:     w.StrictLength,
+		BodyDir:          w.BodyDir,
+		BodyInlineLimit:  w.BodyInlineLimit,
+		MaxBodySize:      w.MaxBodySize,
+	}
+	if r.maxBodySize != 0 {
+		options.MaxBodySize = r.maxBodySize
+	}
+	if w.FollowRedirects != 0 {
+		options.RedirectBodyLimit = w.RedirectBodyLimit
+	}
+	if !r.internal {
+		options.ContentTypes = w.ContentTypes
+		options.SkipContentTypes = w.SkipContentTypes
+		options.SkipBody = w.SkipBody
+	}
+	fetchTimeout := w.FetchTimeout
+	if r.timeout != 0 {
+		fetchTimeout = r.timeout
+	}
+	timeout := fetchTimeout
+	if r.deadline != nil {
+		if r.deadline.IsZero() {
+			*r.deadline = time.Now().Add(fetchTimeout)
+		}
+		timeout = time.Until(*r.deadline)
+		if timeout <= 0 {
+			result = heroshi.ErrorKindResult(url, heroshi.ErrorKindTimeout,
+				fmt.Sprintf("Fetch timeout: %d", fetchTimeout/time.Millisecond))
+			result.Method = method
+			return result
+		}
+	}
+	fetchCtx, fetchCancel := context.WithTimeout(ctx, timeout)
+	if w.MaxBandwidth > 0 {
+		options.Throttle = func(n int) error {
+			return w.bandwidth.WaitN(fetchCtx, n, w.MaxBandwidth)
+		}
+	}
+	result = heroshi.FetchContext(fetchCtx, w.transport, req, options)
+	fetchCancel()
+	result.Method = method
+	result.RequestHeaders = req.Header
+	result.CookiesUsed = cookiesUsed
+	result.CrawlDelay = uint(crawlDelay / time.Millisecond)
+	if w.CertWarnWindow != 0 && result.Stat != nil && !result.Stat.TLSCertExpires.IsZero() {
+		result.CertExpiresSoon = time.Until(result.Stat.TLSCertExpires) < w.CertWarnWindow
+	}
+
+	return result
+}
+
+// openBodyFile opens request body file and returns its size.
+func openBodyFile(path string) (*os.File, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// CacheOrDownload returns cached result of GET request or downloads it
+// and stores result in cache if response status allows that.
+// Without Cache it is the same as Download.
+func (w *Worker) CacheOrDownload(r *Request) *heroshi.FetchResult {
+	if w.Cache == nil || !cacheableRequest(r) {
+		return w.Download(r)
+	}
+
+	key := r.Url.String()
+	if cached, ok := w.Cache.Get(key); ok {
+		result := copyResult(cached)
+		result.Cached = true
+		return result
+	}
+
+	result := w.Download(r)
+	if result.Success && cacheableStatus(result.StatusCode) {
+		// Caller may modify result, cache a copy.
+		w.Cache.Set(key, copyResult(result))
+	}
+	return result
+}
+
+// copyResult returns copy of result with its own Stat, which FetchRequest
+// modifies.
+func copyResult(result *heroshi.FetchResult) *heroshi.FetchResult {
+	r := *result
+	if r.Stat != nil {
+		stat := *r.Stat
+		r.Stat = &stat
+	}
+	return &r
+}
+
+// markDuplicate sets result.DuplicateOf to first final URL seen with the
+// same ContentHash, or remembers final URL of result if there is none.
+func (w *Worker) markDuplicate(result *heroshi.FetchResult) {
+	u := result.Url.String()
+	if result.FinalUrl != nil {
+		u = result.FinalUrl.String()
+	}
+	w.contentLk.Lock()
+	first, ok := w.contentSeen[result.ContentHash]
+	if !ok {
+		w.contentSeen[result.ContentHash] = u
+	}
+	w.contentLk.Unlock()
+	if ok && first != u {
+		result.DuplicateOf = first
+	}
+}
+
+// Probe asks server about size and type of r.Url with HEAD request or,
+// if HEAD is not allowed, with GET of first byte. Returns false if resource is
+// larger than MaxBodySize or its type doesn't pass ContentTypes and SkipContentTypes.
+// In that case result has response headers, Skipped and SkipReason.
+// Probe errors are not a reason to skip.
+func (w *Worker) Probe(r *Request) (bool, *heroshi.FetchResult) {
+	probe := &Request{Url: r.Url, Method: "HEAD", Header: r.Header, user: r.user, jar: r.jar, internal: true, ctx: r.ctx,
+		ConnectTo: r.ConnectTo, connectHost: r.connectHost}
+	result := w.Download(probe)
+	if result.StatusCode == http.StatusMethodNotAllowed || result.StatusCode == http.StatusNotImplemented {
+		probe.Method = "GET"
+		probe.Header = make(http.Header, len(r.Header)+1)
+		for k, v := range r.Header {
+			probe.Header[k] = v
+		}
+		probe.Header.Set("Range", "bytes=0-0")
+		// Server may ignore Range.
+		probe.maxBodySize = 1
+		result = w.Download(probe)
+	}
+	if !result.Success || result.StatusCode >= 300 {
+		return true, result
+	}
+
+	size := int64(-1)
+	if result.StatusCode == http.StatusPartialContent {
+		// Content-Range: bytes 0-0/12345
+		contentRange := result.Headers.Get("Content-Range")
+		if i := strings.LastIndexByte(contentRange, '/'); i != -1 {
+			if n, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				size = n
+			}
+		}
+	} else if n, err := strconv.ParseInt(result.Headers.Get("Content-Length"), 10, 64); err == nil {
+		size = n
+	}
+
+	reason := heroshi.ContentTypeSkipReason(result.Headers.Get("Content-Type"), w.ContentTypes, w.SkipContentTypes)
+	if reason == "" && w.MaxBodySize > 0 && size > w.MaxBodySize {
+		reason = fmt.Sprintf("Content-Length %d exceeds %d", size, w.MaxBodySize)
+	}
+	if reason == "" {
+		return true, result
+	}
+	result.Body = nil
+	result.Skipped = true
+	result.SkipReason = reason
+	return false, result
+}
+
+// Fetch is a shortcut for FetchRequest with a plain GET of url.
+func (w *Worker) Fetch(url *url.URL) (result *heroshi.FetchResult) {
+	return w.FetchRequest(&Request{Url: url})
+}
+
+// FetchContext is Fetch that gives up when ctx is done.
+func (w *Worker) FetchContext(ctx context.Context, url *url.URL) (result *heroshi.FetchResult) {
+	return w.FetchRequestContext(ctx, &Request{Url: url})
+}
+
+// FetchRequestContext is FetchRequest that gives up when ctx is done,
+// including waits for per-host slot and Crawl-delay. Deadline of ctx applies to
+// whole redirect chain, as FetchTimeout does.
+// robots.txt downloads are shared between requests and don't use ctx.
+func (w *Worker) FetchRequestContext(ctx context.Context, r *Request) (result *heroshi.FetchResult) {
+	r2 := *r
+	r2.ctx = ctx
+	return w.FetchRequest(&r2)
+}
+
+// FetchRequest checks robots.txt, downloads r and follows redirects.
+// 307 and 308 redirects repeat method and body, others are followed with
+// GET without body, see RedirectCodes.
+func (w *Worker) FetchRequest(r *Request) (result *heroshi.FetchResult) {
+	r = r.withoutUserinfo()
+	if w.OnResult != nil && !r.internal {
+		// Deferred first to run last, after result is complete.
+		defer func() { w.OnResult(result) }()
+	}
+	url := r.Url
+	original_url := url
+	final_url := url
+	expect := r
+	var chain []heroshi.Redirect
+	cookiesUsed := false
+	robotsStatus := ""
+	started := time.Now()
+	defer func() {
+		if result != nil {
+			ended := time.Now()
+			result.TotalTime = uint((ended.Sub(started)) / time.Millisecond)
+			if result.Method == "" {
+				result.Method = r.Method
+			}
+			result.RequestedUrl = original_url
+			result.FinalUrl = final_url
+			result.RedirectChain = chain
+			result.CookiesUsed = cookiesUsed
+			result.Depth = r.Depth
+			if robotsStatus != "" {
+				result.RobotsStatus = robotsStatus
+			}
+			if result.Success {
+				validate(result, expect)
+			}
+			if result.ContentHash != "" && !r.internal {
+				w.markDuplicate(result)
+			}
+		}
+	}()
+
+	countPerHost := w.MaxPerHost != 0 && !r.internal
+	if countPerHost {
+		// Slot is reserved right away, so concurrent fetches can't pass the limit.
+		w.perHostLk.Lock()
+		done := w.perHostDone[url.Host]
+		if done < w.MaxPerHost {
+			w.perHostDone[url.Host]++
+		}
+		w.perHostLk.Unlock()
+		if done >= w.MaxPerHost {
+			return heroshi.ErrorKindResult(url, heroshi.ErrorKindHostLimit,
+				fmt.Sprintf("Host limit: %d URLs of %s already fetched", done, url.Host))
+		}
+	}
+	downloaded := false
+	defer func() {
+		if countPerHost && !downloaded {
+			// Nothing was fetched, release the slot.
+			w.perHostLk.Lock()
+			w.perHostDone[original_url.Host]--
+			w.perHostLk.Unlock()
+		}
+	}()
+
+	if !r.internal {
+		jar := w.CookieJar
+		if jar == nil {
+			jar, _ = cookiejar.New(nil)
+		}
+		r2 := *r
+		r2.jar = jar
+		r = &r2
+	}
+	if r.deadline == nil {
+		r2 := *r
+		r2.deadline = new(time.Time)
+		r = &r2
+	}
+	if r.ConnectTo != "" && r.connectHost == "" {
+		r2 := *r
+		r2.connectHost = urlAddr(url)
+		r = &r2
+	}
+
+	// URLs seen in this redirect chain.
+	visited := make(map[string]bool)
+	for redirect := uint(0); redirect <= w.FollowRedirects; redirect++ {
+		if url.Scheme == "" || url.Host == "" {
+			return heroshi.ErrorKindResult(url, heroshi.ErrorKindInvalidURL, "Incorrect URL: "+url.String())
+		}
+		if w.Allow != nil && !r.internal && !w.Allow(url) {
+			return heroshi.ErrorKindResult(url, heroshi.ErrorKindFiltered, "Filtered")
+		}
+
+		// The /robots.txt is always allowed, check others.
+		if w.SkipRobots {
+			robotsStatus = heroshi.RobotsStatusSkipped
+		} else if url.Path == "/robots.txt" {
+			robotsStatus = heroshi.RobotsStatusSelf
+		} else {
+			var allow bool
+			var robotsResult *heroshi.FetchResult
+			allow, _, robotsResult = w.askRobotsRule(url, r)
+			if !allow {
+				if robotsResult.RobotsStatus == heroshi.RobotsStatusDisallowed {
+					atomic.AddUint64(&w.Metrics.robotsDisallowed, 1)
+				}
+				robotsStatus = robotsResult.RobotsStatus
+				return robotsResult
+			}
+			robotsStatus = heroshi.RobotsStatusAllowed
+			if robotsResult != nil {
+				// Allowed by RobotsUnavailableAllow.
+				robotsStatus = robotsResult.RobotsStatus
+			}
+		}
+
+		visited[visitKey(url)] = true
+		final_url = url
+		downloaded = true
+		var probeTime time.Duration
+		if w.ProbeFirst && !r.internal && (r.Method == "" || r.Method == "GET") {
+			probeStarted := time.Now()
+			ok, probe := w.Probe(r)
+			probeTime = time.Since(probeStarted)
+			if !ok {
+				return probe
+			}
+		}
+		result = w.CacheOrDownload(r)
+		if result.Stat != nil {
+			result.Stat.ProbeTime = probeTime
+		}
+		cookiesUsed = cookiesUsed || result.CookiesUsed
+		if r.jar != nil && result.Headers != nil {
+			if cookies := (&http.Response{Header: result.Headers}).Cookies(); len(cookies) != 0 {
+				r.jar.SetCookies(url, cookies)
+			}
+		}
+		if w.shouldRedirect(result.StatusCode) {
+			next_url, err := url.Parse(result.Headers.Get("Location"))
+			if err != nil {
+				return heroshi.ErrorKindResult(original_url, heroshi.ErrorKindInvalidURL, err.Error())
+			}
+			if w.SameHostRedirects && !safeRedirect(original_url, url, next_url) {
+				// Caller gets redirect response with Location as is.
+				return result
+			}
+			hop := heroshi.Redirect{Url: url, StatusCode: result.StatusCode}
+			traceRedirect(&hop, result.Headers)
+			chain = append(chain, hop)
+			url = next_url
+			if visited[visitKey(url)] {
+				return heroshi.ErrorKindResult(original_url, heroshi.ErrorKindRedirectLoop, "Redirect loop detected: "+url.String())
+			}
+			next := &Request{Url: url, internal: r.internal, jar: r.jar, ctx: r.ctx, deadline: r.deadline,
+				ConnectTo: r.ConnectTo, connectHost: r.connectHost}
+			// Keep credentials only while on the same host.
+			if url.Host == r.Url.Host && url.User == nil {
+				next.user = r.user
+			}
+			var keepBody bool
+			next.Method, keepBody = redirectMethod(result.StatusCode, r.Method)
+			if keepBody {
+				// Request is repeated as is, headers may be secret to other hosts.
+				next.Body, next.BodyFile = r.Body, r.BodyFile
+				if url.Host == r.Url.Host {
+					next.Header = r.Header
+				}
+			}
+			r = next.withoutUserinfo()
+			url = r.Url
+			atomic.AddUint64(&w.Metrics.redirects, 1)
+			continue
+		}
+
+		// no redirects required
+		return result
+	}
+	return result
+}
+
+// redirectMethod returns method of request following redirect response
+// with statusCode to request with method, and whether body is sent again.
+// 307 and 308 repeat request as is (RFC 7231, 7538). 303 and, as most
+// clients do, 301 and 302 turn it into GET without body, except HEAD.
+func redirectMethod(statusCode int, method string) (string, bool) {
+	if method == "" {
+		method = "GET"
+	}
+	switch {
+	case statusCode == http.StatusTemporaryRedirect || statusCode == http.StatusPermanentRedirect:
+		return method, true
+	case method == "HEAD":
+		return method, false
+	}
+	return "GET", false
+}
+
+// Header bytes kept per redirect in RedirectChain, so long chains with
+// huge cookies don't hold much memory. Set-Cookie values past this size are dropped.
+const redirectTraceLimit = 8 << 10
+
+// traceRedirect copies headers of redirect response to hop.
+func traceRedirect(hop *heroshi.Redirect, header http.Header) {
+	hop.Location = header.Get("Location")
+	if len(hop.Location) > redirectTraceLimit {
+		hop.Location = hop.Location[:redirectTraceLimit]
+	}
+	size := len(hop.Location)
+	for _, cookie := range header["Set-Cookie"] {
+		if size += len(cookie); size > redirectTraceLimit {
+			break
+		}
+		hop.SetCookie = append(hop.SetCookie, cookie)
+	}
+}
+
+// safeRedirect tells whether redirect from url to next stays on host of
+// original URL and doesn't downgrade https to http.
+func safeRedirect(original, url, next *url.URL) bool {
+	return strings.EqualFold(next.Host, original.Host) &&
+		!(url.Scheme == "https" && next.Scheme != "https")
+}
+
+// visitKey identifies URL for redirect loop detection. Fragment is never sent
+// to server, so it does not make a different URL.
+func visitKey(u *url.URL) string {
+	u2 := *u
+	u2.Fragment = ""
+	return u2.String()
+}
+
+// connectTo returns address to connect to for u instead of its own,
+// empty if there is no override.
+func (w *Worker) connectTo(r *Request, u *url.URL) string {
+	addr := urlAddr(u)
+	if r.ConnectTo != "" && (r.connectHost == "" || r.connectHost == addr) {
+		return r.ConnectTo
+	}
+	return w.ConnectTo[addr]
+}
+
+// orDefault returns timeout, or def if timeout is 0.
+func orDefault(timeout, def time.Duration) time.Duration {
+	if timeout == 0 {
+		return def
+	}
+	return timeout
+}
+
+// urlAddr returns host:port of u with default port of scheme if there is none.
+func urlAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (w *Worker) setCrawlDelay(host string, delay time.Duration) {
+	if delay > w.MaxCrawlDelay {
+		delay = w.MaxCrawlDelay
+	}
+	w.crawlLk.Lock()
+	if delay > 0 {
+		w.crawlDelay[host] = delay
+	} else {
+		delete(w.crawlDelay, host)
+		delete(w.nextFetch, host)
+	}
+	w.crawlLk.Unlock()
+}
+
+// Reserves next download slot for host according to Crawl-delay
+// and sleeps until then. Returns time slept.
+func (w *Worker) waitCrawlDelay(ctx context.Context, host string) time.Duration {
+	w.crawlLk.Lock()
+	delay, ok := w.crawlDelay[host]
+	if !ok {
+		w.crawlLk.Unlock()
+		return 0
+	}
+	now := time.Now()
+	next := w.nextFetch[host]
+	if next.Before(now) {
+		next = now
+	}
+	w.nextFetch[host] = next.Add(delay)
+	w.crawlLk.Unlock()
+
+	wait := next.Sub(now)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	return wait
+}
+
+// Abort makes all downloads in progress and future ones fail with "Fetch aborted"
+// as soon as possible. Downloads waiting for per-host slot or Crawl-delay
+// give up too. Worker can't be used after Abort.
+func (w *Worker) Abort() {
+	w.abort()
+}
+
+// Close aborts downloads in progress like Abort, closes all persistent
+// connections and stops CleanIdleConnections. Worker can't be used after Close.
+func (w *Worker) Close() {
+	w.abort()
+	w.transport.CloseIdleConnections(true)
+}
+
+// CleanIdleConnections closes persistent connections idle longer than
+// KeepaliveTimeout every ReapInterval, until stop is closed or Worker
+// is closed or aborted. stop may be nil. Run it in a goroutine.
+func (w *Worker) CleanIdleConnections(stop <-chan bool) {
+	interval := w.ReapInterval
+	if interval <= 0 {
+		interval = w.KeepaliveTimeout / 2
+		if interval < time.Second {
+			interval = time.Second
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.transport.CloseIdleConnections(false)
+		case <-stop:
+			return
+		case <-w.abortCtx.Done():
+			return
+		}
+	}
+}
+
+// PoolStats returns number of hosts with open connections, idle connections
+// kept for reuse and connections in use.
+func (w *Worker) PoolStats() (hosts, idle, active int) {
+	return w.transport.Stats()
+}
+
+// Dial connects to addr directly or through SOCKS5 proxy set with SetProxy,
+// or with DialContext if it is set.
+// HTTP proxy is handled by transport, so it's dialed directly here.
+// Connection is counted against SetMaxConns until closed.
+func (w *Worker) Dial(netw, addr string, options *heroshi.RequestOptions) (net.Conn, error) {
+	if w.conns == nil {
+		return w.connect(netw, addr, options)
+	}
+	if err := w.acquireConn(); err != nil {
+		return nil, err
+	}
+	conn, err := w.connect(netw, addr, options)
+	if err != nil {
+		w.conns.Release()
+		return nil, err
+	}
+	return &slotConn{Conn: conn, slots: w.conns}, nil
+}
+
+// How often Dial waiting for SetMaxConns slot closes idle connections.
+const connSlotRecheck = 50 * time.Millisecond
+
+// acquireConn takes SetMaxConns slot. Idle connections hold slots too
+// and connections in use may become idle instead of closed, so they
+// are closed while waiting. Fails only after Abort.
+func (w *Worker) acquireConn() error {
+	for {
+		if _, ok := w.conns.TryAcquire(); ok {
+			return nil
+		}
+		w.transport.CloseIdleConnections(true)
+		ctx, cancel := context.WithTimeout(w.abortCtx, connSlotRecheck)
+		_, err := w.conns.AcquireContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if w.abortCtx.Err() != nil {
+			return w.abortCtx.Err()
+		}
+	}
+}
+
+// slotConn releases slot of SetMaxConns once it's closed.
+type slotConn struct {
+	net.Conn
+	slots    *limitmap.Semaphore
+	released sync.Once
+}
+
+func (c *slotConn) Close() error {
+	err := c.Conn.Close()
+	c.released.Do(func() { c.slots.Release() })
+	return err
+}
+
+func (w *Worker) connect(netw, addr string, options *heroshi.RequestOptions) (net.Conn, error) {
+	if w.DialContext != nil {
+		ctx := context.Background()
+		if options != nil && options.ConnectTimeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+			defer cancel()
+		}
+		conn, err := w.DialContext(ctx, netw, addr)
+		if err != nil {
+			return nil, err
+		}
+		w.TCP.apply(conn)
+		return conn, nil
+	}
+	if w.proxy == nil || w.proxy.Scheme != "socks5" {
+		if netw == "tcp" {
+			switch w.IPVersion {
+			case "ipv4":
+				netw = "tcp4"
+			case "ipv6":
+				netw = "tcp6"
+			}
+		}
+		if w.DNSTTL <= 0 && w.dns.slots == nil && w.Resolver == nil {
+			// net.Dial itself tries all addresses of host.
+			return dial(netw, addr, options, w.TCP)
+		}
+		var timeout time.Duration
+		var stat *heroshi.RequestStat
+		if options != nil {
+			timeout = options.ConnectTimeout
+			stat = options.Stat
+		}
+		dial := func(netw, addr string, timeout time.Duration) (net.Conn, error) {
+			if options == nil {
+				return dial(netw, addr, nil, w.TCP)
+			}
+			attempt := *options
+			attempt.ConnectTimeout = timeout
+			return dial(netw, addr, &attempt, w.TCP)
+		}
+		return w.dialCached(netw, addr, dial, timeout, stat)
+	}
+
+	var auth *proxy.Auth
+	if w.proxy.User != nil {
+		password, _ := w.proxy.User.Password()
+		auth = &proxy.Auth{User: w.proxy.User.Username(), Password: password}
+	}
+	forward := &net.Dialer{}
+	if options != nil {
+		forward.Timeout = options.ConnectTimeout
+	}
+	dialer, err := proxy.SOCKS5("tcp", w.proxy.Host, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if cd, ok := dialer.(proxy.ContextDialer); ok && forward.Timeout != 0 {
+		// Timeout covers SOCKS handshake, not only TCP connect to proxy.
+		ctx, cancel := context.WithTimeout(context.Background(), forward.Timeout)
+		defer cancel()
+		conn, err = cd.DialContext(ctx, netw, addr)
+	} else {
+		conn, err = dialer.Dial(netw, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.TCP.apply(conn)
+	return conn, nil
+}
+
+// Dial connects to addr with DefaultTCPOptions.
+func Dial(netw, addr string, options *heroshi.RequestOptions) (net.Conn, error) {
+	return dial(netw, addr, options, DefaultTCPOptions)
+}
+
+func dial(netw, addr string, options *heroshi.RequestOptions, tcp TCPOptions) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if options != nil && options.ConnectTimeout != 0 {
+		conn, err = net.DialTimeout(netw, addr, options.ConnectTimeout)
+	} else {
+		conn, err = net.Dial(netw, addr)
+	}
+	if err != nil {
+		return conn, err
+	}
+	tcp.apply(conn)
+	return conn, nil
+}
+
+// apply sets options on conn if it is TCP, other connections are left as is.
+func (o TCPOptions) apply(conn net.Conn) {
+	tcp_conn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tcp_conn.SetKeepAlive(o.KeepAlivePeriod >= 0)
+	if o.KeepAlivePeriod > 0 {
+		tcp_conn.SetKeepAlivePeriod(o.KeepAlivePeriod)
+	}
+	tcp_conn.SetLinger(o.Linger)
+	tcp_conn.SetNoDelay(o.NoDelay)
+}
+
+// ProductToken returns product name of User-Agent string, that is
+// "HeroshiBot" for "HeroshiBot/1 (+http://...)".
+func ProductToken(ua string) string {
+	ua = strings.TrimSpace(ua)
+	i := strings.IndexFunc(ua, func(r rune) bool { return r == '/' || unicode.IsSpace(r) })
+	if i != -1 {
+		return ua[0:i]
+	}
+	return ua
+}
+
+// True if the specified HTTP status code is one for which the Get utility should
+// automatically redirect.
+func ShouldRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		//
+		return true
+	}
+	return false
+}
+
+// shouldRedirect tells whether statusCode is in RedirectCodes.
+func (w *Worker) shouldRedirect(statusCode int) bool {
+	if w.RedirectCodes == nil {
+		return ShouldRedirect(statusCode)
+	}
+	for _, code := range w.RedirectCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1865 @@
+package fetcher
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testWorker() *Worker {
+	w := NewWorker()
+	w.SkipRobots = true
+	return w
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal("url.Parse:", err.Error())
+	}
+	return u
+}
+
+func TestBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("welcome"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	u := mustParse(t, server.URL+"/private")
+	u.User = url.UserPassword("user", "secret")
+	result := worker.Fetch(u)
+	if result.StatusCode != http.StatusOK || string(result.Body) != "welcome" {
+		t.Fatal("Expected 200 welcome, got:", result.Status, string(result.Body))
+	}
+	if result.Url.User != nil || strings.Contains(result.Url.String(), "secret") {
+		t.Fatal("Credentials leaked into result Url:", result.Url)
+	}
+	if u.User == nil {
+		t.Fatal("Fetch modified caller URL")
+	}
+
+	result = worker.Fetch(mustParse(t, server.URL+"/private"))
+	if result.StatusCode != http.StatusUnauthorized {
+		t.Fatal("Expected 401 without credentials, got:", result.Status)
+	}
+}
+
+func TestDNSCacheRoundRobin(t *testing.T) {
+	c := newDNSCache()
+	now := time.Now()
+	c.set("example.com", []string{"192.0.2.1", "2001:db8::1"}, now.Add(time.Minute))
+
+	// First address is taken by lookup itself.
+	for _, expected := range []string{"2001:db8::1", "192.0.2.1", "2001:db8::1"} {
+		if addrs, ok := c.get("example.com", now); !ok || addrs[0] != expected || len(addrs) != 2 {
+			t.Fatal("Expected", expected, "first, got:", addrs, ok)
+		}
+	}
+	if _, ok := c.get("example.com", now.Add(2*time.Minute)); ok {
+		t.Fatal("Expired entry returned")
+	}
+	if _, ok := c.get("example.com", now); ok {
+		t.Fatal("Expired entry not removed")
+	}
+}
+
+func TestIPVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.IPVersion = "ipv4"
+	result := worker.Fetch(mustParse(t, server.URL))
+	if !result.Success || result.Stat.IPVersion != "ipv4" {
+		t.Fatal("Expected success over ipv4, got:", result.Status, result.Stat.IPVersion)
+	}
+
+	worker = testWorker()
+	worker.IPVersion = "ipv6"
+	if result := worker.Fetch(mustParse(t, server.URL)); result.Success {
+		t.Fatal("Expected IPv4 server unreachable over ipv6")
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.TCP = TCPOptions{Linger: -1, KeepAlivePeriod: 15 * time.Second}
+	if result := worker.Fetch(mustParse(t, server.URL)); !result.Success {
+		t.Fatal("Expected success with graceful close, got:", result.Status)
+	}
+
+	// Options are not for other kinds of connections.
+	dir, err := ioutil.TempDir("", "http-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := Dial("unix", path, nil)
+	if err != nil {
+		t.Fatal("Expected unix socket dialed, got:", err)
+	}
+	conn.Close()
+}
+
+func TestDialCachedEvict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.DNSTTL = time.Minute
+	// Stale address which refuses connections.
+	worker.dns.set("localhost", []string{"192.0.2.1", "192.0.2.1"}, time.Now().Add(time.Minute))
+	worker.ConnectTimeout = 100 * time.Millisecond
+	u := mustParse(t, server.URL)
+	u.Host = "localhost:" + u.Port()
+	result := worker.Fetch(u)
+	if result.StatusCode != http.StatusOK {
+		t.Fatal("Expected 200 after re-resolve, got:", result.Status)
+	}
+}
+
+func TestDialCachedFailover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.DNSTTL = time.Minute
+	worker.ConnectTimeout = 200 * time.Millisecond
+	// Name doesn't resolve, so only cached addresses may succeed.
+	// Round-robin starts from second address, the dead one.
+	worker.dns.set("dual.invalid", []string{"127.0.0.1", "192.0.2.1"}, time.Now().Add(time.Minute))
+	u := mustParse(t, server.URL)
+	u.Host = "dual.invalid:" + u.Port()
+	result := worker.Fetch(u)
+	if result.StatusCode != http.StatusOK || result.Stat.RemoteAddr.String() != "127.0.0.1:"+u.Port() {
+		t.Fatal("Expected 200 from live address, got:", result.Status, result.Stat)
+	}
+}
+
+func TestMaxDNSConcurrency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.HostConcurrency = 0
+	worker.SetMaxDNSConcurrency(2)
+	var inFlight, maxInFlight int32
+	worker.dns.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if host == "fail.invalid" {
+			return nil, &net.DNSError{Err: "no such host", Name: host}
+		}
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+
+	port := mustParse(t, server.URL).Port()
+	done := make(chan *heroshi.FetchResult)
+	for i := 0; i < 8; i++ {
+		host := fmt.Sprintf("h%d.invalid", i)
+		if i%2 == 0 {
+			host = "fail.invalid"
+		}
+		go func(host string) {
+			done <- worker.Fetch(mustParse(t, "http://"+host+":"+port+"/"))
+		}(host)
+	}
+	for i := 0; i < 8; i++ {
+		result := <-done
+		if result.Url.Host[:4] == "fail" {
+			if result.ErrorKind != heroshi.ErrorKindDNS {
+				t.Error("Expected DNS error, got:", result.ErrorKind, result.Status)
+			}
+		} else if result.StatusCode != http.StatusOK {
+			t.Error("Expected 200, got:", result.Status)
+		}
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max != 2 {
+		t.Fatal("Expected 2 concurrent lookups at most, got:", max)
+	}
+}
+
+// serveDNS answers A queries on conn with 127.0.0.1 and other queries with
+// no records, counting queries in n.
+func serveDNS(conn net.PacketConn, n *int32) {
+	buf := make([]byte, 512)
+	for {
+		size, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(n, 1)
+		q := buf[:size]
+		// Question starts after 12 bytes of header: name, type, class.
+		end := 12
+		for end < len(q) && q[end] != 0 {
+			end += int(q[end]) + 1
+		}
+		end += 5
+		if end > len(q) {
+			continue
+		}
+		resp := append([]byte{q[0], q[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, q[12:end]...)
+		if q[end-4] == 0 && q[end-3] == 1 {
+			resp[7] = 1
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+		}
+		conn.WriteTo(resp, addr)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dns.Close()
+	var queries int32
+	go serveDNS(dns, &queries)
+
+	worker := testWorker()
+	worker.Resolver, err = NewResolver("udp://" + dns.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := worker.Fetch(mustParse(t, "http://crawl.test:"+mustParse(t, server.URL).Port()+"/"))
+	if result.StatusCode != http.StatusOK {
+		t.Fatal("Expected 200 via custom resolver, got:", result.Status)
+	}
+	if atomic.LoadInt32(&queries) == 0 {
+		t.Fatal("Expected queries to custom resolver")
+	}
+	if result.Stat.DNSTime <= 0 || result.Stat.DNSTime > result.Stat.ConnectTime {
+		t.Fatal("Expected DNSTime within ConnectTime, got:", result.Stat.DNSTime, result.Stat.ConnectTime)
+	}
+
+	for _, s := range []string{"1.1.1.1:53", "http://1.1.1.1", "udp://", "udp://:53"} {
+		if _, err := NewResolver(s); err == nil {
+			t.Error("Expected error for", s)
+		}
+	}
+	if _, err := NewResolver("tcp://[::1]"); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+// countedConn decrements open when closed.
+type countedConn struct {
+	net.Conn
+	open *int32
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(c.open, -1) })
+	return c.Conn.Close()
+}
+
+func TestMaxConns(t *testing.T) {
+	var servers []*httptest.Server
+	for i := 0; i < 3; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+			w.Write([]byte("ok"))
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	worker := testWorker()
+	worker.SetMaxConns(2)
+	var open, maxOpen int32
+	worker.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		n := atomic.AddInt32(&open, 1)
+		for {
+			max := atomic.LoadInt32(&maxOpen)
+			if n <= max || atomic.CompareAndSwapInt32(&maxOpen, max, n) {
+				break
+			}
+		}
+		return &countedConn{Conn: conn, open: &open}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func(server *httptest.Server) {
+			defer wg.Done()
+			if result := worker.Fetch(mustParse(t, server.URL+"/")); !result.Success {
+				t.Error("Fetch failed:", result.Status)
+			}
+		}(servers[i%3])
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&maxOpen); max != 2 {
+		t.Fatal("Expected 2 open connections at most, got:", max)
+	}
+
+	// Failed connect doesn't hold slot.
+	dead := mustParse(t, servers[0].URL)
+	servers[0].Close()
+	for i := 0; i < 3; i++ {
+		if result := worker.Fetch(mustParse(t, "http://"+dead.Host+"/")); result.Success {
+			t.Fatal("Expected connect error")
+		}
+	}
+	if result := worker.Fetch(mustParse(t, servers[1].URL+"/")); !result.Success {
+		t.Fatal("Fetch failed:", result.Status)
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	doc := `<html><head><base href="http://example.com/dir/"></head><body>
+		<a href="page#frag">Page</a> <a name="anchor">No href</a> <a href="/abs?q=1">Abs</a>
+		<a href="mailto:x@example.com">Mail</a> <a href="https://other.com/">Other</a>
+		</body></html>`
+	links := ExtractLinks(mustParse(t, "http://example.org/"), strings.NewReader(doc))
+	var found []string
+	for _, u := range links {
+		found = append(found, u.String())
+	}
+	expected := "http://example.com/dir/page http://example.com/abs?q=1 https://other.com/"
+	if strings.Join(found, " ") != expected {
+		t.Fatal("Unexpected links:", found)
+	}
+
+	result := &heroshi.FetchResult{
+		Url:        mustParse(t, "http://example.org/"),
+		Success:    true,
+		StatusCode: 200,
+		Headers:    http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte(doc),
+	}
+	if links := ResultLinks(result); links != nil {
+		t.Fatal("Expected no links of text/plain, got:", links)
+	}
+}
+
+func TestConnectTo(t *testing.T) {
+	var lk sync.Mutex
+	var hosts []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		hosts = append(hosts, r.URL.Path+" "+r.Host+" "+r.TLS.ServerName)
+		lk.Unlock()
+		w.Write([]byte("vhost"))
+	}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	addr := server.Listener.Addr().String()
+
+	// httptest certificate is issued for example.com.
+	worker := NewWorker()
+	worker.SetTLSConfig(&tls.Config{RootCAs: roots})
+	u := mustParse(t, "https://example.com/page")
+	result := worker.FetchRequest(&Request{Url: u, ConnectTo: addr})
+	if string(result.Body) != "vhost" {
+		t.Fatal("Expected body from overridden address, got:", result.Status)
+	}
+	if result.Stat.Host != "example.com:443" || result.Stat.DialAddr != addr {
+		t.Fatal("Expected logical host and dialed address in stat, got:", result.Stat.Host, result.Stat.DialAddr)
+	}
+	lk.Lock()
+	seen := strings.Join(hosts, ", ")
+	lk.Unlock()
+	if seen != "/robots.txt example.com example.com, /page example.com example.com" {
+		t.Fatal("Expected robots.txt and page with logical Host and SNI, got:", seen)
+	}
+
+	worker = testWorker()
+	worker.SetTLSConfig(&tls.Config{RootCAs: roots})
+	worker.ConnectTo = map[string]string{"example.com:443": addr}
+	if result = worker.Fetch(u); string(result.Body) != "vhost" || result.Stat.DialAddr != addr {
+		t.Fatal("Expected Worker.ConnectTo used, got:", result.Status, result.Stat.DialAddr)
+	}
+}
+
+func TestConditionalRequest(t *testing.T) {
+	const etag = `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	result := worker.Fetch(mustParse(t, server.URL))
+	if result.StatusCode != http.StatusOK || result.NotModified || result.ETag != etag {
+		t.Fatal("Expected 200 with ETag, got:", result.Status, result.NotModified, result.ETag)
+	}
+
+	result = worker.FetchRequest(&Request{Url: mustParse(t, server.URL), IfNoneMatch: result.ETag})
+	if !result.Success || result.StatusCode != http.StatusNotModified || !result.NotModified || len(result.Body) != 0 {
+		t.Fatal("Expected successful 304, got:", result.Status, result.NotModified, string(result.Body))
+	}
+}
+
+func TestSitemapSeed(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Write([]byte(`<?xml version="1.0"?><sitemapindex>` +
+				`<sitemap><loc>` + server.URL + `/child.xml.gz</loc></sitemap>` +
+				`<sitemap><loc>` + server.URL + `/sitemap.xml</loc></sitemap>` +
+				`</sitemapindex>`))
+		case "/child.xml.gz":
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(`<urlset><url><loc>` + server.URL + `/a</loc></url><url><loc> ` + server.URL + `/b </loc></url></urlset>`))
+			gz.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	urls := worker.SitemapSeed(mustParse(t, server.URL+"/ignored"))
+	if len(urls) != 2 || urls[0].String() != server.URL+"/a" || urls[1].String() != server.URL+"/b" {
+		t.Fatal("Expected /a and /b, got:", urls)
+	}
+}
+
+func TestSkipContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+		case "/video":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Write(make([]byte, 1<<20))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<html></html>"))
+		}
+	}))
+	defer server.Close()
+
+	worker := NewWorker()
+	worker.ContentTypes = []string{"text/html"}
+	result := worker.Fetch(mustParse(t, server.URL+"/video"))
+	if !result.Success || !result.Skipped || result.Body != nil || result.Headers.Get("Content-Type") != "video/mp4" {
+		t.Fatal("Expected skipped video with headers, got:", result.Status, result.Skipped, len(result.Body))
+	}
+	// robots.txt is text/plain, but must still be obeyed.
+	if result = worker.Fetch(mustParse(t, server.URL+"/private")); result.Success {
+		t.Fatal("Expected robots disallow, got:", result.Status)
+	}
+	if result = worker.Fetch(mustParse(t, server.URL+"/page")); result.Skipped || string(result.Body) != "<html></html>" {
+		t.Fatal("Expected html body, got:", result.SkipReason, string(result.Body))
+	}
+
+	worker.ContentTypes = nil
+	worker.SkipContentTypes = []string{"text/"}
+	if result = worker.Fetch(mustParse(t, server.URL+"/page")); !result.Skipped {
+		t.Fatal("Expected skipped html")
+	}
+}
+
+func TestBrotli(t *testing.T) {
+	// "hello brotli " repeated 20 times.
+	encoded := []byte("\x1b\x03\x01\xf8\x1d\xa9\x53\x9f\xbb\x70\x2d\x56\x86\x26\x27\x41\xd8\xe8\x92\x2d\xed\x2d\x06\x8c\x06\x8e\x65\xc6\x2f")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			t.Error("br not in Accept-Encoding:", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(encoded)
+	}))
+	defer server.Close()
+
+	result := testWorker().Fetch(mustParse(t, server.URL))
+	if string(result.Body) != strings.Repeat("hello brotli ", 20) {
+		t.Fatal("Expected decoded body, got:", result.Status, string(result.Body))
+	}
+	if result.EncodedLength != int64(len(encoded)) || result.Length != int64(len(result.Body)) {
+		t.Fatal("Unexpected lengths:", result.EncodedLength, result.Length)
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"HTTP://Example.COM", "http://example.com/"},
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:80/a", "https://example.com:80/a"},
+		{"http://[::1]:80/", "http://[::1]/"},
+		{"http://[::1]:8080/", "http://[::1]:8080/"},
+		{"http://example.com/a?", "http://example.com/a"},
+		{"http://example.com/a/", "http://example.com/a/"},
+		{"http://example.com/a#top", "http://example.com/a"},
+		{"http://example.com/?b=2&a=1&b=1", "http://example.com/?a=1&b=2&b=1"},
+		{"http://example.com/a/./b/../c", "http://example.com/a/c"},
+		{"http://example.com/a/b/..", "http://example.com/a/"},
+		{"http://example.com/../a", "http://example.com/a"},
+		{"http://example.com/a%2Fb", "http://example.com/a%2Fb"},
+		{"http://example.com/Path", "http://example.com/Path"},
+	}
+	for _, c := range cases {
+		if out := NormalizeURL(mustParse(t, c.in)).String(); out != c.out {
+			t.Error("NormalizeURL", c.in, "expected", c.out, "got:", out)
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	if result := worker.Fetch(mustParse(t, server.URL)); result.Success {
+		t.Fatal("Expected certificate error, got:", result.Status)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	worker = testWorker()
+	worker.SetTLSConfig(&tls.Config{RootCAs: roots})
+	result := worker.Fetch(mustParse(t, server.URL))
+	if string(result.Body) != "secure" {
+		t.Fatal("Expected body with CA, got:", result.Status)
+	}
+	if result.Stat.TLSVersion == "" || result.Stat.TLSPeerSubject == "" {
+		t.Fatal("TLS stat not filled:", result.Stat.TLSVersion, result.Stat.TLSPeerSubject)
+	}
+
+	if result.CertExpiresSoon {
+		t.Fatal("Expected no expiry warning without CertWarnWindow")
+	}
+
+	worker = testWorker()
+	worker.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	// httptest certificate is valid for decades, make the window longer.
+	worker.CertWarnWindow = 200 * 365 * 24 * time.Hour
+	if result = worker.Fetch(mustParse(t, server.URL)); string(result.Body) != "secure" {
+		t.Fatal("Expected body with insecure, got:", result.Status)
+	}
+	if !result.Stat.TLSCertExpires.Equal(server.Certificate().NotAfter) || !result.CertExpiresSoon {
+		t.Fatal("Expected expiry of unverified certificate, got:", result.Stat.TLSCertExpires, result.CertExpiresSoon)
+	}
+}
+
+// Server which accepts TCP but never answers TLS handshake must fail at ConnectTimeout.
+func TestTLSHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	worker := testWorker()
+	worker.ConnectTimeout = 50 * time.Millisecond
+	worker.FetchTimeout = 5 * time.Second
+	started := time.Now()
+	result := worker.Fetch(mustParse(t, "https://"+listener.Addr().String()+"/"))
+	if result.Success || time.Since(started) > time.Second {
+		t.Fatal("Expected fast handshake timeout, got:", result.Status, time.Since(started))
+	}
+}
+
+// Each timeout applies only to its stage, others are long.
+func TestTimeoutsIndependent(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		// Request body is never read.
+	}))
+	defer server.Close()
+	defer close(release)
+
+	fetch := func(configure func(*Worker), r *Request) (*heroshi.FetchResult, time.Duration) {
+		worker := testWorker()
+		worker.ConnectTimeout = 5 * time.Second
+		worker.IOTimeout = 5 * time.Second
+		worker.FetchTimeout = 10 * time.Second
+		configure(worker)
+		started := time.Now()
+		return worker.FetchRequest(r), time.Since(started)
+	}
+
+	result, elapsed := fetch(func(w *Worker) { w.ReadTimeout = 50 * time.Millisecond },
+		&Request{Url: mustParse(t, server.URL+"/slow")})
+	if result.ErrorKind != heroshi.ErrorKindTimeout || elapsed > time.Second {
+		t.Fatal("Expected fast read timeout, got:", result.ErrorKind, result.Status, elapsed)
+	}
+
+	// Large body fills socket buffers of server that doesn't read it.
+	body := make([]byte, 64<<20)
+	result, elapsed = fetch(func(w *Worker) { w.WriteTimeout = 50 * time.Millisecond },
+		&Request{Url: mustParse(t, server.URL+"/slow"), Method: "POST", Body: body})
+	if result.ErrorKind != heroshi.ErrorKindTimeout || !strings.Contains(result.Status, "WriteRequest") || elapsed > time.Second {
+		t.Fatal("Expected fast write timeout, got:", result.ErrorKind, result.Status, elapsed)
+	}
+
+	// Read timeout doesn't affect write and vice versa.
+	result, _ = fetch(func(w *Worker) { w.WriteTimeout = 50 * time.Millisecond },
+		&Request{Url: mustParse(t, server.URL+"/")})
+	if !result.Success {
+		t.Fatal("Expected success with short WriteTimeout, got:", result.Status)
+	}
+
+	// 192.0.2.1 (TEST-NET-1) doesn't answer.
+	result, elapsed = fetch(func(w *Worker) { w.ConnectTimeout = 50 * time.Millisecond },
+		&Request{Url: mustParse(t, "http://192.0.2.1/")})
+	if result.Success || elapsed > time.Second {
+		t.Fatal("Expected fast connect timeout, got:", result.Status, elapsed)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	worker := testWorker()
+	resultCh := make(chan *heroshi.FetchResult, 2)
+	for i := 0; i < 2; i++ {
+		// Second one waits for per-host slot.
+		go func() { resultCh <- worker.Fetch(mustParse(t, server.URL)) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	worker.Abort()
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-resultCh:
+			if result.Success || result.Status != "Fetch aborted" {
+				t.Fatal("Expected aborted, got:", result.Status)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Abort did not stop fetch")
+		}
+	}
+}
+
+func TestFetchContext(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	worker := testWorker()
+	ctx, cancel := context.WithCancel(context.Background())
+	resultCh := make(chan *heroshi.FetchResult, 1)
+	go func() { resultCh <- worker.FetchContext(ctx, mustParse(t, server.URL)) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case result := <-resultCh:
+		if result.ErrorKind != heroshi.ErrorKindAborted {
+			t.Fatal("Expected aborted, got:", result.Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cancel did not stop fetch")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result := worker.FetchContext(ctx, mustParse(t, server.URL))
+	if result.ErrorKind != heroshi.ErrorKindTimeout {
+		t.Fatal("Expected timeout, got:", result.Status)
+	}
+
+	// Worker is still usable.
+	if result := worker.Fetch(mustParse(t, server.URL+"/ok")); !result.Success {
+		t.Fatal("Expected success, got:", result.Status)
+	}
+}
+
+func TestHostRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.HostRateLimit = 20
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		if result := worker.Fetch(mustParse(t, server.URL)); !result.Success {
+			t.Fatal("Expected success, got:", result.Status)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+		t.Fatal("Expected at least 100ms for 3 requests at 20/s, got:", elapsed)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var hits int32
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.BreakerThreshold = 2
+	worker.BreakerCooldown = 50 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		if result := worker.Fetch(mustParse(t, server.URL)); result.StatusCode != http.StatusServiceUnavailable {
+			t.Fatal("Expected 503, got:", result.Status)
+		}
+	}
+	result := worker.Fetch(mustParse(t, server.URL))
+	if result.ErrorKind != heroshi.ErrorKindCircuitOpen || atomic.LoadInt32(&hits) != 2 {
+		t.Fatal("Expected circuit open without request, got:", result.Status, hits)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	for i := 0; i < 2; i++ {
+		if result := worker.Fetch(mustParse(t, server.URL)); !result.Success || result.StatusCode != http.StatusOK {
+			t.Fatal("Expected circuit closed after cooldown, got:", result.Status)
+		}
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	arrived := make(chan bool)
+	gate := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- true
+		<-gate
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.HostConcurrency = 2
+	worker.SetMaxIdleConns(0)
+	// Each round has two requests in progress at once, so second round
+	// reuses both connections only if both were kept idle.
+	var uses []uint
+	for round := 0; round < 2; round++ {
+		results := make(chan *heroshi.FetchResult, 2)
+		for i := 0; i < 2; i++ {
+			go func() { results <- worker.Fetch(mustParse(t, server.URL)) }()
+		}
+		<-arrived
+		<-arrived
+		gate <- true
+		gate <- true
+		for i := 0; i < 2; i++ {
+			result := <-results
+			if !result.Success {
+				t.Fatal("Fetch:", result.Status)
+			}
+			if round == 1 {
+				uses = append(uses, result.Stat.ConnectionUse)
+			}
+		}
+		// Connections return to idle pool after response is read.
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fmt.Sprint(uses) != "[2 2]" {
+		t.Fatal("Expected both connections reused, got uses:", uses)
+	}
+}
+
+func TestMaxPerHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := NewWorker()
+	worker.MaxPerHost = 2
+	for i := 0; i < 2; i++ {
+		if result := worker.Fetch(mustParse(t, fmt.Sprintf("%s/%d", server.URL, i))); !result.Success {
+			t.Fatal("Expected success within limit, got:", result.Status)
+		}
+	}
+	result := worker.Fetch(mustParse(t, server.URL+"/2"))
+	if result.Success || result.ErrorKind != heroshi.ErrorKindHostLimit {
+		t.Fatal("Expected host limit, got:", result.Status)
+	}
+
+	// Concurrent fetches don't pass the limit either.
+	worker = NewWorker()
+	worker.MaxPerHost = 3
+	worker.HostConcurrency = 10
+	var wg sync.WaitGroup
+	var successes int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if worker.Fetch(mustParse(t, fmt.Sprintf("%s/%d", server.URL, i))).Success {
+				atomic.AddInt32(&successes, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if successes != 3 {
+		t.Fatal("Expected 3 concurrent fetches within limit, got:", successes)
+	}
+}
+
+func TestRedirectBodyLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/r" {
+			w.Header().Set("Location", "/a")
+			w.WriteHeader(http.StatusFound)
+		}
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.RedirectBodyLimit = 10
+	result := worker.Download(&Request{Url: mustParse(t, server.URL+"/r")})
+	if !result.Truncated || len(result.Body) != 10 {
+		t.Fatal("Expected redirect body cut at 10 bytes, got:", len(result.Body), result.Truncated)
+	}
+	result = worker.Fetch(mustParse(t, server.URL+"/r"))
+	if result.Truncated || len(result.Body) != 1000 {
+		t.Fatal("Expected full body after redirect, got:", len(result.Body), result.Truncated)
+	}
+}
+
+func TestOnResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/r" {
+			http.Redirect(w, r, "/a", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	var results []*heroshi.FetchResult
+	worker := NewWorker()
+	worker.OnResult = func(result *heroshi.FetchResult) { results = append(results, result) }
+	result := worker.Fetch(mustParse(t, server.URL+"/r"))
+	if len(results) != 1 || results[0] != result {
+		t.Fatal("Expected one call with returned result, got:", len(results))
+	}
+	if result.FinalUrl.Path != "/a" || len(result.RedirectChain) != 1 {
+		t.Fatal("Expected complete result in hook, got:", result.FinalUrl, result.RedirectChain)
+	}
+}
+
+func TestRedirectCookies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/app"})
+			http.Redirect(w, r, "/app/home", http.StatusFound)
+		case "/app/home", "/other":
+			if c, err := r.Cookie("session"); err == nil && c.Value == "s1" {
+				w.Write([]byte("logged in"))
+			} else {
+				w.Write([]byte("anonymous"))
+			}
+		}
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	result := worker.Fetch(mustParse(t, server.URL+"/login"))
+	if string(result.Body) != "logged in" || !result.CookiesUsed {
+		t.Fatal("Expected cookie sent on redirect, got:", string(result.Body), result.CookiesUsed)
+	}
+	if result = worker.Fetch(mustParse(t, server.URL+"/app/home")); string(result.Body) != "anonymous" || result.CookiesUsed {
+		t.Fatal("Cookie leaked to next Fetch:", string(result.Body))
+	}
+
+	worker.CookieJar, _ = cookiejar.New(nil)
+	worker.Fetch(mustParse(t, server.URL+"/login"))
+	if result = worker.Fetch(mustParse(t, server.URL+"/app/home")); string(result.Body) != "logged in" {
+		t.Fatal("Expected shared cookie, got:", string(result.Body))
+	}
+	// Cookie path is /app.
+	if result = worker.Fetch(mustParse(t, server.URL+"/other")); string(result.Body) != "anonymous" {
+		t.Fatal("Cookie sent outside its path:", string(result.Body))
+	}
+}
+
+func TestRedirectChainHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+			http.SetCookie(w, &http.Cookie{Name: "big", Value: strings.Repeat("x", redirectTraceLimit)})
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusMovedPermanently)
+		default:
+			w.Write([]byte("done"))
+		}
+	}))
+	defer server.Close()
+
+	result := testWorker().Fetch(mustParse(t, server.URL+"/a"))
+	chain := result.RedirectChain
+	if len(chain) != 2 {
+		t.Fatal("Expected 2 redirects, got:", chain)
+	}
+	if chain[0].Location != "/b" || len(chain[0].SetCookie) != 1 || chain[0].SetCookie[0] != "a=1" {
+		t.Fatal("Unexpected first hop:", chain[0].Location, chain[0].SetCookie)
+	}
+	if chain[1].StatusCode != 301 || chain[1].Location != "/c" || chain[1].SetCookie != nil {
+		t.Fatal("Unexpected second hop:", chain[1])
+	}
+}
+
+func TestSameHostRedirects(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other"))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/local":
+			http.Redirect(w, r, "/target", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, other.URL+"/", http.StatusMovedPermanently)
+		default:
+			w.Write([]byte("target"))
+		}
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.FollowRedirects = 5
+	worker.SameHostRedirects = true
+	if result := worker.Fetch(mustParse(t, server.URL+"/local")); string(result.Body) != "target" {
+		t.Fatal("Expected same host redirect followed, got:", result.Status)
+	}
+	result := worker.Fetch(mustParse(t, server.URL+"/away"))
+	if result.StatusCode != http.StatusMovedPermanently || result.Headers.Get("Location") != other.URL+"/" {
+		t.Fatal("Expected redirect response, got:", result.Status, result.Headers.Get("Location"))
+	}
+
+	if safeRedirect(mustParse(t, "https://a/"), mustParse(t, "https://a/"), mustParse(t, "http://a/")) {
+		t.Fatal("https to http downgrade allowed")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nohead" && r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == "GET" && r.Header.Get("Range") == "" {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.ProbeFirst = true
+	worker.MaxBodySize = 100
+	for _, path := range []string{"/big", "/nohead"} {
+		result := worker.Fetch(mustParse(t, server.URL+path))
+		if !result.Skipped || !strings.Contains(result.SkipReason, "1000") {
+			t.Fatal("Expected skip by size for", path, "got:", result.Status, result.SkipReason)
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Fatal("Expected no full GET, got:", n)
+	}
+
+	worker.MaxBodySize = 0
+	result := worker.Fetch(mustParse(t, server.URL+"/big"))
+	if n := atomic.LoadInt32(&gets); result.Skipped || len(result.Body) != 1000 || n != 1 {
+		t.Fatal("Expected full GET after probe, got:", result.Status, len(result.Body), n)
+	}
+
+	// Probe time of cache hits must not leak into cached result.
+	worker.Cache = NewLRUCache(10)
+	if result := worker.Fetch(mustParse(t, server.URL+"/cached")); result.Cached || result.Stat == nil {
+		t.Fatal("Expected fresh result with Stat, got:", result.Cached, result.Stat)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := worker.Fetch(mustParse(t, server.URL+"/cached")); !result.Cached {
+				t.Error("Expected cache hit, got:", result.Status)
+			}
+		}()
+	}
+	wg.Wait()
+	cached, _ := worker.Cache.Get(server.URL + "/cached")
+	if cached.Stat.ProbeTime != 0 {
+		t.Fatal("Expected cached Stat without ProbeTime, got:", cached.Stat.ProbeTime)
+	}
+}
+
+func TestRobotsRule(t *testing.T) {
+	body := []byte(`# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+
+User-agent: OtherBot
+User-agent: HeroshiBot
+Disallow: /
+Allow: /*.html$
+`)
+	cases := []struct{ agent, path, expected string }{
+		{"SomeBot", "/index", ""},
+		{"SomeBot", "/private/x", "Disallow: /private"},
+		{"SomeBot", "/private/public/x", "Allow: /private/public"},
+		{"HeroshiBot", "/a", "Disallow: /"},
+		{"HeroshiBot", "/dir/a.html", "Allow: /*.html$"},
+		{"HeroshiBot", "/dir/a.html?q", "Disallow: /"},
+	}
+	for _, c := range cases {
+		if rule := RobotsRule(body, c.agent, c.path); rule != c.expected {
+			t.Errorf("%s %s: expected %q, got %q", c.agent, c.path, c.expected, rule)
+		}
+	}
+}
+
+func TestCheckRobots(t *testing.T) {
+	var lk sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		paths = append(paths, r.URL.Path)
+		lk.Unlock()
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+		}
+	}))
+	defer server.Close()
+
+	worker := NewWorker()
+	result := worker.CheckRobots(mustParse(t, server.URL+"/private/a"))
+	if result.ErrorKind != heroshi.ErrorKindRobots || result.RobotsRule != "Disallow: /private" {
+		t.Fatal("Expected disallow by rule, got:", result.Status, result.RobotsRule)
+	}
+	result = worker.CheckRobots(mustParse(t, server.URL+"/a"))
+	if !result.Success || result.Status != "Robots allow" || result.RobotsRule != "" {
+		t.Fatal("Expected allow without rule, got:", result.Status, result.RobotsRule)
+	}
+	lk.Lock()
+	defer lk.Unlock()
+	if len(paths) != 1 || paths[0] != "/robots.txt" {
+		t.Fatal("Expected only robots.txt request, got:", paths)
+	}
+}
+
+func TestCheckRobotsGroup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: bot\nDisallow: /\n\nUser-agent: *\nDisallow: /private\n"))
+		}
+	}))
+	defer server.Close()
+
+	// "bot" group is not for HeroshiBot, rule must not come from it.
+	worker := NewWorker()
+	if result := worker.CheckRobots(mustParse(t, server.URL+"/a")); !result.Success || result.RobotsRule != "" {
+		t.Error("Expected allow without rule, got:", result.Status, result.RobotsRule)
+	}
+	if result := worker.CheckRobots(mustParse(t, server.URL+"/private/a")); result.Success || result.RobotsRule != "Disallow: /private" {
+		t.Error("Expected disallow by rule of *, got:", result.Status, result.RobotsRule)
+	}
+}
+
+func TestRobotsCache(t *testing.T) {
+	for _, code := range []int{200, 404, 503} {
+		var robotsHits int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/robots.txt" {
+				atomic.AddInt32(&robotsHits, 1)
+				w.WriteHeader(code)
+				w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+			}
+		}))
+
+		worker := NewWorker()
+		worker.HostConcurrency = 10
+		for i := 0; i < 3; i++ {
+			worker.Fetch(mustParse(t, fmt.Sprintf("%s/%d", server.URL, i)))
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				worker.Fetch(mustParse(t, fmt.Sprintf("%s/c%d", server.URL, i)))
+			}(i)
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&robotsHits); n != 1 {
+			t.Error("Expected robots.txt with status", code, "downloaded once, got:", n)
+		}
+		server.Close()
+	}
+}
+
+func TestRobotsStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+		}
+	}))
+	defer server.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	worker := NewWorker()
+	skipping := NewWorker()
+	skipping.SkipRobots = true
+	for _, c := range []struct {
+		worker *Worker
+		url    string
+		status string
+	}{
+		{worker, server.URL + "/private", heroshi.RobotsStatusDisallowed},
+		{worker, server.URL + "/public", heroshi.RobotsStatusAllowed},
+		{worker, server.URL + "/robots.txt", heroshi.RobotsStatusSelf},
+		{worker, dead.URL + "/public", heroshi.RobotsStatusUnavailable},
+		{skipping, server.URL + "/private", heroshi.RobotsStatusSkipped},
+	} {
+		if result := c.worker.Fetch(mustParse(t, c.url)); result.RobotsStatus != c.status {
+			t.Error(c.url, "expected", c.status, "got:", result.RobotsStatus, result.Status)
+		}
+	}
+	if result := worker.CheckRobots(mustParse(t, server.URL+"/public")); result.RobotsStatus != heroshi.RobotsStatusAllowed {
+		t.Error("CheckRobots: expected allowed, got:", result.RobotsStatus)
+	}
+}
+
+func TestRobotsRedirect(t *testing.T) {
+	var lk sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		paths = append(paths, r.URL.Path)
+		lk.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			http.Redirect(w, r, "/robots-real.txt", http.StatusMovedPermanently)
+		case "/robots-real.txt":
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+		}
+	}))
+	defer server.Close()
+
+	worker := NewWorker()
+	done := make(chan *heroshi.FetchResult)
+	go func() { done <- worker.CheckRobots(mustParse(t, server.URL+"/private/a")) }()
+	select {
+	case result := <-done:
+		if result.RobotsRule != "Disallow: /private" {
+			t.Error("Expected rule of redirected robots.txt, got:", result.Status, result.RobotsRule)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Robots redirect to same host is stuck")
+	}
+	lk.Lock()
+	defer lk.Unlock()
+	if len(paths) != 2 || paths[1] != "/robots-real.txt" {
+		t.Error("Expected robots.txt and its redirect only, got:", paths)
+	}
+}
+
+func TestRobotsBodyDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+		}
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "fetcher-test")
+	if err != nil {
+		t.Fatal("TempDir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	worker := NewWorker()
+	worker.BodyDir = dir
+	worker.BodyInlineLimit = 10
+	if result := worker.CheckRobots(mustParse(t, server.URL+"/private/a")); result.RobotsRule != "Disallow: /private" {
+		t.Error("Expected rule of robots.txt stored in file, got:", result.Status, result.RobotsRule)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("Expected robots.txt file removed, got:", len(files))
+	}
+}
+
+func TestRobotsTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	worker := NewWorker()
+	worker.RobotsTimeout = 50 * time.Millisecond
+	worker.RobotsUnavailable = RobotsUnavailableError
+	started := time.Now()
+	result := worker.Fetch(mustParse(t, server.URL+"/a"))
+	if result.RobotsStatus != heroshi.RobotsStatusUnavailable || result.ErrorKind != heroshi.ErrorKindTimeout {
+		t.Error("Expected robots.txt timeout, got:", result.RobotsStatus, result.ErrorKind, result.Status)
+	}
+	if elapsed := time.Since(started); elapsed > 400*time.Millisecond {
+		t.Error("Expected RobotsTimeout, took", elapsed)
+	}
+}
+
+func TestRobotsUnavailable(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer broken.Close()
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer missing.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	for _, c := range []struct {
+		mode, url string
+		success   bool
+		kind      string
+		status    string
+	}{
+		{RobotsUnavailableDeny, broken.URL, false, heroshi.ErrorKindRobots5xx, heroshi.RobotsStatusUnavailable},
+		{RobotsUnavailableDeny, dead.URL, false, heroshi.ErrorKindRefused, heroshi.RobotsStatusUnavailable},
+		{RobotsUnavailableDeny, missing.URL, true, "", heroshi.RobotsStatusAllowed},
+		{RobotsUnavailableAllow, broken.URL, true, "", heroshi.RobotsStatusUnavailable},
+		{RobotsUnavailableError, broken.URL, false, heroshi.ErrorKindRobots5xx, heroshi.RobotsStatusUnavailable},
+		{RobotsUnavailableError, dead.URL, false, heroshi.ErrorKindRefused, heroshi.RobotsStatusUnavailable},
+		{RobotsUnavailableError, missing.URL, true, "", heroshi.RobotsStatusAllowed},
+	} {
+		worker := NewWorker()
+		worker.RobotsUnavailable = c.mode
+		result := worker.Fetch(mustParse(t, c.url+"/a"))
+		if result.Success != c.success || result.ErrorKind != c.kind || result.RobotsStatus != c.status {
+			t.Error(c.mode, c.url, "expected", c.success, c.kind, c.status, "got:",
+				result.Success, result.ErrorKind, result.RobotsStatus, result.Status)
+		}
+		if n := atomic.LoadUint64(&worker.Metrics.robotsDisallowed); n != 0 {
+			t.Error(c.mode, c.url, "unavailable robots.txt counted as disallowed:", n)
+		}
+	}
+}
+
+func TestRedirectTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		var n int
+		fmt.Sscanf(r.URL.Path, "/%d", &n)
+		http.Redirect(w, r, fmt.Sprintf("/%d", n+1), http.StatusFound)
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.FollowRedirects = 10
+	worker.FetchTimeout = 350 * time.Millisecond
+	started := time.Now()
+	result := worker.Fetch(mustParse(t, server.URL+"/0"))
+	elapsed := time.Since(started)
+	if result.ErrorKind != heroshi.ErrorKindTimeout {
+		t.Fatal("Expected timeout, got:", result.Status)
+	}
+	// Each hop alone fits in FetchTimeout, whole chain doesn't.
+	if elapsed > 500*time.Millisecond || len(result.RedirectChain) != 3 {
+		t.Fatal("Chain exceeded timeout:", elapsed, len(result.RedirectChain))
+	}
+}
+
+func TestSkipBodyRobots(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+			return
+		}
+		w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	worker := NewWorker()
+	worker.SkipBody = true
+	if result := worker.Fetch(mustParse(t, server.URL+"/private")); result.ErrorKind != heroshi.ErrorKindRobots {
+		t.Fatal("Expected robots.txt to be read, got:", result.Status)
+	}
+	result := worker.Fetch(mustParse(t, server.URL+"/public"))
+	if !result.Success || result.Body != nil || result.Length != 4 {
+		t.Fatal("Expected skipped body, got:", result.Status, string(result.Body), result.Length)
+	}
+}
+
+func TestCleanIdleConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.KeepaliveTimeout = 300 * time.Millisecond
+	worker.ReapInterval = 20 * time.Millisecond
+	stop := make(chan bool)
+	defer close(stop)
+	go worker.CleanIdleConnections(stop)
+
+	if result := worker.Fetch(mustParse(t, server.URL+"/")); !result.Success {
+		t.Fatal("Fetch failed:", result.Status)
+	}
+	if hosts, idle, active := worker.PoolStats(); hosts != 1 || idle != 1 || active != 0 {
+		t.Fatal("Expected 1 idle connection, got:", hosts, idle, active)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, idle, _ := worker.PoolStats(); idle != 1 {
+		t.Fatal("Connection reaped before KeepaliveTimeout")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if hosts, idle, active := worker.PoolStats(); hosts != 0 || idle != 0 || active != 0 {
+		t.Fatal("Expected connection reaped after KeepaliveTimeout, got:", hosts, idle, active)
+	}
+}
+
+func TestClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	cleanerDone := make(chan bool)
+	go func() {
+		worker.CleanIdleConnections(nil)
+		close(cleanerDone)
+	}()
+	if result := worker.Fetch(mustParse(t, server.URL+"/")); !result.Success {
+		t.Fatal("Fetch failed:", result.Status)
+	}
+	worker.Close()
+	if hosts, idle, active := worker.PoolStats(); hosts != 0 || idle != 0 || active != 0 {
+		t.Fatal("Expected no connections after Close, got:", hosts, idle, active)
+	}
+	select {
+	case <-cleanerDone:
+	case <-time.After(time.Second):
+		t.Fatal("CleanIdleConnections did not stop after Close")
+	}
+	if result := worker.Fetch(mustParse(t, server.URL+"/")); result.Success {
+		t.Fatal("Expected Fetch to fail after Close")
+	}
+}
+
+func TestNewWorkerOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.UserAgent()))
+	}))
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+	worker, err := NewWorkerOptions(
+		Configure(func(w *Worker) {
+			w.SkipRobots = true
+			w.UserAgent = "TestBot/2 (+http://example.com/)"
+			w.KeepaliveTimeout = 100 * time.Millisecond
+			w.ReapInterval = 20 * time.Millisecond
+		}),
+		WithMaxConns(2),
+		WithIdleCleanup(),
+	)
+	if err != nil {
+		t.Fatal("NewWorkerOptions:", err.Error())
+	}
+	if worker.robotsAgent != "TestBot" {
+		t.Fatal("Expected robots agent from UserAgent option, got:", worker.robotsAgent)
+	}
+	if worker.conns == nil {
+		t.Fatal("Expected WithMaxConns to limit connections")
+	}
+	result := worker.Fetch(mustParse(t, server.URL+"/"))
+	if !result.Success || string(result.Body) != worker.UserAgent {
+		t.Fatal("Fetch failed:", result.Status, string(result.Body))
+	}
+	time.Sleep(300 * time.Millisecond)
+	if hosts, idle, active := worker.PoolStats(); hosts != 0 || idle != 0 || active != 0 {
+		t.Fatal("Expected connection reaped by WithIdleCleanup, got:", hosts, idle, active)
+	}
+
+	worker.Close()
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatal("CleanIdleConnections did not stop after Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := NewWorkerOptions(WithProxy(&url.URL{Scheme: "ftp", Host: "localhost:21"})); err == nil {
+		t.Fatal("Expected error of WithProxy option")
+	}
+}
+
+func TestHostStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadHost := dead.Addr().String()
+	dead.Close()
+
+	worker := testWorker()
+	for i := 0; i < 2; i++ {
+		worker.Fetch(mustParse(t, server.URL+"/"))
+	}
+	worker.Fetch(mustParse(t, "http://"+deadHost+"/"))
+
+	stats := worker.HostStats()
+	live := stats[mustParse(t, server.URL).Host]
+	if live.Requests != 2 || live.Successes != 2 || live.Errors != nil || live.BytesReceived == 0 || live.MeanTime() <= 0 {
+		t.Fatal("Unexpected stats of live host:", live)
+	}
+	failed := stats[deadHost]
+	if failed.Requests != 1 || failed.Successes != 0 || failed.Errors[heroshi.ErrorKindRefused] != 1 {
+		t.Fatal("Unexpected stats of dead host:", failed)
+	}
+
+	failed.Errors[heroshi.ErrorKindRefused] = 10
+	if worker.HostStats()[deadHost].Errors[heroshi.ErrorKindRefused] != 1 {
+		t.Fatal("HostStats returned shared map")
+	}
+}
+
+func TestBodyFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %d %s", r.Method, r.ContentLength, body)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "fetcher-test")
+	if err != nil {
+		t.Fatal("TempDir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upload")
+	if err = ioutil.WriteFile(path, []byte("file content"), 0600); err != nil {
+		t.Fatal("WriteFile:", err.Error())
+	}
+
+	worker := testWorker()
+	result := worker.FetchRequest(&Request{Url: mustParse(t, server.URL+"/"), Method: "POST", BodyFile: path})
+	if string(result.Body) != "POST 12 file content" {
+		t.Fatal("Expected file sent as body, got:", result.Status, string(result.Body))
+	}
+
+	result = worker.FetchRequest(&Request{Url: mustParse(t, server.URL+"/"), Method: "POST", BodyFile: path + ".missing"})
+	if result.Success || result.ErrorKind != heroshi.ErrorKindInput {
+		t.Fatal("Expected input error for missing file, got:", result.ErrorKind, result.Status)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("maintenance"))
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte("all systems operational"))
+			gz.Close()
+		default:
+			w.Write([]byte(strings.Repeat("x", 100) + "all systems operational"))
+		}
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	fetch := func(path string, status int, contains string) *heroshi.FetchResult {
+		return worker.FetchRequest(&Request{Url: mustParse(t, server.URL+path), ExpectStatus: status, ExpectBodyContains: contains})
+	}
+	if result := fetch("/down", 200, ""); result.Success || result.ErrorKind != heroshi.ErrorKindValidation ||
+		result.StatusCode != 503 || string(result.Body) != "maintenance" || result.ValidationError == "" {
+		t.Fatal("Expected validation error with response kept, got:", result.ErrorKind, result.StatusCode, string(result.Body))
+	}
+	if result := fetch("/gzip", 200, "operational"); !result.Success {
+		t.Fatal("Expected match in decompressed body, got:", result.ValidationError)
+	}
+	if result := fetch("/gzip", 0, "outage"); result.Success || result.ErrorKind != heroshi.ErrorKindValidation {
+		t.Fatal("Expected body mismatch, got:", result.ErrorKind)
+	}
+
+	dir, err := ioutil.TempDir("", "fetcher-test")
+	if err != nil {
+		t.Fatal("TempDir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	worker.BodyDir = dir
+	worker.BodyInlineLimit = 10
+	if result := fetch("/", 0, "systems operational"); !result.Success || result.BodyPath == "" {
+		t.Fatal("Expected match in body file, got:", result.ValidationError, result.BodyPath)
+	}
+
+	// Needle crosses boundary of read chunks.
+	path := filepath.Join(dir, "large")
+	if err = ioutil.WriteFile(path, []byte(strings.Repeat("x", 64<<10-3)+"needle"), 0600); err != nil {
+		t.Fatal("WriteFile:", err.Error())
+	}
+	if found, err := bodyContains(&heroshi.FetchResult{BodyPath: path}, []byte("needle")); !found || err != nil {
+		t.Fatal("Expected needle across chunks, got:", found, err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	var lk sync.Mutex
+	hits := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		hits[r.Method+" "+r.URL.Path]++
+		lk.Unlock()
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	hitsOf := func(key string) int {
+		lk.Lock()
+		defer lk.Unlock()
+		return hits[key]
+	}
+
+	worker := testWorker()
+	worker.Cache = NewLRUCache(2)
+	for i := 0; i < 3; i++ {
+		result := worker.Fetch(mustParse(t, server.URL+"/a"))
+		if !result.Success || string(result.Body) != "/a" || result.Cached != (i > 0) {
+			t.Fatal("Expected cache hit after first GET, got:", i, result.Status, string(result.Body), result.Cached)
+		}
+	}
+	if n := hitsOf("GET /a"); n != 1 {
+		t.Fatal("Expected single GET of cached URL, got:", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if result := worker.FetchRequest(&Request{Url: mustParse(t, server.URL+"/a"), Method: "POST"}); result.Cached {
+			t.Fatal("Expected POST not served from cache")
+		}
+		if result := worker.Fetch(mustParse(t, server.URL+"/error")); result.Cached || result.StatusCode != 500 {
+			t.Fatal("Expected 500 not cached, got:", result.Status, result.Cached)
+		}
+	}
+	if n := hitsOf("POST /a"); n != 2 {
+		t.Fatal("Expected every POST sent, got:", n)
+	}
+	if n := hitsOf("GET /error"); n != 2 {
+		t.Fatal("Expected every GET of 500 sent, got:", n)
+	}
+
+	// /a is least recently used after /b and /c fill the cache.
+	worker.Fetch(mustParse(t, server.URL+"/b"))
+	worker.Fetch(mustParse(t, server.URL+"/c"))
+	if result := worker.Fetch(mustParse(t, server.URL+"/c")); !result.Cached {
+		t.Fatal("Expected cache hit of /c")
+	}
+	if result := worker.Fetch(mustParse(t, server.URL+"/a")); result.Cached {
+		t.Fatal("Expected /a evicted")
+	}
+	if n := hitsOf("GET /a"); n != 2 {
+		t.Fatal("Expected GET of evicted URL, got:", n)
+	}
+
+	worker.Cache = nil
+	if result := worker.Fetch(mustParse(t, server.URL+"/c")); result.Cached || hitsOf("GET /c") != 2 {
+		t.Fatal("Expected download without Cache, got:", result.Cached, hitsOf("GET /c"))
+	}
+}
+
+func TestHashBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "not found, sorry"
+		if r.URL.Path == "/home" {
+			body = "welcome"
+		}
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(body))
+			gz.Close()
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	if result := worker.Fetch(mustParse(t, server.URL+"/a")); result.ContentHash != "" {
+		t.Fatal("Expected no hash without HashBodies, got:", result.ContentHash)
+	}
+
+	worker.HashBodies = true
+	first := worker.Fetch(mustParse(t, server.URL+"/a"))
+	if len(first.ContentHash) != 64 || first.DuplicateOf != "" {
+		t.Fatal("Expected hash of first body, got:", first.ContentHash, first.DuplicateOf)
+	}
+	again := worker.Fetch(mustParse(t, server.URL+"/a"))
+	if again.DuplicateOf != "" {
+		t.Fatal("Same URL is not a duplicate of itself, got:", again.DuplicateOf)
+	}
+	// Hash is of decompressed body.
+	dup := worker.Fetch(mustParse(t, server.URL+"/gzip"))
+	if dup.ContentHash != first.ContentHash || dup.DuplicateOf != server.URL+"/a" {
+		t.Fatal("Expected duplicate of /a, got:", dup.ContentHash, dup.DuplicateOf)
+	}
+	other := worker.Fetch(mustParse(t, server.URL+"/home"))
+	if other.ContentHash == first.ContentHash || other.DuplicateOf != "" {
+		t.Fatal("Expected different body, got:", other.ContentHash, other.DuplicateOf)
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.DefaultHeaders = http.Header{"Accept-Language": {"de"}, "Accept": {"text/html"}}
+	worker.Fetch(mustParse(t, server.URL))
+	if got.Get("Accept-Language") != "de" || got.Get("Accept") != "text/html" {
+		t.Fatal("Expected default headers, got:", got)
+	}
+	if got.Get("User-Agent") != DefaultUserAgent || got.Get("Accept-Encoding") != "gzip, deflate, br" {
+		t.Fatal("Built-in headers changed:", got)
+	}
+
+	worker.DefaultHeaders.Set("Accept-Encoding", "identity")
+	worker.FetchRequest(&Request{Url: mustParse(t, server.URL), Header: http.Header{"Accept-Language": {"fr"}}})
+	if got.Get("Accept-Language") != "fr" || got.Get("Accept-Encoding") != "identity" || got.Get("Accept") != "text/html" {
+		t.Fatal("Expected request header over default over built-in, got:", got)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetcher-test")
+	if err != nil {
+		t.Fatal("TempDir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "http.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal("Listen:", err.Error())
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("over unix socket " + r.Host))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	worker := testWorker()
+	worker.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	result := worker.Fetch(mustParse(t, "http://service.local/"))
+	if string(result.Body) != "over unix socket service.local" {
+		t.Fatal("Expected response over unix socket, got:", result.Status, string(result.Body))
+	}
+}
+
+func TestRedirectCodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/308" {
+			http.Redirect(w, r, "/target", http.StatusPermanentRedirect)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("Content-Type"), body)
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.FollowRedirects = 1
+	result := worker.FetchRequest(&Request{Url: mustParse(t, server.URL+"/308"), Method: "POST",
+		Body: []byte("data"), Header: http.Header{"Content-Type": {"text/plain"}}})
+	if string(result.Body) != "POST text/plain data" || len(result.RedirectChain) != 1 {
+		t.Fatal("Expected 308 followed with method, headers and body, got:", result.Status, string(result.Body))
+	}
+
+	worker.RedirectCodes = []int{http.StatusFound}
+	result = worker.Fetch(mustParse(t, server.URL+"/308"))
+	if result.StatusCode != http.StatusPermanentRedirect || len(result.RedirectChain) != 0 {
+		t.Fatal("Expected 308 not followed, got:", result.Status)
+	}
+}
+
+func TestRedirectMethod(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/target" {
+			code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+			http.Redirect(w, r, "/target", code)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		fmt.Fprintf(w, "%s", body)
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.FollowRedirects = 1
+	for _, c := range []struct {
+		code   int
+		method string
+		body   string
+	}{
+		{http.StatusMovedPermanently, "GET", ""},
+		{http.StatusFound, "GET", ""},
+		{http.StatusSeeOther, "GET", ""},
+		{http.StatusTemporaryRedirect, "POST", "data"},
+		{http.StatusPermanentRedirect, "POST", "data"},
+	} {
+		result := worker.FetchRequest(&Request{Url: mustParse(t, fmt.Sprintf("%s/%d", server.URL, c.code)),
+			Method: "POST", Body: []byte("data")})
+		if method := result.Headers.Get("X-Method"); method != c.method || string(result.Body) != c.body {
+			t.Fatal(c.code, "expected", c.method, c.body, "got:", method, string(result.Body))
+		}
+	}
+
+	result := worker.FetchRequest(&Request{Url: mustParse(t, server.URL+"/303"), Method: "HEAD"})
+	if method := result.Headers.Get("X-Method"); method != "HEAD" {
+		t.Fatal("Expected HEAD kept after 303, got:", method)
+	}
+}
+
+func TestMaxBandwidth(t *testing.T) {
+	body := strings.Repeat("x", 40<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	worker := testWorker()
+	worker.HostConcurrency = 0
+	worker.MaxBandwidth = 200 << 10
+	started := time.Now()
+	var wg sync.WaitGroup
+	results := make([]*heroshi.FetchResult, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = worker.Fetch(mustParse(t, fmt.Sprintf("%s/%d", server.URL, i)))
+		}(i)
+	}
+	wg.Wait()
+	// 80KB at 200KB/s, bandwidth is shared.
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Fatal("Expected at least 250ms for 80KB at 200KB/s, got:", elapsed)
+	}
+	for _, result := range results {
+		if string(result.Body) != body {
+			t.Fatal("Expected full body, got:", result.Status, len(result.Body))
+		}
+		if result.Stat.ReadBodyRate == 0 || result.Stat.ReadBodyRate > 400<<10 {
+			t.Fatal("Unexpected body rate:", result.Stat.ReadBodyRate)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package heroshi
+
+import (
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// textMediaType tells whether body of mediaType is text that may need transcoding.
+func textMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/xml" || mediaType == "application/javascript"
+}
+
+// transcodeBody converts text body of result to UTF-8 according to charset
+// of contentType or, for HTML, <meta> tag. Sets result.Charset to detected
+// source charset. Body of unknown charset is left as is. On failure body is
+// left as is too and result.TranscodeFailed is set. Bodies in files are not transcoded.
+func transcodeBody(result *FetchResult, contentType string) {
+	if len(result.Body) == 0 || result.BodyPath != "" {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !textMediaType(mediaType) {
+		return
+	}
+
+	var e encoding.Encoding
+	var name string
+	if label := params["charset"]; label != "" {
+		if e, name = charset.Lookup(label); e == nil {
+			result.Charset = label
+			result.TranscodeFailed = true
+			return
+		}
+	} else if mediaType == "text/html" {
+		var certain bool
+		e, name, certain = charset.DetermineEncoding(result.Body, contentType)
+		// Without declaration valid UTF-8 is more likely than default guess.
+		if !certain && utf8.Valid(result.Body) {
+			name = "utf-8"
+		}
+	} else {
+		return
+	}
+	result.Charset = name
+	if name == "utf-8" {
+		return
+	}
+
+	decoded, err := e.NewDecoder().Bytes(result.Body)
+	if err != nil {
+		result.TranscodeFailed = true
+		return
+	}
+	result.Body = decoded
+	result.Length = int64(len(decoded))
+}
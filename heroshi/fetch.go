@@ -2,28 +2,143 @@ package heroshi
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/andybalholm/brotli"
 	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os"
+	"strings"
+	"syscall"
 	"time"
 )
 
-type FetchResult struct {
+// Redirect is one step of redirect chain: Url responded with StatusCode.
+type Redirect struct {
 	Url        *url.URL
-	Success    bool
-	Status     string
 	StatusCode int
-	Headers    http.Header
-	Body       []byte
-	Length     int64
-	Cached     bool
-	FetchTime  uint
-	TotalTime  uint
-	Stat       *RequestStat
+	// Headers of redirect response, possibly cut.
+	Location  string
+	SetCookie []string
 }
 
+type FetchResult struct {
+	Url *url.URL
+	// Category of failure, one of ErrorKind* constants. Empty on success.
+	ErrorKind string
+	// URL as requested by caller and URL of last request after redirects,
+	// filled by caller.
+	RequestedUrl  *url.URL
+	FinalUrl      *url.URL
+	RedirectChain []Redirect
+	Method        string
+	Success       bool
+	Status        string
+	StatusCode    int
+	Headers       http.Header
+	// Headers sent with request, filled by caller.
+	RequestHeaders http.Header
+	Body           []byte
+	// Name of file with body if it was too large to keep in memory.
+	// Body is nil in this case. Caller owns the file.
+	BodyPath string
+	Length   int64
+	// Length of body as received, before decompression.
+	// Zero if body was not compressed.
+	EncodedLength int64
+	// Body was cut at RequestOptions.MaxBodySize. Compressed body is cut
+	// before decoding, decoded one is cut at the same size.
+	Truncated bool
+	// Connection ended before Content-Length bytes of body were received,
+	// Body is what was received. See RequestOptions.StrictLength.
+	Incomplete bool
+	// Body was not read because of Content-Type, see RequestOptions.ContentTypes.
+	Skipped    bool
+	SkipReason string
+	// Body was gzip without Content-Encoding, see RequestOptions.SniffGzip.
+	SniffedGzip bool
+	// Response couldn't be parsed, Body is all bytes received and status
+	// is synthetic 200, see RequestOptions.Lenient.
+	Malformed bool
+	// Server replied 304 to conditional request.
+	NotModified bool
+	// Validators from response headers, to be sent in next conditional request.
+	ETag         string
+	LastModified string
+	Cached       bool
+	// Request carried cookies from jar, filled by caller.
+	CookiesUsed bool
+	FetchTime   uint
+	TotalTime   uint
+	// Time in milliseconds spent waiting for robots.txt Crawl-delay.
+	CrawlDelay uint
+	// robots.txt directive deciding for Url, filled by caller.
+	RobotsRule string
+	// How robots.txt gated Url, one of RobotsStatus* constants, filled by caller.
+	RobotsStatus string
+	// Source charset of text body, set with RequestOptions.TranscodeUTF8.
+	// TranscodeFailed means body is left in that charset or unknown one.
+	Charset         string
+	TranscodeFailed bool
+	// Hex SHA-256 of body after decompression and before transcoding,
+	// set with RequestOptions.HashBody. Empty if there is no body.
+	ContentHash string
+	// Earlier URL with the same ContentHash, filled by caller.
+	DuplicateOf string
+	// Server certificate expires within warning window, filled by caller.
+	// See RequestStat.TLSCertExpires.
+	CertExpiresSoon bool
+	// Why response failed ErrorKindValidation, filled by caller.
+	// Status and body are left as received.
+	ValidationError string
+	// Links followed from input URL to Url, filled by caller.
+	Depth int
+	Stat  *RequestStat
+}
+
+// Values of FetchResult.ErrorKind.
+const (
+	ErrorKindTimeout      = "timeout"
+	ErrorKindDNS          = "dns"
+	ErrorKindRefused      = "connection_refused"
+	ErrorKindConnect      = "connect"
+	ErrorKindTLS          = "tls"
+	ErrorKindNetwork      = "network" // other errors of connection or HTTP protocol
+	ErrorKindAborted      = "aborted"
+	ErrorKindRobots       = "robots"
+	ErrorKindRobots5xx    = "robots_5xx" // robots.txt status is 5xx
+	ErrorKindInvalidURL   = "invalid_url"
+	ErrorKindRedirectLoop = "redirect_loop"
+	ErrorKindDuplicate    = "duplicate"
+	ErrorKindHostLimit    = "host_limit"
+	ErrorKindFiltered     = "filtered" // URL rejected by caller's filter
+	ErrorKindCircuitOpen  = "circuit_open"
+	ErrorKindInput        = "input"      // caller failed to read input
+	ErrorKindValidation   = "validation" // response didn't meet caller's expectations
+	ErrorKindTruncated    = "truncated"  // body shorter than Content-Length, see RequestOptions.StrictLength
+)
+
+// Values of FetchResult.RobotsStatus.
+const (
+	RobotsStatusAllowed     = "allowed"
+	RobotsStatusDisallowed  = "disallowed"
+	RobotsStatusUnavailable = "unavailable" // robots.txt download failed
+	RobotsStatusSkipped     = "skipped"     // robots.txt is not checked at all
+	RobotsStatusSelf        = "self"        // Url is robots.txt itself
+)
+
 func ErrorResult(url *url.URL, reason string) *FetchResult {
 	return &FetchResult{
 		Url:     url,
@@ -32,32 +147,99 @@ func ErrorResult(url *url.URL, reason string) *FetchResult {
 	}
 }
 
-func BeginFetch(transport *Transport, req *http.Request, options *RequestOptions, ch chan *FetchResult) io.Closer {
-	// debug
-	if false {
-		dump, err := httputil.DumpRequest(req, true)
-		if err != nil {
-			panic(err)
-		}
-		println(string(dump))
+// ErrorKindResult is ErrorResult with ErrorKind set to kind.
+func ErrorKindResult(url *url.URL, kind, reason string) *FetchResult {
+	result := ErrorResult(url, reason)
+	result.ErrorKind = kind
+	return result
+}
+
+// ErrorResultFromError is ErrorResult with ErrorKind derived from type of err.
+func ErrorResultFromError(url *url.URL, err error) *FetchResult {
+	return ErrorKindResult(url, ErrorKind(err), err.Error())
+}
+
+// ErrorKind classifies err as one of ErrorKind* constants.
+func ErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrorKindDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorKindTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorKindRefused
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorKindTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrorKindConnect
 	}
+	return ErrorKindNetwork
+}
 
+func BeginFetch(transport *Transport, req *http.Request, options *RequestOptions, ch chan *FetchResult) io.Closer {
 	conn, err := transport.GetConnRequest(req, options)
 	if err != nil {
-		ch <- ErrorResult(req.URL, err.Error())
+		ch <- ErrorResultFromError(req.URL, err)
 		return nil
 	}
 
+	var stat *RequestStat
+	if options != nil {
+		stat = options.Stat
+	}
+	var sent0, received0 int64
+	if stat != nil {
+		sent0, received0 = conn.ByteCount()
+	}
+	countBytes := func() {
+		if stat != nil {
+			sent, received := conn.ByteCount()
+			stat.BytesSent = sent - sent0
+			stat.BytesReceived = received - received0
+		}
+	}
+
 	go func() {
-		err := conn.WriteRequest(req, options)
+		response, err := exchange(conn, req, options)
 		if err != nil {
-			ch <- ErrorResult(req.URL, err.Error())
+			ch <- ErrorResultFromError(req.URL, err)
 			return
 		}
-		response, err := conn.ReadResponse(options)
-		if err != nil {
-			ch <- ErrorResult(req.URL, err.Error())
-			return
+
+		defer response.Body.Close()
+		if options != nil {
+			if reason := skipContentType(response.Header.Get("Content-Type"), options); reason != "" {
+				// Body is not needed, closing is cheaper than reading it to reuse connection.
+				closeEarly(conn, response.Body)
+				countBytes()
+				result := headerResult(req, response)
+				result.Skipped = true
+				result.SkipReason = reason
+				ch <- result
+				return
+			}
+			if options.SkipBody {
+				if !discardBody(response.Body) {
+					closeEarly(conn, response.Body)
+				}
+				countBytes()
+				result := headerResult(req, response)
+				if response.ContentLength > 0 {
+					result.Length = response.ContentLength
+				}
+				ch <- result
+				return
+			}
 		}
 
 		var read_body_started time.Time
@@ -65,55 +247,456 @@ func BeginFetch(transport *Transport, req *http.Request, options *RequestOptions
 			read_body_started = time.Now()
 		}
 
-		defer response.Body.Close()
-		var buf bytes.Buffer
-		var body_len int64
-		body_len, err = io.Copy(&buf, response.Body)
+		var body io.Reader = response.Body
+		var short *shortBodyReader
+		if response.ContentLength > 0 {
+			short = &shortBodyReader{r: body}
+			body = short
+		}
+		if options != nil && options.Throttle != nil {
+			body = &throttledReader{r: body, wait: options.Throttle}
+		}
+		var limited *truncatingReader
+		if limit := bodyLimit(response, options); limit > 0 {
+			limited = &truncatingReader{r: body, n: limit}
+			body = limited
+		}
+		responseBody, bodyPath, body_len, err := readBody(body, options)
+		countBytes()
+		truncated := limited != nil && limited.truncated
+		incomplete := short != nil && short.short
+		if truncated || incomplete {
+			// Rest of body is not needed or never comes, don't wait for it to reuse connection.
+			closeEarly(conn, response.Body)
+		}
 
 		if options != nil && options.Stat != nil {
 			options.Stat.ReadBodyTime = time.Now().Sub(read_body_started)
+			if options.Stat.ReadBodyTime > 0 {
+				options.Stat.ReadBodyRate = int64(float64(body_len) / options.Stat.ReadBodyTime.Seconds())
+			}
 		}
 
-		responseBody := buf.Bytes()
 		if err != nil {
-			ch <- ErrorResult(req.URL, err.Error())
+			ch <- ErrorResultFromError(req.URL, err)
+			return
+		}
+		if incomplete && options != nil && options.StrictLength {
+			if bodyPath != "" {
+				os.Remove(bodyPath)
+			}
+			ch <- ErrorKindResult(req.URL, ErrorKindTruncated,
+				fmt.Sprintf("Body incomplete: %d of %d bytes", body_len, response.ContentLength))
 			return
 		}
 
-		ch <- &FetchResult{
-			Url:        req.URL,
-			Success:    true,
-			Status:     response.Status,
-			StatusCode: response.StatusCode,
-			Body:       responseBody,
-			Length:     body_len,
-			Headers:    response.Header,
+		result := headerResult(req, response)
+		result.Body = responseBody
+		result.BodyPath = bodyPath
+		result.Length = body_len
+		result.Truncated = truncated
+		result.Incomplete = incomplete
+		if options != nil && options.Decompress {
+			decodeBody(result, response.Header.Get("Content-Encoding"), options)
+		}
+		if options != nil && options.Decompress && options.SniffGzip && sniffGzip(result, response.Header) {
+			decodeBody(result, "gzip", options)
+			result.SniffedGzip = result.EncodedLength != 0
+		}
+		if options != nil && options.HashBody {
+			result.ContentHash = hashBody(result)
 		}
+		if options != nil && options.TranscodeUTF8 && (result.EncodedLength != 0 || identityEncoding(response.Header)) {
+			transcodeBody(result, response.Header.Get("Content-Type"))
+		}
+		ch <- result
 	}()
 
 	return conn
 }
 
+// headerResult returns successful result of response without body.
+func headerResult(req *http.Request, response *http.Response) *FetchResult {
+	return &FetchResult{
+		Url:        req.URL,
+		Method:     req.Method,
+		Success:    true,
+		Status:     response.Status,
+		StatusCode: response.StatusCode,
+		Headers:    response.Header,
+
+		Malformed:    isMalformed(response),
+		NotModified:  response.StatusCode == http.StatusNotModified,
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	}
+}
+
+// Body up to this size is read and discarded with RequestOptions.SkipBody
+// to reuse connection, larger one is not worth it.
+const skipBodyDrainLimit = 4 << 10
+
+// discardBody reads body to the end if it is small enough.
+// Returns false if body was left unread and connection must be closed.
+func discardBody(body io.Reader) bool {
+	n, err := io.CopyN(ioutil.Discard, body, skipBodyDrainLimit+1)
+	return n <= skipBodyDrainLimit && err == io.EOF
+}
+
+// bodyLimit returns size to cut body of response at, 0 means no limit.
+func bodyLimit(response *http.Response, options *RequestOptions) int64 {
+	if options == nil {
+		return 0
+	}
+	limit := options.MaxBodySize
+	redirect := response.StatusCode/100 == 3 && response.Header.Get("Location") != ""
+	if redirect && options.RedirectBodyLimit > 0 && (limit <= 0 || options.RedirectBodyLimit < limit) {
+		limit = options.RedirectBodyLimit
+	}
+	return limit
+}
+
+// skipContentType returns reason to skip body of contentType according to
+// options.ContentTypes and options.SkipContentTypes or empty string if body is wanted.
+// Response without Content-Type is never skipped because its type is unknown.
+func skipContentType(contentType string, options *RequestOptions) string {
+	return ContentTypeSkipReason(contentType, options.ContentTypes, options.SkipContentTypes)
+}
+
+// ContentTypeSkipReason checks contentType against allow (if not empty) and skip
+// lists as in RequestOptions.ContentTypes. Returns reason to skip or empty string.
+func ContentTypeSkipReason(contentType string, allow, skip []string) string {
+	if contentType == "" || (len(allow) == 0 && len(skip) == 0) {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	if len(allow) != 0 && !matchMediaType(mediaType, allow) {
+		return "Content-Type not allowed: " + mediaType
+	}
+	if matchMediaType(mediaType, skip) {
+		return "Content-Type skipped: " + mediaType
+	}
+	return ""
+}
+
+func matchMediaType(mediaType string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if mediaType == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(mediaType, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// shortBodyReader reports io.EOF instead of io.ErrUnexpectedEOF, which
+// body reader returns when connection ends before Content-Length, so what
+// was received is kept. short is set then, see FetchResult.Incomplete.
+type shortBodyReader struct {
+	r     io.Reader
+	short bool
+}
+
+func (s *shortBodyReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		s.short = true
+		err = io.EOF
+	}
+	return n, err
+}
+
+// truncatingReader reads up to n bytes from r and then reports EOF.
+// truncated is set if r had more data.
+type truncatingReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (t *truncatingReader) Read(p []byte) (int, error) {
+	if t.n <= 0 {
+		var probe [1]byte
+		for {
+			n, err := t.r.Read(probe[:])
+			if n > 0 {
+				t.truncated = true
+			}
+			if n > 0 || err != nil {
+				return 0, io.EOF
+			}
+		}
+	}
+	if int64(len(p)) > t.n {
+		p = p[:t.n]
+	}
+	n, err := t.r.Read(p)
+	t.n -= int64(n)
+	return n, err
+}
+
+// Largest read under throttle, so that one read doesn't take long at low rate.
+const throttleChunk = 16 << 10
+
+// throttledReader calls wait with number of bytes after each read from r.
+type throttledReader struct {
+	r    io.Reader
+	wait func(n int) error
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.wait(n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// readBody reads whole r into memory. If options.BodyDir is set and body is
+// larger than options.BodyInlineLimit, body is written to a temporary file in
+// BodyDir and its name is returned instead. On error the file is removed.
+func readBody(r io.Reader, options *RequestOptions) (body []byte, path string, n int64, err error) {
+	var buf bytes.Buffer
+	if options == nil || options.BodyDir == "" {
+		n, err = io.Copy(&buf, r)
+		return buf.Bytes(), "", n, err
+	}
+
+	n, err = io.Copy(&buf, io.LimitReader(r, options.BodyInlineLimit+1))
+	if err != nil || n <= options.BodyInlineLimit {
+		return buf.Bytes(), "", n, err
+	}
+
+	f, err := ioutil.TempFile(options.BodyDir, "body-")
+	if err != nil {
+		return nil, "", n, err
+	}
+	if _, err = buf.WriteTo(f); err == nil {
+		var rest int64
+		rest, err = io.Copy(f, r)
+		n += rest
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, "", n, err
+	}
+	return nil, f.Name(), n, nil
+}
+
+func decoder(encoding string, src io.ReadSeeker) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(src)
+	case "deflate":
+		// Deflate is supposed to be zlib format, but some servers send raw deflate.
+		r, err := zlib.NewReader(src)
+		if err != nil {
+			if _, err = src.Seek(0, 0); err != nil {
+				return nil, err
+			}
+			r = flate.NewReader(src)
+		}
+		return r, nil
+	case "br":
+		return brotli.NewReader(src), nil
+	}
+	return nil, nil
+}
+
+func identityEncoding(header http.Header) bool {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	return encoding == "" || encoding == "identity"
+}
+
+// sniffGzip tells whether body of result is gzip sent without
+// Content-Encoding. Only HTML or body of unknown type is checked,
+// other binary formats may start with gzip magic by chance.
+func sniffGzip(result *FetchResult, header http.Header) bool {
+	if !identityEncoding(header) {
+		return false
+	}
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "text/html" {
+			return false
+		}
+	}
+	magic := result.Body
+	if result.BodyPath != "" {
+		f, err := os.Open(result.BodyPath)
+		if err != nil {
+			return false
+		}
+		magic = make([]byte, 2)
+		n, _ := io.ReadFull(f, magic)
+		magic = magic[:n]
+		f.Close()
+	}
+	return len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// decodeBody replaces compressed result body with decoded one according to
+// Content-Encoding. Decoded body is limited to options.ReadLimit bytes.
+// On unknown encoding or any decoding error body is left as is.
+func decodeBody(result *FetchResult, encoding string, options *RequestOptions) {
+	if result.BodyPath != "" {
+		decodeBodyFile(result, encoding, options)
+		return
+	}
+
+	r, err := decoder(encoding, bytes.NewReader(result.Body))
+	if r == nil || err != nil {
+		return
+	}
+	r = cutDecoded(r, result)
+	limit := options.ReadLimit
+	if limit != 0 {
+		r = io.LimitReader(r, int64(limit)+1)
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil || (limit != 0 && uint64(len(decoded)) > limit) {
+		return
+	}
+	result.EncodedLength = result.Length
+	result.Body = decoded
+	result.Length = int64(len(decoded))
+}
+
+// cutDecoded cuts decoded body of truncated result at the size encoded one
+// was cut at, same as body without Content-Encoding. Decoding of cut body
+// stops early with io.ErrUnexpectedEOF, that's not an error here.
+func cutDecoded(r io.Reader, result *FetchResult) io.Reader {
+	if !result.Truncated {
+		return r
+	}
+	return io.LimitReader(&shortBodyReader{r: r}, result.Length)
+}
+
+// decodeBodyFile is decodeBody for body stored in result.BodyPath.
+// Decoded body is written to new file, compressed one is removed.
+func decodeBodyFile(result *FetchResult, encoding string, options *RequestOptions) {
+	src, err := os.Open(result.BodyPath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	r, err := decoder(encoding, src)
+	if r == nil || err != nil {
+		return
+	}
+	r = cutDecoded(r, result)
+	limit := options.ReadLimit
+	if limit != 0 {
+		r = io.LimitReader(r, int64(limit)+1)
+	}
+
+	dst, err := ioutil.TempFile(options.BodyDir, "body-")
+	if err != nil {
+		return
+	}
+	n, err := io.Copy(dst, r)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || (limit != 0 && uint64(n) > limit) {
+		os.Remove(dst.Name())
+		return
+	}
+	os.Remove(result.BodyPath)
+	result.EncodedLength = result.Length
+	result.BodyPath = dst.Name()
+	result.Length = n
+}
+
+// hashBody returns hex SHA-256 of result body, in memory or in file.
+// Empty body or unreadable file has no hash.
+func hashBody(result *FetchResult) string {
+	if result.Length == 0 {
+		return ""
+	}
+	h := sha256.New()
+	if result.BodyPath == "" {
+		h.Write(result.Body)
+	} else {
+		f, err := os.Open(result.BodyPath)
+		if err != nil {
+			return ""
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return ""
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Fetch is FetchContext with timeout.
 func Fetch(transport *Transport, req *http.Request, options *RequestOptions, timeout time.Duration) (result *FetchResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return FetchContext(ctx, transport, req, options)
+}
+
+// FetchContext sends req and reads response. When ctx is done, connection is
+// closed and error result is returned right away, even if connection is not
+// established yet.
+func FetchContext(ctx context.Context, transport *Transport, req *http.Request, options *RequestOptions) (result *FetchResult) {
+	started := time.Now()
 	if options != nil && options.Stat != nil && options.Stat.Started.IsZero() {
-		options.Stat.Started = time.Now()
+		options.Stat.Started = started
 	}
+	req = req.WithContext(ctx)
 
 	ch := make(chan *FetchResult, 1)
-	conn := BeginFetch(transport, req, options, ch)
+	connCh := make(chan io.Closer, 1)
+	go func() {
+		connCh <- BeginFetch(transport, req, options, ch)
+	}()
 
 	select {
 	case result = <-ch:
-	case <-time.After(timeout):
-		// TODO: check result of Close
-		_ = conn.Close()
-		result = ErrorResult(req.URL, fmt.Sprintf("Fetch timeout: %d", timeout/time.Millisecond))
+	case <-ctx.Done():
+		go func() {
+			// conn is nil if connection failed, error is already in ch.
+			if conn := <-connCh; conn != nil {
+				// TODO: check result of Close
+				_ = conn.Close()
+			}
+			// Late result may hold a body file nobody will read.
+			if late := <-ch; late.BodyPath != "" {
+				os.Remove(late.BodyPath)
+			}
+		}()
+		if ctx.Err() == context.DeadlineExceeded {
+			timeout := time.Since(started)
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = deadline.Sub(started)
+			}
+			result = ErrorKindResult(req.URL, ErrorKindTimeout, fmt.Sprintf("Fetch timeout: %d", timeout/time.Millisecond))
+		} else {
+			result = ErrorKindResult(req.URL, ErrorKindAborted, "Fetch aborted")
+		}
 	}
 
 	if options != nil && options.Stat != nil && !options.Stat.Started.IsZero() {
 		options.Stat.TotalTime = time.Now().Sub(options.Stat.Started)
 		result.FetchTime = uint(options.Stat.TotalTime / time.Millisecond)
 	}
+	if options != nil {
+		result.Stat = options.Stat
+	}
 
 	return result
 }
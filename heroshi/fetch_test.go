@@ -0,0 +1,513 @@
+package heroshi
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal("compress:", err.Error())
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	plain := bytes.Repeat([]byte("Everything is fine."), 50)
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate"} {
+		encoded := compress(t, encoding, plain)
+		result := &FetchResult{Body: encoded, Length: int64(len(encoded))}
+		header := encoding
+		if encoding == "raw-deflate" {
+			header = "deflate"
+		}
+		decodeBody(result, header, &RequestOptions{})
+		if !bytes.Equal(result.Body, plain) {
+			t.Error(encoding, ": decoded body does not match")
+		}
+		if result.Length != int64(len(plain)) || result.EncodedLength != int64(len(encoded)) {
+			t.Error(encoding, ": Length:", result.Length, "EncodedLength:", result.EncodedLength)
+		}
+	}
+}
+
+// Broken or too large compressed body must be returned as is.
+func TestDecodeBodyFallback(t *testing.T) {
+	garbage := []byte("not really gzip")
+	result := &FetchResult{Body: garbage, Length: int64(len(garbage))}
+	decodeBody(result, "gzip", &RequestOptions{})
+	if !bytes.Equal(result.Body, garbage) || result.EncodedLength != 0 {
+		t.Error("Broken gzip: body changed")
+	}
+
+	encoded := compress(t, "gzip", bytes.Repeat([]byte("x"), 1000))
+	result = &FetchResult{Body: encoded, Length: int64(len(encoded))}
+	decodeBody(result, "gzip", &RequestOptions{ReadLimit: 100})
+	if !bytes.Equal(result.Body, encoded) {
+		t.Error("Limit exceeded: body changed")
+	}
+}
+
+func TestFetchStat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 42))
+	}))
+	defer server.Close()
+
+	request, err := http.NewRequest("GET", server.URL+"/stat", nil)
+	if err != nil {
+		t.Fatal("NewRequest:", err.Error())
+	}
+
+	options := &RequestOptions{Stat: new(RequestStat)}
+	result := Fetch(&Transport{}, request, options, time.Second)
+	if !result.Success {
+		t.Fatal("Fetch:", result.Status)
+	}
+	if result.Stat != options.Stat {
+		t.Fatal("Stat is not attached to result")
+	}
+	if result.Stat.RemoteAddr == nil || result.Stat.ConnectTime == 0 {
+		t.Error("Stat is not filled:", result.Stat)
+	}
+	// Wire bytes include request line, status line and headers, not only body.
+	if result.Stat.BytesSent <= int64(len("GET /stat HTTP/1.1\r\n")) || result.Stat.BytesReceived <= result.Length {
+		t.Error("Byte counts are not filled:", result.Stat.BytesSent, result.Stat.BytesReceived, result.Length)
+	}
+}
+
+func TestReadBodyToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "heroshi-test")
+	if err != nil {
+		t.Fatal("TempDir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	options := &RequestOptions{BodyDir: dir, BodyInlineLimit: 10}
+
+	body, path, n, err := readBody(strings.NewReader("small"), options)
+	if err != nil || string(body) != "small" || path != "" || n != 5 {
+		t.Fatal("Small body must stay in memory:", string(body), path, n, err)
+	}
+
+	big := strings.Repeat("x", 100)
+	body, path, n, err = readBody(strings.NewReader(big), options)
+	if err != nil || body != nil || path == "" || n != 100 {
+		t.Fatal("Big body must go to file:", len(body), path, n, err)
+	}
+	stored, err := ioutil.ReadFile(path)
+	if err != nil || string(stored) != big {
+		t.Fatal("Stored body does not match:", len(stored), err)
+	}
+}
+
+func TestTruncatingReader(t *testing.T) {
+	r := &truncatingReader{r: strings.NewReader("0123456789"), n: 4}
+	body, err := ioutil.ReadAll(r)
+	if err != nil || string(body) != "0123" || !r.truncated {
+		t.Error("Expected truncated 0123, got:", string(body), r.truncated, err)
+	}
+
+	r = &truncatingReader{r: strings.NewReader("0123"), n: 4}
+	body, err = ioutil.ReadAll(r)
+	if err != nil || string(body) != "0123" || r.truncated {
+		t.Error("Body of exactly limit size is not truncated, got:", string(body), r.truncated, err)
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := listener.Addr().String()
+	listener.Close()
+	_, refusedErr := net.Dial("tcp", closedAddr)
+
+	cases := []struct {
+		err  error
+		kind string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "invalid.", IsNotFound: true}, ErrorKindDNS},
+		{&Error{str: "ReadResponse timeout", timeout: true}, ErrorKindTimeout},
+		{refusedErr, ErrorKindRefused},
+		{x509.UnknownAuthorityError{}, ErrorKindTLS},
+		{io.ErrUnexpectedEOF, ErrorKindNetwork},
+	}
+	for _, c := range cases {
+		if kind := ErrorKind(c.err); kind != c.kind {
+			t.Error("ErrorKind", c.err, "expected", c.kind, "got:", kind)
+		}
+	}
+}
+
+func TestTranscodeBody(t *testing.T) {
+	cases := []struct {
+		contentType, body string
+		charset, expected string
+		failed            bool
+	}{
+		{"text/plain; charset=iso-8859-1", "caf\xe9", "windows-1252", "café", false},
+		{"text/html", `<meta charset="iso-8859-1">caf` + "\xe9", "windows-1252", `<meta charset="iso-8859-1">café`, false},
+		{"text/html", "café", "utf-8", "café", false},
+		{"text/plain; charset=x-no-such-charset", "caf\xe9", "x-no-such-charset", "caf\xe9", true},
+		{"image/png; charset=iso-8859-1", "\x89PNG\xe9", "", "\x89PNG\xe9", false},
+		{"text/plain", "caf\xe9", "", "caf\xe9", false},
+	}
+	for _, c := range cases {
+		result := &FetchResult{Body: []byte(c.body), Length: int64(len(c.body))}
+		transcodeBody(result, c.contentType)
+		if string(result.Body) != c.expected || result.Charset != c.charset || result.TranscodeFailed != c.failed {
+			t.Errorf("%s: expected %q from %s (failed %v), got %q from %s (failed %v)", c.contentType,
+				c.expected, c.charset, c.failed, result.Body, result.Charset, result.TranscodeFailed)
+		}
+		if result.Length != int64(len(result.Body)) {
+			t.Errorf("%s: Length %d of %d bytes", c.contentType, result.Length, len(result.Body))
+		}
+	}
+}
+
+func TestFetchStream(t *testing.T) {
+	body := strings.Repeat("stream ", 10000)
+	hang := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-hang
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	transport := &Transport{}
+	stream := func(path string, options *RequestOptions) *StreamResult {
+		request, _ := http.NewRequest("GET", server.URL+path, nil)
+		result, err := FetchStream(context.Background(), transport, request, options)
+		if err != nil {
+			t.Fatal("FetchStream:", err.Error())
+		}
+		if result.StatusCode != 200 {
+			t.Fatal("Unexpected status:", result.Status)
+		}
+		return result
+	}
+
+	// Body read to EOF returns connection to pool.
+	var uses []uint
+	for i := 0; i < 2; i++ {
+		options := &RequestOptions{Stat: new(RequestStat)}
+		result := stream("/", options)
+		data, err := ioutil.ReadAll(result.Body)
+		result.Body.Close()
+		if err != nil || string(data) != body {
+			t.Fatal("Unexpected body:", len(data), err)
+		}
+		uses = append(uses, options.Stat.ConnectionUse)
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Body closed early closes connection.
+	result := stream("/", nil)
+	result.Body.Read(make([]byte, 10))
+	result.Body.Close()
+	options := &RequestOptions{Stat: new(RequestStat)}
+	stream("/", options).Body.Close()
+	uses = append(uses, options.Stat.ConnectionUse)
+	if fmt.Sprint(uses) != "[1 2 1]" {
+		t.Fatal("Unexpected connection uses:", uses)
+	}
+
+	result = stream("/hang", &RequestOptions{ReadTimeout: 50 * time.Millisecond})
+	defer result.Body.Close()
+	data, err := ioutil.ReadAll(result.Body)
+	if string(data) != "partial" || err == nil || ErrorKind(err) != ErrorKindTimeout {
+		t.Fatal("Expected timeout after partial body, got:", string(data), err)
+	}
+}
+
+func TestSkipBody(t *testing.T) {
+	// Multiples of chunk size.
+	sizes := map[string]int64{"/small": 100, "/large": 1000000}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(sizes[r.URL.Path]))
+		chunk := make([]byte, 100)
+		for n := sizes[r.URL.Path]; n > 0; n -= 100 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	transport := &Transport{}
+	var uses []uint
+	for _, path := range []string{"/small", "/small", "/large", "/small"} {
+		request, _ := http.NewRequest("GET", server.URL+path, nil)
+		options := &RequestOptions{Stat: new(RequestStat), SkipBody: true}
+		result := Fetch(transport, request, options, time.Second)
+		if !result.Success || result.Body != nil || result.Length != sizes[path] {
+			t.Fatal("Unexpected result:", result.Status, len(result.Body), result.Length)
+		}
+		if options.Stat.BytesReceived > 100<<10 {
+			t.Fatal("Body was downloaded:", options.Stat.BytesReceived)
+		}
+		uses = append(uses, options.Stat.ConnectionUse)
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Small body is drained to keep connection, large one closes it.
+	if fmt.Sprint(uses) != "[1 2 3 1]" {
+		t.Fatal("Unexpected connection uses:", uses)
+	}
+}
+
+// waitGoroutines fails t unless number of goroutines drops to n within a second.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatal("Leaked goroutines:", runtime.NumGoroutine()-n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Connection closed before body is read to the end must not leave its
+// readLoop waiting for the rest.
+func TestCloseEarly(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/short" {
+			w.Header().Set("Content-Length", "800")
+			w.Write(make([]byte, 400))
+			return
+		}
+		w.Write(make([]byte, 1<<20))
+	}))
+	defer server.Close()
+
+	transport := &Transport{}
+	before := runtime.NumGoroutine()
+	for _, c := range []struct {
+		path    string
+		options *RequestOptions
+	}{
+		{"/", &RequestOptions{SkipContentTypes: []string{"text/plain"}}},
+		{"/", &RequestOptions{MaxBodySize: 100}},
+		{"/", &RequestOptions{SkipBody: true}},
+		{"/short", &RequestOptions{}},
+	} {
+		for i := 0; i < 20; i++ {
+			request, _ := http.NewRequest("GET", server.URL+c.path, nil)
+			if result := Fetch(transport, request, c.options, time.Second); !result.Success {
+				t.Fatal(c.path, "Fetch:", result.Status)
+			}
+		}
+	}
+	for i := 0; i < 20; i++ {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		result, err := FetchStream(context.Background(), transport, request, nil)
+		if err != nil {
+			t.Fatal("FetchStream:", err.Error())
+		}
+		result.Body.Read(make([]byte, 10))
+		result.Body.Close()
+	}
+	waitGoroutines(t, before)
+}
+
+func TestTruncateDecoded(t *testing.T) {
+	plain := []byte(strings.Repeat("truncated gzip ", 10000))
+	encoded := compress(t, "gzip", plain)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encoded)
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	result := Fetch(&Transport{}, request, &RequestOptions{Decompress: true, MaxBodySize: 200}, time.Second)
+	if !result.Success || !result.Truncated || result.EncodedLength != 200 || !bytes.Equal(result.Body, plain[:200]) {
+		t.Fatal("Expected decoded body cut at 200 bytes, got:", result.Status, result.Truncated, result.EncodedLength, len(result.Body))
+	}
+}
+
+func TestSniffGzip(t *testing.T) {
+	plain := []byte("<html>Everything is fine.</html>")
+	encoded := compress(t, "gzip", plain)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/untyped" {
+			w.Header().Set("Content-Type", r.URL.Path[1:])
+		} else {
+			// Prevent Content-Type detection by net/http.
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write(encoded)
+	}))
+	defer server.Close()
+
+	for path, sniffed := range map[string]bool{
+		"/text/html":                true,
+		"/untyped":                  true,
+		"/application/octet-stream": false,
+		"/application/gzip":         false,
+	} {
+		request, _ := http.NewRequest("GET", server.URL+path, nil)
+		result := Fetch(&Transport{}, request, &RequestOptions{Decompress: true, SniffGzip: true}, time.Second)
+		if !result.Success || result.SniffedGzip != sniffed {
+			t.Fatal(path, "expected sniffed", sniffed, "got:", result.Status, result.SniffedGzip)
+		}
+		if sniffed && !bytes.Equal(result.Body, plain) || !sniffed && !bytes.Equal(result.Body, encoded) {
+			t.Fatal(path, "unexpected body:", result.Body)
+		}
+	}
+
+	// Nothing is decoded without Decompress.
+	request, _ := http.NewRequest("GET", server.URL+"/text/html", nil)
+	result := Fetch(&Transport{}, request, &RequestOptions{SniffGzip: true}, time.Second)
+	if result.SniffedGzip || !bytes.Equal(result.Body, encoded) {
+		t.Fatal("Expected gzip body as is, got sniffed:", result.SniffedGzip)
+	}
+}
+
+func TestDump(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "dump")
+		w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	transport := &Transport{}
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("POST", server.URL+"/path", strings.NewReader("payload"))
+		request.Header.Set("X-Request", "dump")
+		options := &RequestOptions{Stat: new(RequestStat), Dump: true, WriteTimeout: time.Duration(i) * time.Second}
+		result := Fetch(transport, request, options, time.Second)
+		if !result.Success || string(result.Body) != "body" {
+			t.Fatal("Expected body kept, got:", result.Status, string(result.Body))
+		}
+		raw := string(options.Stat.RawRequest)
+		if !strings.HasPrefix(raw, "POST /path HTTP/1.1\r\n") || !strings.Contains(raw, "X-Request: dump\r\n") ||
+			!strings.HasSuffix(raw, "\r\n\r\n") {
+			t.Fatalf("Unexpected raw request: %q", raw)
+		}
+		head := string(options.Stat.RawResponseHead)
+		if !strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n") || !strings.Contains(head, "X-Test: dump\r\n") ||
+			!strings.HasSuffix(head, "\r\n\r\n") {
+			t.Fatalf("Unexpected raw response head: %q", head)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	options := &RequestOptions{Stat: new(RequestStat)}
+	Fetch(transport, request, options, time.Second)
+	if options.Stat.RawRequest != nil || options.Stat.RawResponseHead != nil {
+		t.Fatal("Expected nothing dumped without Dump")
+	}
+}
+
+func TestLenient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err.Error())
+	}
+	defer listener.Close()
+	raw := "legacy server says hi\n" + strings.Repeat("x", 10000)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if request.URL.Path == "/valid" {
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				} else {
+					io.WriteString(conn, raw)
+				}
+			}()
+		}
+	}()
+
+	transport := &Transport{}
+	url := fmt.Sprintf("http://%s/", listener.Addr().String())
+	request, _ := http.NewRequest("GET", url, nil)
+	result := Fetch(transport, request, &RequestOptions{}, time.Second)
+	if result.Success || result.Malformed {
+		t.Fatal("Expected parse error without Lenient, got:", result.Status)
+	}
+
+	request, _ = http.NewRequest("GET", url, nil)
+	result = Fetch(transport, request, &RequestOptions{Lenient: true, ReadTimeout: time.Second}, time.Second)
+	if !result.Success || result.StatusCode != 200 || !result.Malformed || string(result.Body) != raw {
+		t.Fatal("Expected raw bytes as malformed response, got:", result.Status, result.Malformed, len(result.Body))
+	}
+
+	request, _ = http.NewRequest("GET", url+"valid", nil)
+	result = Fetch(transport, request, &RequestOptions{Lenient: true}, time.Second)
+	if !result.Success || result.Malformed || string(result.Body) != "ok" {
+		t.Fatal("Expected valid response, got:", result.Status, result.Malformed, string(result.Body))
+	}
+}
+
+func TestIncompleteBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "800")
+		// Server closes connection after handler wrote less than declared.
+		w.Write(bytes.Repeat([]byte("x"), 400))
+	}))
+	defer server.Close()
+
+	transport := &Transport{}
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	result := Fetch(transport, request, &RequestOptions{}, time.Second)
+	if !result.Success || !result.Incomplete || result.Length != 400 || len(result.Body) != 400 {
+		t.Fatal("Expected incomplete 400 bytes, got:", result.Status, result.Incomplete, result.Length)
+	}
+
+	request, _ = http.NewRequest("GET", server.URL, nil)
+	result = Fetch(transport, request, &RequestOptions{StrictLength: true}, time.Second)
+	if result.Success || result.ErrorKind != ErrorKindTruncated {
+		t.Fatal("Expected truncated error, got:", result.ErrorKind, result.Status)
+	}
+
+	// Body cut at MaxBodySize is not incomplete.
+	request, _ = http.NewRequest("GET", server.URL, nil)
+	result = Fetch(transport, request, &RequestOptions{MaxBodySize: 100, StrictLength: true}, time.Second)
+	if !result.Success || result.Incomplete || !result.Truncated {
+		t.Fatal("Expected truncated body, got:", result.Status, result.Incomplete, result.Truncated)
+	}
+}
@@ -0,0 +1,98 @@
+package heroshi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// writeRequestH2 starts HTTP/2 round trip, response goes to pc.rech.
+// HTTP/2 client writes request and reads headers in one call, so both
+// are limited together in readResponseH2.
+func (pc *PersistConn) writeRequestH2(req *http.Request, opt *RequestOptions) {
+	pc.lastUsed = time.Now()
+	if opt != nil && opt.Dump && opt.Stat != nil {
+		opt.Stat.RawRequest, _ = httputil.DumpRequest(req, false)
+	}
+	go func() {
+		resp, err := pc.h2.RoundTrip(req)
+		pc.rech <- responseAndError{resp, err}
+	}()
+}
+
+// readResponseH2 is ReadResponse for HTTP/2 connection with the same
+// timeouts and ReadLimit as readLoop applies to HTTP/1, except that
+// ReadLimit counts only body. Connection returns to idle pool when body
+// is read to EOF or closed.
+func (pc *PersistConn) readResponseH2(opt *RequestOptions) (resp *http.Response, err error) {
+	started := time.Now()
+	var timeout time.Duration
+	if opt != nil {
+		timeout = opt.WriteTimeout + opt.ReadTimeout
+	}
+	var re responseAndError
+	if timeout == 0 {
+		re = <-pc.rech
+	} else {
+		select {
+		case re = <-pc.rech:
+		case <-time.After(timeout):
+			re.err = &Error{str: "ReadResponse timeout", timeout: true, temporary: true}
+		}
+	}
+	pc.lk.Lock()
+	pc.numExpectedResponses--
+	pc.lk.Unlock()
+	if opt != nil && opt.Stat != nil {
+		opt.Stat.ReadHeaderTime = time.Now().Sub(started)
+	}
+	if re.err != nil {
+		pc.Close()
+		return nil, re.err
+	}
+	if opt != nil && opt.Dump && opt.Stat != nil {
+		opt.Stat.RawResponseHead, _ = httputil.DumpResponse(re.resp, false)
+	}
+
+	body := &h2Body{body: re.resp.Body, release: pc.h2release}
+	if opt != nil && opt.ReadLimit != 0 {
+		body.limited = true
+		body.left = int64(opt.ReadLimit)
+	}
+	re.resp.Body = body
+	return re.resp, nil
+}
+
+var errReadLimitH2 = &Error{str: "ReadLimit exceeded"}
+
+// h2Body is response body of one HTTP/2 stream.
+type h2Body struct {
+	body    io.ReadCloser
+	limited bool
+	left    int64 // bytes until ReadLimit
+	release func()
+	once    sync.Once
+}
+
+func (b *h2Body) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.limited {
+		b.left -= int64(n)
+		if b.left < 0 {
+			return 0, errReadLimitH2
+		}
+	}
+	if err == io.EOF {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *h2Body) Close() error {
+	// Closing stream early doesn't affect other streams, connection is still good.
+	err := b.body.Close()
+	b.once.Do(b.release)
+	return err
+}
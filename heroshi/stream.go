@@ -0,0 +1,148 @@
+package heroshi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// StreamResult is response of FetchStream with body not read yet.
+type StreamResult struct {
+	Url        *url.URL
+	Method     string
+	Status     string
+	StatusCode int
+	Headers    http.Header
+	// Body must be closed by caller. Whole response is limited by
+	// RequestOptions.ReadLimit and every Read by ReadTimeout, Read past
+	// timeout closes connection and returns timeout error.
+	// Connection returns to idle pool when body is read to EOF,
+	// closing body before that closes connection.
+	Body io.ReadCloser
+	Stat *RequestStat
+}
+
+// FetchStream sends req and returns as soon as response headers are read,
+// so large body may be processed without keeping it in memory. Unlike
+// FetchContext, body is passed as is: options to decompress, cut, skip or
+// store body don't apply. When ctx is done, connection is closed, both
+// before and after FetchStream returns. Error may be classified with ErrorKind.
+func FetchStream(ctx context.Context, transport *Transport, req *http.Request, options *RequestOptions) (*StreamResult, error) {
+	if options != nil && options.Stat != nil && options.Stat.Started.IsZero() {
+		options.Stat.Started = time.Now()
+	}
+	req = req.WithContext(ctx)
+
+	ch := make(chan responseAndError, 1)
+	connCh := make(chan *PersistConn, 1)
+	go func() {
+		conn, err := transport.GetConnRequest(req, options)
+		connCh <- conn
+		if err != nil {
+			ch <- responseAndError{nil, err}
+			return
+		}
+		response, err := exchange(conn, req, options)
+		ch <- responseAndError{response, err}
+	}()
+
+	select {
+	case re := <-ch:
+		if re.err != nil {
+			return nil, re.err
+		}
+		conn := <-connCh
+		body := &streamBody{
+			conn: conn,
+			body: re.resp.Body,
+			// Nothing to read, connection is already back in pool.
+			eof: re.resp.ContentLength == 0 || req.Method == "HEAD",
+		}
+		if options != nil {
+			body.timeout = options.ReadTimeout
+		}
+		body.stop = context.AfterFunc(ctx, func() { conn.Close() })
+		result := &StreamResult{
+			Url:        req.URL,
+			Method:     req.Method,
+			Status:     re.resp.Status,
+			StatusCode: re.resp.StatusCode,
+			Headers:    re.resp.Header,
+			Body:       body,
+		}
+		if options != nil {
+			result.Stat = options.Stat
+		}
+		return result, nil
+	case <-ctx.Done():
+		go func() {
+			// conn is nil if connection failed.
+			if conn := <-connCh; conn != nil {
+				conn.Close()
+			}
+			if re := <-ch; re.resp != nil {
+				re.resp.Body.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// exchange writes req to conn and reads response headers.
+func exchange(conn *PersistConn, req *http.Request, options *RequestOptions) (*http.Response, error) {
+	if err := conn.WriteRequest(req, options); err != nil {
+		return nil, err
+	}
+	return conn.ReadResponse(options)
+}
+
+// streamBody is StreamResult.Body.
+type streamBody struct {
+	conn    *PersistConn
+	body    io.ReadCloser
+	timeout time.Duration
+	stop    func() bool // stops closing conn on end of context
+	eof     bool
+	expired bool
+}
+
+var errReadBodyTimeout = &Error{str: "Read body timeout", timeout: true, temporary: true}
+
+func (b *streamBody) Read(p []byte) (n int, err error) {
+	if b.expired {
+		return 0, errReadBodyTimeout
+	}
+	if b.timeout == 0 {
+		return b.read(p)
+	}
+	timer := time.AfterFunc(b.timeout, func() { b.conn.Close() })
+	n, err = b.read(p)
+	if !timer.Stop() {
+		// Connection is closed, data read so far is still good.
+		b.expired = true
+		if err != nil && err != io.EOF {
+			err = errReadBodyTimeout
+		}
+	}
+	return n, err
+}
+
+func (b *streamBody) read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *streamBody) Close() error {
+	b.stop()
+	if !b.eof {
+		// Rest of body is not needed, closing is cheaper than reading it to reuse connection.
+		closeEarly(b.conn, b.body)
+		return nil
+	}
+	return b.body.Close()
+}
@@ -2,7 +2,7 @@
 // Differences:
 // * per-request timeouts on single socket operations
 // * method to abort a request (by closing its connection)
-// * proxy support is removed for simplicity
+// * only HTTP proxies are supported, other kinds are left to custom Dial
 //   (many required types/methods are not exported from net/http)
 // * transparent gzip decompression is removed for simplicity
 
@@ -19,7 +19,11 @@ package heroshi
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
+	"golang.org/x/net/http2"
 	"io"
 	"io/ioutil"
 	"log"
@@ -28,6 +32,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,21 +40,39 @@ import (
 // MaxIdleConnsPerHost.
 const DefaultMaxIdleConnsPerHost = 2
 
-// Transport is an implementation of RoundTripper that supports http and https.
-// Does not support proxies.
+// Transport is an implementation of RoundTripper that supports http and https
+// directly or via HTTP proxy.
 // Will cache connections for future re-use.
 type Transport struct {
 	lk       sync.Mutex
 	idleConn map[string][]*PersistConn
 
+	// Open connections by cache key, idle or not, for Stats.
+	// Taken after lk and PersistConn.lk, never before them.
+	openLk sync.Mutex
+	open   map[string]int
+
 	// TODO: tunable on global max cached connections
 	// TODO: tunable on timeout on cached connections
 	// TODO: optional pipelining
 
+	// Proxy specifies a function to return a proxy for a given
+	// Request. If the function returns a non-nil error, the
+	// request is aborted with the provided error.
+	// If Proxy is nil or returns a nil *URL, no proxy is used.
+	// Only http:// proxy URLs are supported.
+	Proxy func(*http.Request) (*url.URL, error)
+
 	// Dial specifies the dial function for creating TCP connections.
 	// If Dial is nil, net.Dial is used.
 	Dial func(net, addr string, opt *RequestOptions) (c net.Conn, err error)
 
+	// DialContext, if not nil, is used instead of Dial, e.g. to connect
+	// over unix socket or to in-memory pipe in tests. ctx is done after
+	// RequestOptions.ConnectTimeout. Returned connection gets the same
+	// timeouts and byte counting as TCP one.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// TLSClientConfig specifies the TLS configuration to use with
 	// tls.Client. If nil, the default configuration is used.
 	TLSClientConfig *tls.Config
@@ -58,29 +81,112 @@ type Transport struct {
 	// (keep-alive) to keep to keep per-host.  If zero,
 	// DefaultMaxIdleConnsPerHost is used.
 	MaxIdleConnsPerHost int
+
+	// MaxConnReuse, if non-zero, is number of requests after which
+	// connection is closed instead of kept for reuse.
+	MaxConnReuse uint
+
+	// HTTP2, if true, offers HTTP/2 to https servers via ALPN and uses it
+	// when server agrees. Otherwise and for plain http only HTTP/1.x is used.
+	// HTTP/2 connection still serves one request at a time.
+	HTTP2 bool
 }
 
 type RequestOptions struct {
-	ConnectTimeout   time.Duration
-	ReadTimeout      time.Duration
-	WriteTimeout     time.Duration
-	ReadLimit        uint64
+	// If not empty, host:port to connect to instead of address of request
+	// URL, like curl --connect-to. Host header and TLS server name still
+	// come from URL. Not used with HTTP proxy.
+	ConnectTo      string
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	ReadLimit      uint64
+	// Response header block, including status line, may be at most this
+	// many bytes and lines, otherwise ReadResponse fails with ErrHeaderBytes
+	// or ErrHeaderLines before body is read. 0 means no limit.
+	// HTTP/1 only, HTTP/2 headers are limited by ReadLimit.
+	MaxHeaderBytes   int64
+	MaxHeaderLines   int
 	KeepaliveTimeout time.Duration
 	Stat             *RequestStat
+	// Decode gzip, deflate and br response body in Fetch.
+	// This transport itself never decompresses.
+	Decompress bool
+	// If not empty, Fetch writes bodies larger than BodyInlineLimit bytes
+	// to temporary files in this directory instead of memory.
+	BodyDir         string
+	BodyInlineLimit int64
+	// Fetch reads only status and headers, FetchResult.Length is taken
+	// from Content-Length. Small body is still read to reuse connection.
+	SkipBody bool
+	// Fetch cuts response body at this size, see FetchResult.Truncated.
+	// Unlike ReadLimit, exceeding it is not an error. 0 means no limit.
+	MaxBodySize int64
+	// With Decompress, Fetch decodes gzip body of HTML or unknown type that
+	// was sent without Content-Encoding. Other types are never sniffed.
+	SniffGzip bool
+	// Fetch converts text body to UTF-8 according to charset in Content-Type
+	// or HTML <meta>, see FetchResult.Charset. Body must be decoded first.
+	TranscodeUTF8 bool
+	// Fetch sets FetchResult.ContentHash of decoded body, before transcoding.
+	HashBody bool
+	// If not nil, Fetch calls it with number of body bytes after each read
+	// from connection, it blocks to keep download rate. Error fails the fetch.
+	// Headers are not throttled.
+	Throttle func(n int) error
+	// Keep request and response header blocks in Stat.RawRequest and
+	// Stat.RawResponseHead, as sent and received for HTTP/1.
+	Dump bool
+	// If HTTP/1 response can't be parsed, e.g. HTTP/0.9 body without
+	// status line, return it as 200 response with all received bytes
+	// as body and FetchResult.Malformed instead of error. Limits
+	// of header size and timeouts still fail.
+	Lenient bool
+	// Fail response with body shorter than its Content-Length with
+	// ErrorKindTruncated. Otherwise it's FetchResult.Incomplete.
+	StrictLength bool
+	// If not zero, body of redirect response (3xx with Location header)
+	// is cut at this size, or MaxBodySize if that is smaller.
+	RedirectBodyLimit int64
+	// Fetch does not read body of response with Content-Type not in
+	// ContentTypes (if not empty) or in SkipContentTypes, see FetchResult.Skipped.
+	// Items are media types ("text/html") or prefixes ending with slash ("image/").
+	ContentTypes     []string
+	SkipContentTypes []string
 }
 
 type RequestStat struct {
+	Host           string // host:port of request URL
+	DialAddr       string // host:port connected to: Host, RequestOptions.ConnectTo or proxy
 	RemoteAddr     net.Addr
+	IPVersion      string // "ipv4" or "ipv6", family of RemoteAddr
 	Started        time.Time
 	ConnectionAge  time.Duration
 	ConnectionUse  uint
 	ConnectTime    time.Duration
+	Protocol       string    // "h2" or "http/1.1"
+	TLSVersion     string    // https only, tls.VersionName of negotiated version
+	TLSPeerSubject string    // https only, subject of server certificate
+	TLSCertExpires time.Time // https only, NotAfter of server certificate, even if not verified
 	WriteTime      time.Duration
 	ReadHeaderTime time.Duration
+	// Part of ConnectTime spent resolving host name, filled by custom Dial.
+	DNSTime time.Duration
+	// Bytes on the wire for this request and response, including headers
+	// and TLS records, excluding connection setup and TLS handshake.
+	BytesSent     int64
+	BytesReceived int64
+	// Time of HEAD (or ranged GET) probe before this request, filled by caller.
+	ProbeTime time.Duration
 	// These are not yet filled by this transport. But outer code
 	// may fill these fields to have all in one place.
 	ReadBodyTime time.Duration
 	TotalTime    time.Duration
+	// Bytes per second of body as received over ReadBodyTime, filled by Fetch.
+	ReadBodyRate int64
+	// Set with RequestOptions.Dump. HTTP/2 headers are given in HTTP/1 form.
+	RawRequest      []byte
+	RawResponseHead []byte
 }
 
 type Error struct {
@@ -147,15 +253,62 @@ func (t *Transport) CloseIdleConnections(force bool) {
 	if !force {
 		now = time.Now()
 	}
-	for _, conns := range t.idleConn {
+	for key, conns := range t.idleConn {
+		alive := conns[:0]
 		for _, pconn := range conns {
 			// Already closed (broken) will be closed again, assume that's not a problem.
 			if force || now.Sub(pconn.lastUsed) > pconn.idleTimeout {
 				pconn.Close()
+			} else {
+				alive = append(alive, pconn)
 			}
 		}
+		if len(alive) == 0 {
+			delete(t.idleConn, key)
+		} else {
+			t.idleConn[key] = alive
+		}
+	}
+}
+
+// Stats returns number of hosts with open connections, idle connections
+// in pool and connections in use.
+func (t *Transport) Stats() (hosts, idle, active int) {
+	t.lk.Lock()
+	for _, conns := range t.idleConn {
+		idle += len(conns)
+	}
+	t.lk.Unlock()
+	t.openLk.Lock()
+	hosts = len(t.open)
+	for _, n := range t.open {
+		active += n
+	}
+	t.openLk.Unlock()
+	// Connection is counted open before it's put to idle pool.
+	if active -= idle; active < 0 {
+		active = 0
+	}
+	return hosts, idle, active
+}
+
+// trackOpen counts pc until it is closed.
+func (t *Transport) trackOpen(pc *PersistConn) {
+	pc.transport = t
+	t.openLk.Lock()
+	if t.open == nil {
+		t.open = make(map[string]int)
+	}
+	t.open[pc.cacheKey]++
+	t.openLk.Unlock()
+}
+
+func (t *Transport) trackClosed(pc *PersistConn) {
+	t.openLk.Lock()
+	if t.open[pc.cacheKey]--; t.open[pc.cacheKey] <= 0 {
+		delete(t.open, pc.cacheKey)
 	}
-	t.idleConn = make(map[string][]*PersistConn)
+	t.openLk.Unlock()
 }
 
 //
@@ -167,6 +320,16 @@ func (t *Transport) ConnectMethodForRequest(req *http.Request) (*ConnectMethod,
 		targetScheme: req.URL.Scheme,
 		targetAddr:   canonicalAddr(req.URL),
 	}
+	if t.Proxy != nil {
+		var err error
+		cm.proxyURL, err = t.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if cm.proxyURL != nil && cm.proxyURL.Scheme != "http" {
+			return nil, &Error{str: "unsupported proxy scheme: " + cm.proxyURL.Scheme}
+		}
+	}
 	return cm, nil
 }
 
@@ -180,6 +343,14 @@ func (t *Transport) putIdleConn(pconn *PersistConn) bool {
 		return false
 	}
 	if pconn.isBroken() {
+		if pconn.h2 != nil {
+			// No readLoop to close it.
+			pconn.Close()
+		}
+		return false
+	}
+	if t.MaxConnReuse != 0 && pconn.useCount >= t.MaxConnReuse {
+		pconn.Close()
 		return false
 	}
 
@@ -229,7 +400,16 @@ func (t *Transport) getIdleConn(cm *ConnectMethod) (pconn *PersistConn) {
 }
 
 func (t *Transport) dial(network, addr string, opt *RequestOptions) (c net.Conn, err error) {
-	if t.Dial != nil {
+	started := time.Now()
+	if t.DialContext != nil {
+		ctx := context.Background()
+		if opt != nil && opt.ConnectTimeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opt.ConnectTimeout)
+			defer cancel()
+		}
+		c, err = t.DialContext(ctx, network, addr)
+	} else if t.Dial != nil {
 		c, err = t.Dial(network, addr, opt)
 	} else if opt != nil && opt.ConnectTimeout != 0 {
 		c, err = net.DialTimeout(network, addr, opt.ConnectTimeout)
@@ -240,17 +420,36 @@ func (t *Transport) dial(network, addr string, opt *RequestOptions) (c net.Conn,
 	// Custom Dial may have provide these values, do not overwrite.
 	if err == nil && opt != nil && opt.Stat != nil && opt.Stat.RemoteAddr == nil {
 		opt.Stat.RemoteAddr = c.RemoteAddr()
+		opt.Stat.IPVersion = ipVersion(opt.Stat.RemoteAddr)
 		opt.Stat.ConnectionAge = 0
 		opt.Stat.ConnectionUse = 1
 	}
+	if err == nil && opt != nil && opt.Stat != nil && opt.Stat.ConnectTime == 0 {
+		opt.Stat.ConnectTime = time.Now().Sub(started)
+	}
 	return
 }
 
+// ipVersion returns "ipv4" or "ipv6" for TCP address, empty string otherwise.
+func ipVersion(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if tcp.IP.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
 func (t *Transport) GetConnRequest(req *http.Request, opt *RequestOptions) (*PersistConn, error) {
 	cm, err := t.ConnectMethodForRequest(req)
 	if err != nil {
 		return nil, err
 	}
+	if opt != nil && cm.proxyURL == nil {
+		cm.connectTo = opt.ConnectTo
+	}
 	return t.GetConn(cm, opt)
 }
 
@@ -258,13 +457,19 @@ func (t *Transport) GetConnRequest(req *http.Request, opt *RequestOptions) (*Per
 // This includes setting up TLS.
 // If this doesn't return an error, the PersistConn is ready to write requests to.
 func (t *Transport) GetConn(cm *ConnectMethod, opt *RequestOptions) (*PersistConn, error) {
+	if opt != nil && opt.Stat != nil {
+		opt.Stat.Host = cm.targetAddr
+		opt.Stat.DialAddr = cm.addr()
+	}
 	if pc := t.getIdleConn(cm); pc != nil {
 		pc.useCount++
 		if opt != nil && opt.Stat != nil {
 			opt.Stat.RemoteAddr = pc.conn.RemoteAddr()
+			opt.Stat.IPVersion = ipVersion(opt.Stat.RemoteAddr)
 			opt.Stat.ConnectionAge = time.Now().Sub(pc.started)
 			opt.Stat.ConnectionUse = pc.useCount
 		}
+		pc.fillConnStat(opt)
 		return pc, nil
 	}
 
@@ -272,10 +477,14 @@ func (t *Transport) GetConn(cm *ConnectMethod, opt *RequestOptions) (*PersistCon
 	if err != nil {
 		return nil, err
 	}
+	// Wrap after Dial, so that custom Dial still gets *net.TCPConn.
+	counter := &countingConn{Conn: conn}
+	conn = counter
 
 	pconn := &PersistConn{
 		cacheKey:    cm.String(),
 		conn:        conn,
+		counter:     counter,
 		reqch:       make(chan requestAndOptions, 50),
 		rech:        make(chan responseAndError, 1),
 		started:     time.Now(),
@@ -286,25 +495,138 @@ func (t *Transport) GetConn(cm *ConnectMethod, opt *RequestOptions) (*PersistCon
 		pconn.idleTimeout = opt.KeepaliveTimeout
 	}
 
+	switch {
+	case cm.proxyURL == nil:
+		// Direct connection.
+	case cm.targetScheme == "http":
+		// Requests are sent to proxy with absolute URI.
+		pconn.isProxy = true
+		pconn.proxyAuth = proxyAuth(cm.proxyURL)
+	case cm.targetScheme == "https":
+		if err = connectTunnel(conn, cm, opt); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
 	if cm.targetScheme == "https" {
 		// Initiate TLS and check remote host name against certificate.
-		conn = tls.Client(conn, t.TLSClientConfig)
-		if err = conn.(*tls.Conn).Handshake(); err != nil {
+		var cfg *tls.Config
+		if t.TLSClientConfig != nil {
+			cfg = t.TLSClientConfig.Clone()
+		} else {
+			cfg = new(tls.Config)
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = cm.tlsHost()
+		}
+		if t.HTTP2 && len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+		tlsConn := tls.Client(conn, cfg)
+		// Handshake is part of connection establishment.
+		if opt != nil && opt.ConnectTimeout != 0 {
+			conn.SetDeadline(time.Now().Add(opt.ConnectTimeout))
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
 			return nil, err
 		}
-		if t.TLSClientConfig == nil || !t.TLSClientConfig.InsecureSkipVerify {
-			if err = conn.(*tls.Conn).VerifyHostname(cm.tlsHost()); err != nil {
+		conn.SetDeadline(time.Time{})
+		if !cfg.InsecureSkipVerify {
+			if err = tlsConn.VerifyHostname(cm.tlsHost()); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		state := tlsConn.ConnectionState()
+		pconn.tlsState = &state
+		pconn.conn = tlsConn
+		if state.NegotiatedProtocol == "h2" {
+			// Compression is left to caller, as with HTTP/1.
+			pconn.h2, err = (&http2.Transport{DisableCompression: true}).NewClientConn(tlsConn)
+			if err != nil {
+				conn.Close()
 				return nil, err
 			}
+			pconn.h2release = func() { t.putIdleConn(pconn) }
+			pconn.fillConnStat(opt)
+			t.trackOpen(pconn)
+			return pconn, nil
 		}
-		pconn.conn = conn
 	}
+	pconn.fillConnStat(opt)
 
 	pconn.bw = bufio.NewWriter(pconn.conn)
+	t.trackOpen(pconn)
 	go pconn.readLoop(func(pc *PersistConn) bool { return t.putIdleConn(pc) })
 	return pconn, nil
 }
 
+func (pc *PersistConn) fillConnStat(opt *RequestOptions) {
+	if opt == nil || opt.Stat == nil {
+		return
+	}
+	opt.Stat.Protocol = "http/1.1"
+	if pc.h2 != nil {
+		opt.Stat.Protocol = "h2"
+	}
+	if pc.tlsState == nil {
+		return
+	}
+	opt.Stat.TLSVersion = tls.VersionName(pc.tlsState.Version)
+	if len(pc.tlsState.PeerCertificates) != 0 {
+		opt.Stat.TLSPeerSubject = pc.tlsState.PeerCertificates[0].Subject.String()
+		opt.Stat.TLSCertExpires = pc.tlsState.PeerCertificates[0].NotAfter
+	}
+}
+
+// proxyAuth returns Proxy-Authorization header value for proxy URL userinfo.
+func proxyAuth(proxyURL *url.URL) string {
+	if proxyURL.User == nil {
+		return ""
+	}
+	password, _ := proxyURL.User.Password()
+	r := &http.Request{Header: make(http.Header)}
+	r.SetBasicAuth(proxyURL.User.Username(), password)
+	return r.Header.Get("Authorization")
+}
+
+// connectTunnel asks HTTP proxy on conn to connect to cm.targetAddr.
+// ConnectTimeout applies to the whole exchange.
+func connectTunnel(conn net.Conn, cm *ConnectMethod, opt *RequestOptions) error {
+	if opt != nil && opt.ConnectTimeout != 0 {
+		conn.SetDeadline(time.Now().Add(opt.ConnectTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: cm.targetAddr},
+		Host:   cm.targetAddr,
+		Header: make(http.Header),
+	}
+	if auth := proxyAuth(cm.proxyURL); auth != "" {
+		connectReq.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		return err
+	}
+
+	// Okay to use and discard buffered reader here, because
+	// TLS server will not speak until spoken to.
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return &Error{str: "proxy CONNECT: " + resp.Status}
+	}
+	return nil
+}
+
 // ConnectMethod is the map key (in its String form) for keeping persistent
 // TCP connections alive for subsequent HTTP requests.
 //
@@ -312,20 +634,34 @@ func (t *Transport) GetConn(cm *ConnectMethod, opt *RequestOptions) (*PersistCon
 //
 // Cache key form                Description
 // -----------------             -------------------------
-// http|foo.com                  http directly to server
-// https|foo.com                 https directly to server
+// |http|foo.com                 http directly to server
+// |https|foo.com                https directly to server
+// http://proxy.com|http|foo.com http to proxy, then to server
+// http://proxy.com|https|foo.com CONNECT tunnel via proxy, then https to server
 //
 type ConnectMethod struct {
-	targetScheme string // "http" or "https"
+	proxyURL     *url.URL // nil for no proxy
+	targetScheme string   // "http" or "https"
 	targetAddr   string
+	connectTo    string // dialed instead of targetAddr if not empty, only without proxy
 }
 
 func (cm *ConnectMethod) String() string {
-	return strings.Join([]string{cm.targetScheme, cm.targetAddr}, "|")
+	proxyStr := ""
+	if cm.proxyURL != nil {
+		proxyStr = cm.proxyURL.String()
+	}
+	return strings.Join([]string{proxyStr, cm.targetScheme, cm.targetAddr, cm.connectTo}, "|")
 }
 
 // addr returns the first hop "host:port" to which we need to TCP connect.
 func (cm *ConnectMethod) addr() string {
+	if cm.proxyURL != nil {
+		return canonicalAddr(cm.proxyURL)
+	}
+	if cm.connectTo != "" {
+		return cm.connectTo
+	}
 	return cm.targetAddr
 }
 
@@ -352,16 +688,50 @@ type PersistConn struct {
 	connectTime time.Duration
 	idleTimeout time.Duration
 	useCount    uint
+	isProxy     bool                 // requests are sent to HTTP proxy
+	proxyAuth   string               // Proxy-Authorization for isProxy requests
+	tlsState    *tls.ConnectionState // nil for plain HTTP
+	counter     *countingConn        // under TLS, if any
+	h2          *http2.ClientConn    // nil for HTTP/1, no readLoop otherwise
+	h2release   func()               // returns HTTP/2 connection to idle pool
+	transport   *Transport           // counts this connection open until closed
 
 	lk                   sync.Mutex // guards numExpectedResponses and broken
 	numExpectedResponses int
 	broken               bool // an error has happened on this connection; marked broken so it's not reused.
+	closed               bool
+}
+
+// ByteCount returns number of bytes sent and received on the wire through
+// this connection since it was established.
+func (pc *PersistConn) ByteCount() (sent, received int64) {
+	return atomic.LoadInt64(&pc.counter.sent), atomic.LoadInt64(&pc.counter.received)
+}
+
+// countingConn counts bytes passed through Read and Write.
+type countingConn struct {
+	net.Conn
+	sent     int64 // accessed atomically
+	received int64 // accessed atomically
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
 }
 
 func (pc *PersistConn) isBroken() bool {
 	pc.lk.Lock()
 	defer pc.lk.Unlock()
-	return pc.broken
+	// HTTP/2 connection may also be shut down by server with GOAWAY.
+	return pc.broken || (pc.h2 != nil && !pc.h2.CanTakeNewRequest())
 }
 
 var remoteSideClosedFunc func(error) bool // or nil to use default
@@ -382,7 +752,8 @@ func (pc *PersistConn) readLoop(putIdleConn func(*PersistConn) bool) {
 
 	for alive {
 		limitedReader := &io.LimitedReader{R: pc.conn, N: 1}
-		br := bufio.NewReader(limitedReader)
+		guard := &headerGuard{r: limitedReader}
+		br := bufio.NewReader(guard)
 
 		pb, err := br.Peek(1)
 
@@ -420,18 +791,47 @@ func (pc *PersistConn) readLoop(putIdleConn func(*PersistConn) bool) {
 		} else {
 			limitedReader.N = 1<<63 - 1
 		}
+		lenient := rc.opt != nil && rc.opt.Lenient
+		if rc.opt != nil {
+			guard.maxBytes, guard.maxLines = rc.opt.MaxHeaderBytes, rc.opt.MaxHeaderLines
+			// Peeked byte is the only one passed guard so far.
+			if lenient {
+				guard.kept = append(guard.kept, pb...)
+				guard.keep = true
+			}
+			if rc.opt.Dump && rc.opt.Stat != nil {
+				guard.head = append(guard.head, pb...)
+				guard.record = true
+			}
+		}
 
 		// Separate started variable because pc.lastUsed may be updated concurrently.
 		var started time.Time = time.Now()
 		pc.lastUsed = started
 
+		readResponse := func() (*http.Response, error) {
+			r, e := http.ReadResponse(br, rc.req)
+			if e != nil && guard.err != nil {
+				e = guard.err
+			}
+			if lenient {
+				guard.keep = false
+				if _, netErr := e.(net.Error); e != nil && guard.err == nil && !netErr && len(guard.kept) != 0 {
+					// Bytes buffered in br are in kept too, rest is read past it.
+					r, e = malformedResponse(rc.req, guard.kept, limitedReader, pc), nil
+					guard.head = nil
+				}
+				guard.kept = nil
+			}
+			return r, e
+		}
 		var resp *http.Response
 		if rc.opt == nil || rc.opt.ReadTimeout == 0 {
-			resp, err = http.ReadResponse(br, rc.req)
+			resp, err = readResponse()
 		} else {
 			ch := make(chan responseAndError, 0)
 			go func() {
-				r, e := http.ReadResponse(br, rc.req)
+				r, e := readResponse()
 				ch <- responseAndError{r, e}
 			}()
 			select {
@@ -444,6 +844,9 @@ func (pc *PersistConn) readLoop(putIdleConn func(*PersistConn) bool) {
 
 		if rc.opt != nil && rc.opt.Stat != nil {
 			rc.opt.Stat.ReadHeaderTime = time.Now().Sub(started)
+			if guard.record && err == nil {
+				rc.opt.Stat.RawResponseHead = guard.head
+			}
 		}
 
 		if err != nil {
@@ -462,12 +865,16 @@ func (pc *PersistConn) readLoop(putIdleConn func(*PersistConn) bool) {
 			if hasBody {
 				lastbody = resp.Body
 				waitForBodyRead = make(chan bool)
-				resp.Body.(*bodyEOFSignal).fn = func() {
+				es := resp.Body.(*bodyEOFSignal)
+				es.fn = func() {
 					if !putIdleConn(pc) {
 						alive = false
 					}
 					waitForBodyRead <- true
 				}
+				es.earlyCloseFn = func() {
+					waitForBodyRead <- false
+				}
 			} else {
 				// When there's no response body, we immediately
 				// reuse the TCP connection (putIdleConn), but
@@ -488,10 +895,111 @@ func (pc *PersistConn) readLoop(putIdleConn func(*PersistConn) bool) {
 
 		// Wait for the just-returned response body to be fully consumed
 		// before we race and peek on the underlying bufio reader.
-		if waitForBodyRead != nil {
-			<-waitForBodyRead
+		if waitForBodyRead != nil && !<-waitForBodyRead {
+			// Body was closed before EOF, rest of response is still unread.
+			alive = false
+			pc.Close()
+		}
+	}
+}
+
+var (
+	ErrHeaderBytes = &Error{str: "MaxHeaderBytes exceeded"}
+	ErrHeaderLines = &Error{str: "MaxHeaderLines exceeded"}
+)
+
+// headerGuard passes r through and fails with ErrHeaderBytes or
+// ErrHeaderLines if response header block, up to first empty line,
+// exceeds maxBytes or maxLines. Bytes after it are not counted.
+// Parser may see the cut line first and fail on it, so err tells
+// the reason of failure. With record, header block is kept in head.
+type headerGuard struct {
+	r        io.Reader
+	maxBytes int64
+	maxLines int
+	bytes    int64
+	lines    int
+	lineLen  int // bytes of current line except CR
+	done     bool
+	err      error
+	record   bool
+	head     []byte
+	keep     bool // keep all bytes read in kept, not only header block
+	kept     []byte
+}
+
+func (g *headerGuard) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if g.keep {
+		g.kept = append(g.kept, p[:n]...)
+	}
+	if g.done {
+		return n, err
+	}
+	for i, c := range p[:n] {
+		g.bytes++
+		if g.record {
+			g.head = append(g.head, c)
 		}
+		if c != '\n' {
+			if c != '\r' {
+				g.lineLen++
+			}
+		} else if g.lineLen == 0 {
+			g.done = true
+			return n, err
+		} else {
+			g.lines++
+			g.lineLen = 0
+		}
+		if g.maxBytes != 0 && g.bytes > g.maxBytes {
+			g.err = ErrHeaderBytes
+		} else if g.maxLines != 0 && g.lines > g.maxLines {
+			g.err = ErrHeaderLines
+		}
+		if g.err != nil {
+			return i, g.err
+		}
+	}
+	return n, err
+}
+
+// malformedBody is body of response made by malformedResponse,
+// closing it closes connection.
+type malformedBody struct {
+	io.Reader
+	conn io.Closer
+}
+
+func (b *malformedBody) Close() error {
+	return b.conn.Close()
+}
+
+// malformedResponse returns response to req that failed to parse: 200
+// status, no headers, raw bytes read so far and the rest of connection
+// as body. Connection is not reused.
+func malformedResponse(req *http.Request, raw []byte, rest io.Reader, conn io.Closer) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/0.9",
+		ProtoMinor:    9,
+		Header:        make(http.Header),
+		Body:          &malformedBody{Reader: io.MultiReader(bytes.NewReader(raw), rest), conn: conn},
+		ContentLength: -1,
+		Close:         true,
+		Request:       req,
+	}
+}
+
+// isMalformed tells if response was made by malformedResponse.
+func isMalformed(response *http.Response) bool {
+	es, ok := response.Body.(*bodyEOFSignal)
+	if !ok {
+		return false
 	}
+	_, ok = es.body.(*malformedBody)
+	return ok
 }
 
 type responseAndError struct {
@@ -508,40 +1016,144 @@ func (pc *PersistConn) WriteRequest(req *http.Request, opt *RequestOptions) (err
 	pc.lk.Lock()
 	pc.numExpectedResponses++
 	pc.lk.Unlock()
+	if pc.h2 != nil {
+		pc.writeRequestH2(req, opt)
+		return nil
+	}
 
 	// Separate started variable because pc.lastUsed may be updated concurrently.
 	var started time.Time = time.Now()
 	pc.lastUsed = started
 
+	write := req.Write
+	if pc.isProxy {
+		if pc.proxyAuth != "" && req.Header.Get("Proxy-Authorization") == "" {
+			// Don't modify caller's request.
+			r2 := *req
+			r2.Header = make(http.Header, len(req.Header)+1)
+			for k, v := range req.Header {
+				r2.Header[k] = v
+			}
+			r2.Header.Set("Proxy-Authorization", pc.proxyAuth)
+			req = &r2
+		}
+		write = req.WriteProxy
+	}
+
+	var dst io.Writer = pc.bw
+	var recorder *headRecorder
+	if opt != nil && opt.Dump && opt.Stat != nil {
+		recorder = &headRecorder{w: pc.bw}
+		dst = recorder
+	}
 	if opt == nil || opt.WriteTimeout == 0 {
-		err = req.Write(pc.bw)
+		err = write(dst)
+		if err == nil {
+			err = pc.bw.Flush()
+		}
 	} else {
-		ch := make(chan error, 0)
-		go func() {
-			ch <- req.Write(pc.bw)
-		}()
-		select {
-		case err = <-ch:
-		case <-time.After(opt.WriteTimeout):
+		// WriteTimeout limits stall, not whole upload: it restarts
+		// with every chunk written.
+		sw := &stallWriter{conn: pc.conn, timeout: opt.WriteTimeout}
+		pc.bw.Reset(sw)
+		err = write(dst)
+		if err == nil {
+			err = pc.bw.Flush()
+		}
+		pc.bw.Reset(pc.conn)
+		pc.conn.SetWriteDeadline(time.Time{})
+		var netErr net.Error
+		if err != nil && (sw.timedOut || errors.As(err, &netErr) && netErr.Timeout()) {
 			err = &Error{str: "WriteRequest timeout", timeout: true, temporary: true}
 		}
 	}
 	if opt != nil && opt.Stat != nil {
 		opt.Stat.WriteTime = time.Now().Sub(started)
 	}
+	if recorder != nil {
+		opt.Stat.RawRequest = recorder.head
+	}
 	if err != nil {
 		pc.Close()
 		return
 	}
-	pc.bw.Flush()
 
 	pc.reqch <- requestAndOptions{req, opt}
 
 	return err
 }
 
+// headRecorder passes writes to w and keeps bytes up to end of header block.
+type headRecorder struct {
+	w    io.Writer
+	head []byte
+	done bool
+}
+
+func (r *headRecorder) Write(p []byte) (int, error) {
+	if !r.done {
+		r.head = append(r.head, p...)
+		if i := bytes.Index(r.head, []byte("\r\n\r\n")); i != -1 {
+			r.head = r.head[:i+4]
+			r.done = true
+		}
+	}
+	return r.w.Write(p)
+}
+
+// Largest single write under stallWriter deadline.
+// Small enough to make progress on slow link within timeout.
+const stallWriteChunk = 4 << 10
+
+// stallWriter writes to conn in chunks, each with its own write deadline.
+type stallWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	// net/http may wrap write error while copying body, so
+	// timeout is detected here.
+	timedOut bool
+}
+
+func (w *stallWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > stallWriteChunk {
+			chunk = chunk[:stallWriteChunk]
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+		var written int
+		written, err = w.conn.Write(chunk)
+		n += written
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				w.timedOut = true
+			}
+			return n, err
+		}
+		p = p[written:]
+	}
+	return n, nil
+}
+
 func (pc *PersistConn) ReadResponse(options *RequestOptions) (resp *http.Response, err error) {
-	re := <-pc.rech
+	if pc.h2 != nil {
+		return pc.readResponseH2(options)
+	}
+	var re responseAndError
+	if options == nil || options.ReadTimeout == 0 {
+		re = <-pc.rech
+	} else {
+		// readLoop starts its timer at first byte of response,
+		// server which doesn't send anything is timed out here.
+		timer := time.NewTimer(options.ReadTimeout)
+		select {
+		case re = <-pc.rech:
+		case <-timer.C:
+			pc.Close()
+			re.err = &Error{str: "ReadResponse timeout", timeout: true, temporary: true}
+		}
+		timer.Stop()
+	}
 	pc.lk.Lock()
 	pc.numExpectedResponses--
 	pc.lk.Unlock()
@@ -556,6 +1168,10 @@ func (pc *PersistConn) Close() error {
 
 func (pc *PersistConn) closeLocked() error {
 	pc.broken = true
+	if !pc.closed && pc.transport != nil {
+		pc.transport.trackClosed(pc)
+	}
+	pc.closed = true
 	return pc.conn.Close()
 }
 
@@ -575,38 +1191,80 @@ func canonicalAddr(url *url.URL) string {
 
 // bodyEOFSignal wraps a ReadCloser but runs fn (if non-nil) at most
 // once, right before the final Read() or Close() call returns, but after
-// EOF has been seen.
+// EOF has been seen. If body is closed without EOF, earlyCloseFn runs
+// instead, see closeEarly.
 type bodyEOFSignal struct {
-	body     io.ReadCloser
-	fn       func()
-	isClosed bool
+	body         io.ReadCloser
+	mu           sync.Mutex // guards fields below, readLoop closes body too
+	fn           func()
+	earlyCloseFn func()
+	isClosed     bool
 }
 
 func (es *bodyEOFSignal) Read(p []byte) (n int, err error) {
 	n, err = es.body.Read(p)
-	if es.isClosed && n > 0 {
+	es.mu.Lock()
+	closed := es.isClosed
+	var fn func()
+	if err == io.EOF {
+		fn = es.fn
+		es.fn, es.earlyCloseFn = nil, nil
+	}
+	es.mu.Unlock()
+	if closed && n > 0 {
 		panic("http: unexpected bodyEOFSignal Read after Close; see issue 1725")
 	}
-	if err == io.EOF && es.fn != nil {
-		es.fn()
-		es.fn = nil
+	if fn != nil {
+		fn()
 	}
 	return
 }
 
 func (es *bodyEOFSignal) Close() (err error) {
+	es.mu.Lock()
 	if es.isClosed {
+		es.mu.Unlock()
 		return nil
 	}
 	es.isClosed = true
+	es.mu.Unlock()
 	err = es.body.Close()
-	if err == nil && es.fn != nil {
-		es.fn()
-		es.fn = nil
+	es.mu.Lock()
+	fn, earlyCloseFn := es.fn, es.earlyCloseFn
+	es.fn, es.earlyCloseFn = nil, nil
+	es.mu.Unlock()
+	if err == nil && fn != nil {
+		fn()
+	} else if err != nil && earlyCloseFn != nil {
+		// Rest of body is lost, connection can't be reused.
+		earlyCloseFn()
 	}
 	return
 }
 
+// closeEarly marks body closed without reading the rest of it, which
+// would block on connection being closed. readLoop is released to close
+// connection instead of waiting for EOF forever.
+func (es *bodyEOFSignal) closeEarly() {
+	es.mu.Lock()
+	earlyCloseFn := es.earlyCloseFn
+	es.isClosed = true
+	es.fn, es.earlyCloseFn = nil, nil
+	es.mu.Unlock()
+	if earlyCloseFn != nil {
+		earlyCloseFn()
+	}
+}
+
+// closeEarly closes conn whose response body is not read to the end.
+// Closing conn alone would leave its readLoop waiting for body EOF.
+func closeEarly(conn *PersistConn, body io.ReadCloser) {
+	if es, ok := body.(*bodyEOFSignal); ok {
+		es.closeEarly()
+	}
+	conn.Close()
+}
+
 type readFirstCloseBoth struct {
 	io.ReadCloser
 	io.Closer
@@ -3,11 +3,15 @@ package heroshi
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -97,6 +101,10 @@ func makeServe(connectionClose bool, processTime time.Duration, bodyLength int,
 			if err != nil {
 				t.Error("Write:", err.Error())
 			}
+			if connectionClose {
+				// Client may close connection as told, don't wait for next request.
+				return
+			}
 		}
 		t.Fatal("Too many requests on one connection")
 	}
@@ -400,3 +408,208 @@ func TestReadLimitFalseNegative(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxConnReuse(t *testing.T) {
+	var lk sync.Mutex
+	clients := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		clients[r.RemoteAddr] = true
+		lk.Unlock()
+	}))
+	defer server.Close()
+
+	transport := &Transport{MaxConnReuse: 2}
+	var uses []uint
+	for i := 0; i < 4; i++ {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		options := &RequestOptions{Stat: new(RequestStat)}
+		if result := Fetch(transport, request, options, time.Second); !result.Success {
+			t.Fatal("Fetch:", result.Status)
+		}
+		uses = append(uses, options.Stat.ConnectionUse)
+		// Connection returns to idle pool after response is read.
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fmt.Sprint(uses) != "[1 2 1 2]" || len(clients) != 2 {
+		t.Fatal("Expected new connection after 2 requests, got uses", uses, "connections", len(clients))
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	transport := &Transport{}
+	fetch := func() uint {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		options := &RequestOptions{Stat: new(RequestStat)}
+		if result := Fetch(transport, request, options, time.Second); !result.Success {
+			t.Fatal("Fetch:", result.Status)
+		}
+		// Connection returns to idle pool after response is read.
+		time.Sleep(10 * time.Millisecond)
+		return options.Stat.ConnectionUse
+	}
+	var uses []uint
+	uses = append(uses, fetch())
+	// Not idle longer than keepalive yet.
+	transport.CloseIdleConnections(false)
+	uses = append(uses, fetch())
+	transport.CloseIdleConnections(true)
+	uses = append(uses, fetch())
+	if fmt.Sprint(uses) != "[1 2 1]" {
+		t.Fatal("Expected new connection after forced close only, got uses", uses)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	fetch := func(transport *Transport, limit uint64) (*FetchResult, *RequestStat) {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		options := &RequestOptions{Stat: new(RequestStat), ReadLimit: limit}
+		return Fetch(transport, request, options, time.Second), options.Stat
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	transport := &Transport{HTTP2: true, TLSClientConfig: tlsConfig}
+	var uses []uint
+	for i := 0; i < 2; i++ {
+		result, stat := fetch(transport, 0)
+		if !result.Success || string(result.Body) != "HTTP/2.0" || stat.Protocol != "h2" {
+			t.Fatal("Expected HTTP/2, got:", result.Status, string(result.Body), stat.Protocol)
+		}
+		uses = append(uses, stat.ConnectionUse)
+	}
+	if fmt.Sprint(uses) != "[1 2]" {
+		t.Fatal("HTTP/2 connection is not reused:", uses)
+	}
+	if result, _ := fetch(transport, 4); result.Success {
+		t.Fatal("Expected ReadLimit error, got body:", string(result.Body))
+	}
+
+	result, stat := fetch(&Transport{TLSClientConfig: tlsConfig}, 0)
+	if !result.Success || string(result.Body) != "HTTP/1.1" || stat.Protocol != "http/1.1" {
+		t.Fatal("Expected HTTP/1.1, got:", result.Status, string(result.Body), stat.Protocol)
+	}
+}
+
+func TestWriteTimeoutProgress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 64<<10)
+		var n int64
+		for {
+			// Slow but steady reader.
+			time.Sleep(time.Millisecond)
+			m, err := r.Body.Read(buf)
+			n += int64(m)
+			if err != nil {
+				break
+			}
+		}
+		fmt.Fprint(w, n)
+	}))
+	defer server.Close()
+
+	const size = 32 << 20
+	const timeout = 100 * time.Millisecond
+	request, _ := http.NewRequest("POST", server.URL, bytes.NewReader(make([]byte, size)))
+	started := time.Now()
+	result := Fetch(&Transport{}, request, &RequestOptions{WriteTimeout: timeout}, 10*time.Second)
+	if !result.Success || string(result.Body) != fmt.Sprint(size) {
+		t.Fatal("Upload making progress timed out:", result.Status, string(result.Body))
+	}
+	if elapsed := time.Since(started); elapsed < timeout {
+		t.Log("Upload was too fast to check timeout:", elapsed)
+	}
+}
+
+func TestMaxHeader(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				w := bufio.NewWriter(conn)
+				w.WriteString("HTTP/1.1 200 OK\r\n")
+				// Endless junk, client must give up.
+				for i := 0; ; i++ {
+					if _, err := fmt.Fprintf(w, "X-Junk-%d: %s\r\n", i, strings.Repeat("j", 100)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	url := fmt.Sprintf("http://%s/", listener.Addr().String())
+	for _, c := range []struct {
+		options  *RequestOptions
+		expected error
+	}{
+		{&RequestOptions{MaxHeaderBytes: 64 << 10}, ErrHeaderBytes},
+		{&RequestOptions{MaxHeaderLines: 1000}, ErrHeaderLines},
+	} {
+		request, _ := http.NewRequest("GET", url, nil)
+		result := Fetch(&Transport{}, request, c.options, 5*time.Second)
+		if result.Success || result.Status != c.expected.Error() {
+			t.Fatal("Expected", c.expected, "got:", result.Status)
+		}
+	}
+
+	// Limits are per response, normal one passes.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	transport := &Transport{}
+	options := &RequestOptions{MaxHeaderBytes: 200, MaxHeaderLines: 5}
+	for i := 0; i < 3; i++ {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		if result := Fetch(transport, request, options, time.Second); !result.Success || string(result.Body) != "ok" {
+			t.Fatal("Expected ok within limits, got:", result.Status, string(result.Body))
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	var dialed string
+	var deadline bool
+	transport := &Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = network + " " + addr
+			_, deadline = ctx.Deadline()
+			client, server := net.Pipe()
+			go makeServe(true, 0, 5, nil)(t, server)
+			return client, nil
+		},
+	}
+	request, _ := http.NewRequest("GET", "http://in-memory/", nil)
+	options := &RequestOptions{ConnectTimeout: time.Second, Stat: new(RequestStat)}
+	result := Fetch(transport, request, options, time.Second)
+	if !result.Success || string(result.Body) != "xxxxx" {
+		t.Fatal("Expected body from pipe, got:", result.Status, string(result.Body))
+	}
+	if dialed != "tcp in-memory:80" || !deadline {
+		t.Fatal("Unexpected dial:", dialed, deadline)
+	}
+	if options.Stat.BytesReceived == 0 || options.Stat.BytesSent == 0 {
+		t.Fatal("Expected bytes counted on pipe, got:", options.Stat.BytesSent, options.Stat.BytesReceived)
+	}
+}
@@ -0,0 +1,88 @@
+package limitmap
+
+import (
+	"context"
+	"sync"
+)
+
+// One blocked Acquire of FIFO semaphore.
+type fifoWaiter struct {
+	n     uint
+	value uint          // counter value after grant
+	ready chan struct{} // closed when permits are granted
+}
+
+// NewFIFOSemaphore returns Semaphore which grants permits to blocked
+// Acquire, AcquireContext and AcquireN calls in order of arrival, so none
+// of them starves under contention. Waiter for several permits holds back
+// everyone after it. TryAcquire fails while anyone waits. Costs a channel
+// per blocked call, NewSemaphore doesn't.
+func NewFIFOSemaphore(max uint) *Semaphore {
+	return &Semaphore{
+		max:  max,
+		wait: sync.Cond{L: new(sync.Mutex)},
+		fifo: true,
+	}
+}
+
+// acquireFIFO waits in line for n permits until ctx is done. nil ctx waits forever.
+func (s *Semaphore) acquireFIFO(ctx context.Context, n uint) (uint, error) {
+	s.wait.L.Lock()
+	if s.waiters.Len() == 0 && s.value+n <= s.max {
+		s.value += n
+		value := s.value
+		s.wait.L.Unlock()
+		return value, nil
+	}
+	w := &fifoWaiter{n: n, ready: make(chan struct{})}
+	elem := s.waiters.PushBack(w)
+	s.wait.L.Unlock()
+
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	select {
+	case <-w.ready:
+		return w.value, nil
+	case <-done:
+	}
+
+	s.wait.L.Lock()
+	defer s.wait.L.Unlock()
+	select {
+	case <-w.ready:
+		// Granted meanwhile, give permits back to next in line.
+		s.value -= n
+	default:
+		s.waiters.Remove(elem)
+	}
+	// Waiters after this one may fit now.
+	s.grant()
+	return 0, ctx.Err()
+}
+
+// wakeup lets waiters check for free permits. Called with lock held.
+func (s *Semaphore) wakeup() {
+	if s.fifo {
+		s.grant()
+		return
+	}
+	// Waiters may want different number of permits, wake all to re-check.
+	s.wait.Broadcast()
+}
+
+// grant gives free permits to waiters from the front of line until first
+// one that doesn't fit. Called with lock held.
+func (s *Semaphore) grant() {
+	for elem := s.waiters.Front(); elem != nil; elem = s.waiters.Front() {
+		w := elem.Value.(*fifoWaiter)
+		if s.value+w.n > s.max {
+			return
+		}
+		s.value += w.n
+		w.value = s.value
+		s.waiters.Remove(elem)
+		close(w.ready)
+	}
+}
@@ -16,13 +16,16 @@
 package limitmap
 
 import (
+	"container/list"
+	"context"
 	"sync"
+	"time"
 )
 
 // Internal structure, may be changed.
 // Requirements for this data structure:
 // * Acquire() will not block until internal counter reaches set maximum number
-// * Release() will decrement internal counter and wake up one goroutine blocked on Acquire().
+// * Release() will decrement internal counter and wake up goroutines blocked on Acquire().
 //   Calling Release() when internal counter is zero is programming error, panic.
 type Semaphore struct {
 	// Number of Acquires - Releases. When this goes to zero, this structure is removed from map.
@@ -32,6 +35,11 @@ type Semaphore struct {
 	max   uint
 	value uint
 	wait  sync.Cond
+
+	// Set by NewFIFOSemaphore. Waiters are granted permits in order from
+	// waiters instead of racing on wait.
+	fifo    bool
+	waiters list.List // of *fifoWaiter
 }
 
 func NewSemaphore(max uint) *Semaphore {
@@ -42,6 +50,10 @@ func NewSemaphore(max uint) *Semaphore {
 }
 
 func (s *Semaphore) Acquire() uint {
+	if s.fifo {
+		value, _ := s.acquireFIFO(nil, 1)
+		return value
+	}
 	s.wait.L.Lock()
 	defer s.wait.L.Unlock()
 	for i := 0; ; i++ {
@@ -54,15 +66,114 @@ func (s *Semaphore) Acquire() uint {
 	panic("Unexpected branch")
 }
 
-func (s *Semaphore) Release() (result uint) {
+// AcquireContext is like Acquire but gives up waiting when ctx is done.
+// In that case it returns ctx.Err() and counter is not changed.
+func (s *Semaphore) AcquireContext(ctx context.Context) (uint, error) {
+	return s.acquireN(ctx, 1)
+}
+
+// TryAcquire takes permit only if it's free right now. Never blocks.
+// Returns new counter value and true on success, current value and false otherwise.
+func (s *Semaphore) TryAcquire() (uint, bool) {
 	s.wait.L.Lock()
 	defer s.wait.L.Unlock()
-	s.value--
-	if s.value < 0 {
+	// FIFO waiters are first in line.
+	if s.value+1 <= s.max && s.waiters.Len() == 0 {
+		s.value++
+		return s.value, true
+	}
+	return s.value, false
+}
+
+// AcquireN atomically takes n permits, blocking until value+n <= max.
+// Use it to weight expensive work. Release with ReleaseN(n).
+func (s *Semaphore) AcquireN(n uint) uint {
+	value, _ := s.acquireN(nil, n)
+	return value
+}
+
+// acquireN waits for n permits until ctx is done. nil ctx waits forever.
+func (s *Semaphore) acquireN(ctx context.Context, n uint) (uint, error) {
+	if n > s.max {
+		panic("Semaphore AcquireN: n > max would block forever")
+	}
+	if s.fifo {
+		return s.acquireFIFO(ctx, n)
+	}
+	s.wait.L.Lock()
+	defer s.wait.L.Unlock()
+	if s.value+n <= s.max {
+		s.value += n
+		return s.value, nil
+	}
+
+	if ctx != nil {
+		// sync.Cond can't wait on channel, so wake up all waiters on cancel
+		// and let them check their contexts.
+		stop := make(chan bool)
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.wait.L.Lock()
+				s.wait.Broadcast()
+				s.wait.L.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	for {
+		if s.value+n <= s.max {
+			s.value += n
+			return s.value, nil
+		}
+		if ctx != nil {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+		s.wait.Wait()
+	}
+}
+
+// Release returns permit taken by Acquire and returns new counter value.
+func (s *Semaphore) Release() uint {
+	s.wait.L.Lock()
+	defer s.wait.L.Unlock()
+	// value is unsigned, check before decrement or it wraps around.
+	if s.value == 0 {
 		panic("Semaphore Release without Acquire")
 	}
-	s.wait.Signal()
-	return
+	s.value--
+	s.wakeup()
+	return s.value
+}
+
+// ReleaseN returns n permits taken by AcquireN(n).
+func (s *Semaphore) ReleaseN(n uint) uint {
+	s.wait.L.Lock()
+	defer s.wait.L.Unlock()
+	if n > s.value {
+		panic("Semaphore ReleaseN without AcquireN")
+	}
+	s.value -= n
+	s.wakeup()
+	return s.value
+}
+
+// Available returns number of permits free right now.
+func (s *Semaphore) Available() uint {
+	s.wait.L.Lock()
+	defer s.wait.L.Unlock()
+	return s.max - s.value
+}
+
+// state returns counter value and max under lock.
+func (s *Semaphore) state() (value, max uint) {
+	s.wait.L.Lock()
+	defer s.wait.L.Unlock()
+	return s.value, s.max
 }
 
 type LimitMap struct {
@@ -88,11 +199,44 @@ func (m *LimitMap) Acquire(key string, max uint) {
 	m.lk.Unlock()
 
 	m.wg.Add(1)
-	if x := l.Acquire(); x < 0 || x > l.max {
+	if x := l.Acquire(); x == 0 || x > l.max {
 		panic("oia")
 	}
 }
 
+// AcquireContext is like Acquire but gives up waiting when ctx is done.
+// In that case it returns ctx.Err() and key is not acquired.
+func (m *LimitMap) AcquireContext(ctx context.Context, key string, max uint) error {
+	m.lk.Lock()
+	l, ok := m.limits[key]
+	if !ok {
+		l = NewSemaphore(max)
+		m.limits[key] = l
+	}
+	l.refs++
+	m.lk.Unlock()
+
+	if _, err := l.AcquireContext(ctx); err != nil {
+		m.lk.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.limits, key)
+		}
+		m.lk.Unlock()
+		return err
+	}
+	m.wg.Add(1)
+	return nil
+}
+
+// TryAcquire is like Acquire but gives up after timeout and returns false.
+// Zero timeout only takes free slot, never waits.
+func (m *LimitMap) TryAcquire(key string, max uint, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.AcquireContext(ctx, key, max) == nil
+}
+
 func (m *LimitMap) Release(key string) {
 	m.lk.Lock()
 	l, ok := m.limits[key]
@@ -108,7 +252,7 @@ func (m *LimitMap) Release(key string) {
 	}
 	m.lk.Unlock()
 
-	if x := l.Release(); x < 0 || x > l.max {
+	if x := l.Release(); x >= l.max {
 		panic("oir")
 	}
 	m.wg.Done()
@@ -119,6 +263,20 @@ func (m *LimitMap) Wait() {
 	m.wg.Wait()
 }
 
+// Available returns counter value and max of semaphore for key.
+// ok is false if key is not acquired by anyone.
+func (m *LimitMap) Available(key string) (value uint, max uint, ok bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	// Semaphore lock is always taken after m.lk or alone, never the other way.
+	l, ok := m.limits[key]
+	if !ok {
+		return 0, 0, false
+	}
+	value, max = l.state()
+	return value, max, true
+}
+
 func (m *LimitMap) Size() (keys int, total int) {
 	m.lk.Lock()
 	keys = len(m.limits)
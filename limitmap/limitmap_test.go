@@ -1,7 +1,12 @@
 package limitmap
 
 import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLimitMapRandom(t *testing.T) {
@@ -25,6 +30,121 @@ func TestLimitMapRandom(t *testing.T) {
 	}
 }
 
+func TestSemaphoreAcquireContext(t *testing.T) {
+	s := NewSemaphore(1)
+	s.Acquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.AcquireContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected DeadlineExceeded, got:", err)
+	}
+	if s.value != 1 {
+		t.Fatal("Cancelled AcquireContext changed value:", s.value)
+	}
+
+	// Plain waiter must still be woken up by Release.
+	done := make(chan bool)
+	go func() {
+		s.Acquire()
+		done <- true
+	}()
+	time.Sleep(5 * time.Millisecond)
+	s.Release()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Acquire after cancelled AcquireContext is stuck")
+	}
+}
+
+func TestLimitMapAcquireContext(t *testing.T) {
+	m := NewLimitMap()
+	m.Acquire("k", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		errCh <- m.AcquireContext(ctx, "k", 1)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatal("Expected Canceled, got:", err)
+	}
+
+	m.Release("k")
+	if keys, total := m.Size(); keys != 0 || total != 0 {
+		t.Fatal("Cancelled AcquireContext left key in map:", keys, total)
+	}
+	if err := m.AcquireContext(context.Background(), "k", 1); err != nil {
+		t.Fatal("AcquireContext:", err)
+	}
+	m.Release("k")
+}
+
+func TestLimitMapTryAcquire(t *testing.T) {
+	m := NewLimitMap()
+	if !m.TryAcquire("k", 1, 0) {
+		t.Fatal("TryAcquire failed on free key")
+	}
+	started := time.Now()
+	if m.TryAcquire("k", 1, 10*time.Millisecond) {
+		t.Fatal("TryAcquire succeeded on busy key")
+	}
+	if waited := time.Since(started); waited < 10*time.Millisecond {
+		t.Fatal("TryAcquire returned before timeout:", waited)
+	}
+	m.Release("k")
+	if keys, total := m.Size(); keys != 0 || total != 0 {
+		t.Fatal("Failed TryAcquire left key in map:", keys, total)
+	}
+	if !m.TryAcquire("k", 1, 0) {
+		t.Fatal("TryAcquire failed after Release")
+	}
+	m.Release("k")
+}
+
+// Weight 1 and weight 3 acquirers interleaved must never take more than max
+// permits and must all complete.
+func TestSemaphoreAcquireN(t *testing.T) {
+	const max = 4
+	s := NewSemaphore(max)
+	var inUse int32
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		n := uint(1)
+		if i%2 == 1 {
+			n = 3
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.AcquireN(n)
+			if x := atomic.AddInt32(&inUse, int32(n)); x > max {
+				t.Error("Over-subscription:", x)
+			}
+			time.Sleep(100 * time.Microsecond)
+			atomic.AddInt32(&inUse, -int32(n))
+			s.ReleaseN(n)
+		}()
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deadlock: weighted acquirers did not complete")
+	}
+	if s.value != 0 {
+		t.Fatal("value after all released:", s.value)
+	}
+}
+
 // See how it scales
 func BenchmarkSemaphoreBoth01(b *testing.B) {
 	b.StopTimer()
@@ -46,3 +166,278 @@ func BenchmarkSemaphoreBoth10(b *testing.B) {
 		}
 	}
 }
+
+func TestRateLimiter(t *testing.T) {
+	var l RateLimiter
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if err := l.Wait(ctx, 0); err != nil {
+			t.Fatal("Unlimited Wait:", err)
+		}
+	}
+
+	started := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(ctx, 100); err != nil {
+			t.Fatal("Wait:", err)
+		}
+	}
+	// First token is free, 4 more take 10ms each.
+	if elapsed := time.Since(started); elapsed < 40*time.Millisecond {
+		t.Fatal("Expected at least 40ms for 5 tokens at 100/s, got:", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 1); err != nil {
+		t.Fatal("Wait:", err)
+	}
+	if err := l.Wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatal("Expected DeadlineExceeded, got:", err)
+	}
+}
+
+func TestRateLimiterWaitN(t *testing.T) {
+	var l RateLimiter
+	ctx := context.Background()
+	started := time.Now()
+	// 100 tokens at 2000/s are 50ms for the next caller.
+	for _, n := range []int{100, 100, 1} {
+		if err := l.WaitN(ctx, n, 2000); err != nil {
+			t.Fatal("WaitN:", err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+		t.Fatal("Expected at least 100ms for 200 tokens at 2000/s, got:", elapsed)
+	}
+	if err := l.WaitN(ctx, 0, 2000); err != nil {
+		t.Fatal("Expected no wait for 0 tokens, got:", err)
+	}
+}
+
+func TestRateMapSweep(t *testing.T) {
+	m := NewRateMap()
+	ctx := context.Background()
+	for i := 0; i < minSweep; i++ {
+		m.Wait(ctx, fmt.Sprint("k", i), 1000)
+	}
+	time.Sleep(5 * time.Millisecond)
+	m.Wait(ctx, "new", 1000)
+	if size := m.Size(); size != 1 {
+		t.Fatal("Expected idle limiters removed, size:", size)
+	}
+}
+
+func TestSemaphoreTryAcquire(t *testing.T) {
+	s := NewSemaphore(2)
+	for i := uint(1); i <= 2; i++ {
+		if value, ok := s.TryAcquire(); !ok || value != i {
+			t.Fatal("Expected TryAcquire below max to succeed with", i, "got:", value, ok)
+		}
+	}
+	if value, ok := s.TryAcquire(); ok || value != 2 {
+		t.Fatal("Expected TryAcquire at max to fail, got:", value, ok)
+	}
+	s.Release()
+	if _, ok := s.TryAcquire(); !ok {
+		t.Fatal("Expected TryAcquire after Release to succeed")
+	}
+}
+
+func TestSemaphoreTryAcquireConcurrent(t *testing.T) {
+	const max = 3
+	s := NewSemaphore(max)
+	var active, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(try bool) {
+			defer wg.Done()
+			if try {
+				if _, ok := s.TryAcquire(); !ok {
+					return
+				}
+			} else {
+				s.Acquire()
+			}
+			n := atomic.AddInt32(&active, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			s.Release()
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	if peak > max {
+		t.Fatal("Expected at most", max, "holders, got:", peak)
+	}
+	if s.value != 0 {
+		t.Fatal("Expected all released, value:", s.value)
+	}
+}
+
+func TestSemaphoreReleaseWithoutAcquire(t *testing.T) {
+	s := NewSemaphore(2)
+	s.Acquire()
+	if value := s.Release(); value != 0 {
+		t.Fatal("Expected 0 after Release, got:", value)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected panic on Release without Acquire")
+		}
+		if s.value != 0 {
+			t.Fatal("Counter changed by bad Release:", s.value)
+		}
+	}()
+	s.Release()
+}
+
+func TestAvailable(t *testing.T) {
+	m := NewLimitMap()
+	if _, _, ok := m.Available("k"); ok {
+		t.Fatal("Expected absent key")
+	}
+	m.Acquire("k", 3)
+	m.Acquire("k", 3)
+	if value, max, ok := m.Available("k"); !ok || value != 2 || max != 3 {
+		t.Fatal("Expected 2 of 3, got:", value, max, ok)
+	}
+	m.Release("k")
+	m.Release("k")
+	if _, _, ok := m.Available("k"); ok {
+		t.Fatal("Expected key removed after last Release")
+	}
+
+	s := NewSemaphore(2)
+	s.Acquire()
+	if n := s.Available(); n != 1 {
+		t.Fatal("Expected 1 available, got:", n)
+	}
+}
+
+func TestAvailableConcurrent(t *testing.T) {
+	m := NewLimitMap()
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m.Acquire("k", 2)
+				m.Release("k")
+			}
+		}()
+	}
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if value, max, ok := m.Available("k"); ok && (value > max || max != 2) {
+			t.Fatal("Inconsistent state:", value, max)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// waitQueued waits until n Acquires are blocked on FIFO semaphore s.
+func waitQueued(t *testing.T, s *Semaphore, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.wait.L.Lock()
+		queued := s.waiters.Len()
+		s.wait.L.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected", n, "waiters, got:", queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFIFOSemaphore(t *testing.T) {
+	const N = 50
+	s := NewFIFOSemaphore(1)
+	s.Acquire()
+
+	granted := make(chan int, N)
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < N; i++ {
+		go func(i int) {
+			if i == 10 {
+				// Gives up in the middle of line.
+				if _, err := s.AcquireContext(ctx); err != nil {
+					granted <- -1
+					return
+				}
+			} else if i%2 == 0 {
+				s.Acquire()
+			} else {
+				s.AcquireN(1)
+			}
+			granted <- i
+			s.Release()
+		}(i)
+		// Make arrival order known.
+		waitQueued(t, s, i+1)
+	}
+	if _, ok := s.TryAcquire(); ok {
+		t.Fatal("TryAcquire must not overtake waiters")
+	}
+	cancel()
+	if i := <-granted; i != -1 {
+		t.Fatal("Expected cancelled waiter first, got:", i)
+	}
+
+	s.Release()
+	for want := 0; want < N; want++ {
+		if want == 10 {
+			continue
+		}
+		if i := <-granted; i != want {
+			t.Fatal("Expected waiter", want, "granted, got:", i)
+		}
+	}
+	if n := s.Available(); n != 1 {
+		t.Fatal("Expected permit free at the end, got:", n)
+	}
+}
+
+func TestFIFOSemaphoreAcquireN(t *testing.T) {
+	s := NewFIFOSemaphore(3)
+	s.AcquireN(2)
+	big := make(chan bool)
+	go func() {
+		s.AcquireN(3)
+		big <- true
+	}()
+	waitQueued(t, s, 1)
+	small := make(chan bool)
+	go func() {
+		s.Acquire()
+		small <- true
+	}()
+	waitQueued(t, s, 2)
+	// One permit is free, but the first waiter needs 3.
+	select {
+	case <-small:
+		t.Fatal("Small Acquire overtook AcquireN")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.ReleaseN(2)
+	<-big
+	s.ReleaseN(3)
+	<-small
+}
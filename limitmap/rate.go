@@ -0,0 +1,143 @@
+package limitmap
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket of one token: at most rate calls of Wait
+// return per second. Zero value is ready to use. Safe for concurrent use.
+//
+// Each Wait reserves next free slot before sleeping, so waiters are served
+// in order of arrival and nobody starves.
+type RateLimiter struct {
+	lk   sync.Mutex
+	next time.Time // when next token is available
+}
+
+// Wait blocks until token is available or ctx is done and returns ctx.Err()
+// in the latter case. rate is tokens per second, 0 or less means unlimited.
+// Rate may differ between calls, new interval applies from next reservation.
+func (l *RateLimiter) Wait(ctx context.Context, rate float64) error {
+	if rate <= 0 {
+		return ctx.Err()
+	}
+	return l.wait(ctx, l.reserve(1, rate))
+}
+
+// WaitN is Wait for n tokens at once, e.g. bytes under bandwidth limit.
+// Next caller waits for n tokens to pass, not this one: large n doesn't
+// delay the caller itself, but everyone after it.
+func (l *RateLimiter) WaitN(ctx context.Context, n int, rate float64) error {
+	if rate <= 0 || n <= 0 {
+		return ctx.Err()
+	}
+	return l.wait(ctx, l.reserve(n, rate))
+}
+
+// Reserved token, see RateLimiter.reserve.
+type reservation struct {
+	at, next time.Time
+}
+
+// reserve takes next free slot for n tokens and returns when it is.
+func (l *RateLimiter) reserve(n int, rate float64) reservation {
+	interval := time.Duration(float64(n) * float64(time.Second) / rate)
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	at := l.next
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(interval)
+	return reservation{at: at, next: l.next}
+}
+
+// wait sleeps until reserved slot.
+func (l *RateLimiter) wait(ctx context.Context, r reservation) error {
+	wait := time.Until(r.at)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give slot back if nobody reserved after us.
+		l.lk.Lock()
+		if l.next.Equal(r.next) {
+			l.next = r.at
+		}
+		l.lk.Unlock()
+		return ctx.Err()
+	}
+}
+
+// idle tells whether limiter has no reservations at now and may be forgotten.
+func (l *RateLimiter) idle(now time.Time) bool {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return !l.next.After(now)
+}
+
+// RateMap keeps RateLimiter for each key. Idle limiters are removed
+// from time to time, so map doesn't grow with every key ever seen.
+type RateMap struct {
+	lk      sync.Mutex
+	limits  map[string]*RateLimiter
+	sweepAt int
+}
+
+func NewRateMap() *RateMap {
+	return &RateMap{
+		limits:  make(map[string]*RateLimiter),
+		sweepAt: minSweep,
+	}
+}
+
+// Map size when idle limiters are removed first time.
+const minSweep = 1024
+
+// Wait is RateLimiter.Wait for key.
+func (m *RateMap) Wait(ctx context.Context, key string, rate float64) error {
+	if rate <= 0 {
+		return ctx.Err()
+	}
+	m.lk.Lock()
+	l, ok := m.limits[key]
+	if !ok {
+		if len(m.limits) >= m.sweepAt {
+			m.sweep(time.Now())
+		}
+		l = new(RateLimiter)
+		m.limits[key] = l
+	}
+	// Reserve under m.lk, otherwise sweep could forget l before that.
+	r := l.reserve(1, rate)
+	m.lk.Unlock()
+	return l.wait(ctx, r)
+}
+
+// sweep removes idle limiters. Called with m.lk held.
+// Next sweep happens when map doubles, so cost per Wait stays constant.
+func (m *RateMap) sweep(now time.Time) {
+	for key, l := range m.limits {
+		if l.idle(now) {
+			delete(m.limits, key)
+		}
+	}
+	m.sweepAt = 2 * len(m.limits)
+	if m.sweepAt < minSweep {
+		m.sweepAt = minSweep
+	}
+}
+
+// Size returns number of keys with limiters.
+func (m *RateMap) Size() int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return len(m.limits)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"net/url"
+	"sync"
+)
+
+// reorderBuffer restores input order of reports which complete in any order,
+// see -ordered. Every input gets index from Add and its report goes to Put,
+// or Skip if there will be none. Reports after missing one wait in memory,
+// at most window of them. When window is full, missing report is written as
+// timeout error in its place and the real one is dropped when it comes.
+//
+// So window size trades memory (window reports, with bodies) and output
+// latency behind one slow URL for fewer slow URLs reported as timed out.
+// It should be larger than -jobs, otherwise normal spread of fetch times
+// is enough to time out some. Safe for concurrent use.
+type reorderBuffer struct {
+	lk      sync.Mutex
+	write   func(report []byte) // called in input order under lk
+	window  int
+	last    uint64                  // index given by last Add
+	next    uint64                  // index of report to write next
+	waiting map[uint64][]byte       // reports after next
+	skipped map[uint64]bool         // inputs without report after next
+	pending map[uint64]reorderInput // inputs without report yet
+}
+
+// Input waiting for report, enough to write timeout report in its place.
+type reorderInput struct {
+	key string
+	url *url.URL
+}
+
+func newReorderBuffer(window int, write func(report []byte)) *reorderBuffer {
+	if window < 1 {
+		window = 1
+	}
+	return &reorderBuffer{
+		write:   write,
+		window:  window,
+		next:    1,
+		waiting: make(map[uint64][]byte),
+		skipped: make(map[uint64]bool),
+		pending: make(map[uint64]reorderInput),
+	}
+}
+
+// Add registers next input and returns its index. key and u describe
+// input in timeout report.
+func (b *reorderBuffer) Add(key string, u *url.URL) uint64 {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.last++
+	b.pending[b.last] = reorderInput{key, u}
+	return b.last
+}
+
+// Put writes report of input index and all following ones that are ready,
+// or keeps it until earlier reports are written. nil report means no report.
+func (b *reorderBuffer) Put(index uint64, report []byte) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if index < b.next {
+		// Already written as timeout.
+		return
+	}
+	delete(b.pending, index)
+	if report == nil {
+		b.skipped[index] = true
+	} else {
+		b.waiting[index] = report
+	}
+	b.flush()
+	for len(b.waiting) > b.window {
+		b.timeout()
+		b.flush()
+	}
+}
+
+// Skip tells that input index will have no report.
+func (b *reorderBuffer) Skip(index uint64) {
+	b.Put(index, nil)
+}
+
+// Close writes all waiting reports in order, missing ones are not waited for.
+func (b *reorderBuffer) Close() {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	for ; b.next <= b.last; b.next++ {
+		if report, ok := b.waiting[b.next]; ok {
+			b.write(report)
+		}
+	}
+	b.waiting = make(map[uint64][]byte)
+	b.skipped = make(map[uint64]bool)
+	b.pending = make(map[uint64]reorderInput)
+}
+
+// flush writes reports from next on until missing one.
+func (b *reorderBuffer) flush() {
+	for {
+		if report, ok := b.waiting[b.next]; ok {
+			delete(b.waiting, b.next)
+			b.write(report)
+		} else if b.skipped[b.next] {
+			delete(b.skipped, b.next)
+		} else {
+			return
+		}
+		b.next++
+	}
+}
+
+// timeout writes timeout report in place of next one.
+func (b *reorderBuffer) timeout() {
+	input := b.pending[b.next]
+	delete(b.pending, b.next)
+	if input.url == nil {
+		input.url = &url.URL{Host: input.key}
+	}
+	result := heroshi.ErrorKindResult(input.url, heroshi.ErrorKindTimeout, "Reorder window exceeded")
+	if report, _ := encodeResult(input.key, result); report != nil {
+		b.write(report)
+	}
+	b.next++
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+)
+
+// pauseGate holds dispatch of new URLs while paused, requests in progress
+// are not affected. See SIGUSR1 and SIGUSR2. Safe for concurrent use.
+type pauseGate struct {
+	lk      sync.Mutex
+	resumed chan bool // closed on Resume, nil when not paused
+}
+
+func (g *pauseGate) Pause() {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan bool)
+	}
+}
+
+func (g *pauseGate) Resume() {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+func (g *pauseGate) Paused() bool {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	return g.resumed != nil
+}
+
+// Wait returns when gate is not paused or cancel is closed.
+func (g *pauseGate) Wait(cancel <-chan bool) {
+	g.lk.Lock()
+	resumed := g.resumed
+	g.lk.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-cancel:
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/temoto/http-client.go/fetcher" // Temporary location
+	"sync"
+)
+
+// requestQueue is bounded priority queue of requests between input reader
+// and fetchers. Higher priority is popped first, equal priorities in order
+// of Push. Push blocks while queue is full, so input is not read ahead
+// further than queue size. Safe for concurrent use.
+type requestQueue struct {
+	lk      sync.Mutex
+	changed sync.Cond
+	items   queueHeap
+	max     int
+	seq     uint64
+	closed  bool // no more Push, Pop returns the rest
+	stopped bool // Pop returns nothing, Push drops
+	dropped int  // requests lost because of Stop
+	track   bool // see TrackDone
+	active  int  // popped and not Done yet, with track
+}
+
+type queueItem struct {
+	r        *fetcher.Request
+	priority int
+	seq      uint64
+	index    uint64 // input index for reorderBuffer
+}
+
+type queueHeap []queueItem
+
+func (h queueHeap) Len() int { return len(h) }
+func (h queueHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h queueHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *queueHeap) Push(x interface{}) { *h = append(*h, x.(queueItem)) }
+func (h *queueHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func newRequestQueue(max int) *requestQueue {
+	if max < 1 {
+		max = 1
+	}
+	q := &requestQueue{max: max}
+	q.changed.L = &q.lk
+	return q
+}
+
+// Push waits for free space and adds r, index is returned by Pop along with it.
+// Returns false if queue is stopped or closed.
+func (q *requestQueue) Push(r *fetcher.Request, priority int, index uint64) bool {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	for len(q.items) >= q.max && !q.stopped {
+		q.changed.Wait()
+	}
+	if q.stopped {
+		q.dropped++
+		return false
+	}
+	if q.closed {
+		return false
+	}
+	heap.Push(&q.items, queueItem{r: r, priority: priority, seq: q.seq, index: index})
+	q.seq++
+	q.changed.Broadcast()
+	return true
+}
+
+// Add adds r without waiting for free space and even after Close, for
+// requests found while processing popped ones, see TrackDone.
+// Returns false if queue is stopped.
+func (q *requestQueue) Add(r *fetcher.Request, priority int, index uint64) bool {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if q.stopped {
+		q.dropped++
+		return false
+	}
+	heap.Push(&q.items, queueItem{r: r, priority: priority, seq: q.seq, index: index})
+	q.seq++
+	q.changed.Broadcast()
+	return true
+}
+
+// Pop waits for request with highest priority and returns it with its index.
+// Returns false when queue is closed and empty or stopped.
+func (q *requestQueue) Pop() (*fetcher.Request, uint64, bool) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	for len(q.items) == 0 && !(q.closed && q.active == 0) && !q.stopped {
+		q.changed.Wait()
+	}
+	if q.stopped || len(q.items) == 0 {
+		return nil, 0, false
+	}
+	item := heap.Pop(&q.items).(queueItem)
+	if q.track {
+		q.active++
+	}
+	q.changed.Broadcast()
+	return item.r, item.index, true
+}
+
+// TrackDone makes queue count popped requests until Done, closed queue
+// is not over while any of them may Add more. Call before first Pop.
+func (q *requestQueue) TrackDone() {
+	q.lk.Lock()
+	q.track = true
+	q.lk.Unlock()
+}
+
+// Done tells that popped request is processed, see TrackDone.
+func (q *requestQueue) Done() {
+	q.lk.Lock()
+	q.active--
+	q.changed.Broadcast()
+	q.lk.Unlock()
+}
+
+func (q *requestQueue) Len() int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return len(q.items)
+}
+
+// Dropped returns number of requests pushed and never popped because of Stop.
+func (q *requestQueue) Dropped() int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.dropped
+}
+
+// Close tells that nothing more will be pushed. Pop returns remaining requests.
+func (q *requestQueue) Close() {
+	q.lk.Lock()
+	q.closed = true
+	q.changed.Broadcast()
+	q.lk.Unlock()
+}
+
+// Stop drops remaining requests and wakes everyone waiting.
+// Returns indices of dropped requests.
+func (q *requestQueue) Stop() []uint64 {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.stopped = true
+	q.dropped += len(q.items)
+	indices := make([]uint64, len(q.items))
+	for i, item := range q.items {
+		indices[i] = item.index
+	}
+	q.items = nil
+	q.changed.Broadcast()
+	return indices
+}
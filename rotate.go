@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rotatingWriter writes reports to results-NNNN.jsonl files in dir, starting
+// next file when current one would exceed maxSize bytes or is older than
+// interval. 0 disables either limit. Reports are never split between files,
+// report larger than maxSize gets a file of its own. Existing files are
+// not overwritten, numbering continues past them.
+type rotatingWriter struct {
+	dir      string
+	maxSize  int64
+	interval time.Duration
+
+	seq    int
+	f      *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+func newRotatingWriter(dir string, maxSize int64, interval time.Duration) (*rotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rw := &rotatingWriter{dir: dir, maxSize: maxSize, interval: interval}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Write writes whole report p to current file or to next one if rotation is due.
+func (rw *rotatingWriter) Write(p []byte) (int, error) {
+	if rw.size > 0 && (rw.maxSize > 0 && rw.size+int64(len(p)) > rw.maxSize ||
+		rw.interval > 0 && time.Since(rw.opened) >= rw.interval) {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.w.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *rotatingWriter) Flush() error {
+	return rw.w.Flush()
+}
+
+// Close flushes and closes current file.
+func (rw *rotatingWriter) Close() error {
+	err := rw.w.Flush()
+	if closeErr := rw.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (rw *rotatingWriter) rotate() error {
+	if err := rw.Close(); err != nil {
+		return err
+	}
+	return rw.open()
+}
+
+// open creates next file that doesn't exist yet.
+func (rw *rotatingWriter) open() error {
+	for {
+		rw.seq++
+		name := filepath.Join(rw.dir, fmt.Sprintf("results-%04d.jsonl", rw.seq))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rw.f = f
+		if rw.w == nil {
+			rw.w = bufio.NewWriter(f)
+		} else {
+			rw.w.Reset(f)
+		}
+		rw.size = 0
+		rw.opened = time.Now()
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency histogram has latencyBucketsPerDouble buckets between powers of two,
+// so percentile is off by at most 19%. Buckets up to 2^32 ms cover any timeout.
+const latencyBucketsPerDouble = 4
+const latencyBuckets = 32 * latencyBucketsPerDouble
+
+// runSummary counts results of whole run for -summary. Memory doesn't grow
+// with number of URLs: latencies go to fixed exponential histogram.
+// Safe for concurrent use.
+type runSummary struct {
+	lk       sync.Mutex
+	count    uint64
+	kinds    map[string]uint64 // ErrorKind, "ok" for success
+	latency  [latencyBuckets]uint64
+	max      uint // largest TotalTime, ms
+	received int64
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{kinds: make(map[string]uint64)}
+}
+
+func (s *runSummary) Add(result *heroshi.FetchResult) {
+	kind := result.ErrorKind
+	if kind == "" {
+		if result.Success {
+			kind = "ok"
+		} else {
+			kind = "error"
+		}
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.count++
+	s.kinds[kind]++
+	s.latency[latencyBucket(result.TotalTime)]++
+	if result.TotalTime > s.max {
+		s.max = result.TotalTime
+	}
+	if result.Stat != nil {
+		s.received += result.Stat.BytesReceived
+	}
+}
+
+// latencyBucket returns histogram index of ms milliseconds.
+func latencyBucket(ms uint) int {
+	i := int(math.Log2(float64(ms)+1) * latencyBucketsPerDouble)
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	return i
+}
+
+// percentile returns upper bound of bucket containing p (0..1) of latencies, in ms.
+// Callers hold lk.
+func (s *runSummary) percentile(p float64) uint {
+	target := uint64(math.Ceil(p * float64(s.count)))
+	var seen uint64
+	for i, n := range s.latency {
+		seen += n
+		if seen >= target && seen != 0 {
+			bound := uint(math.Exp2(float64(i+1)/latencyBucketsPerDouble) - 1)
+			if bound > s.max {
+				bound = s.max
+			}
+			return bound
+		}
+	}
+	return s.max
+}
+
+// Format returns one line summary of run which took elapsed.
+func (s *runSummary) Format(elapsed time.Duration) string {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	kinds := make([]string, 0, len(s.kinds))
+	for kind := range s.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for i, kind := range kinds {
+		kinds[i] = fmt.Sprintf("%s %d", kind, s.kinds[kind])
+	}
+	line := fmt.Sprintf("Summary: %d URLs", s.count)
+	if len(kinds) != 0 {
+		line += ", " + strings.Join(kinds, ", ")
+	}
+	if s.count != 0 {
+		line += fmt.Sprintf("; total_time p50 %dms p90 %dms p99 %dms",
+			s.percentile(0.5), s.percentile(0.9), s.percentile(0.99))
+	}
+	line += fmt.Sprintf("; received %d bytes", s.received)
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		line += fmt.Sprintf(", %.0f bytes/s", float64(s.received)/seconds)
+	}
+	return line
+}
@@ -3,118 +3,440 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
-	"github.com/temoto/http-client.go/heroshi" // Temporary location
+	"fmt"
+	"github.com/temoto/http-client.go/fetcher"  // Temporary location
+	"github.com/temoto/http-client.go/heroshi"  // Temporary location
+	"github.com/temoto/http-client.go/limitmap" // Temporary location
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"os/signal"
-	"runtime"
+	"regexp"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
-var urls chan *url.URL
+var urls *requestQueue
 var reports chan []byte
 
-func stdinReader(stop chan bool) {
-	defer func() { stop <- true }()
+// When true, reports are written in multipart format: JSON line with body_length
+// instead of content, followed by exactly body_length bytes of raw body.
+var rawBody bool
 
-	var line string
-	var u *url.URL
-	var err error
-	stdinReader := bufio.NewReader(os.Stdin)
-	for {
-		lineBytes, readErr := stdinReader.ReadBytes('\n')
-		if readErr != nil && readErr != io.EOF {
-			panic("At ReadBytes")
-			return
+// When true, reports are indented for humans, see -pretty.
+var prettyJson bool
+
+// With -ordered, reports go to reports in order of input through it. nil otherwise.
+var order *reorderBuffer
+
+// With -max-report-memory, bytes of reports between queueReport and reportWriter.
+// nil means unlimited.
+var reportMemory *limitmap.Semaphore
+var maxReportMemory uint
+
+// Structured input line, alternative to bare URL.
+// Body is base64 encoded so binary payloads survive JSON.
+// Large body is better given as path in BodyFile, it is streamed from disk.
+type inputLine struct {
+	Url      string            `json:"url"`
+	Method   string            `json:"method"`
+	Body     []byte            `json:"body"`
+	BodyFile string            `json:"body_file"`
+	Headers  map[string]string `json:"headers"`
+	// Relative Url is resolved against Base, absolute Url ignores it.
+	Base string `json:"base"`
+	// host:port to connect to instead of URL host, see Request.ConnectTo.
+	ConnectTo string `json:"connect_to"`
+
+	// Response checks, see Request.ExpectStatus.
+	ExpectStatus       int    `json:"expect_status"`
+	ExpectBodyContains string `json:"expect_body_contains"`
+
+	IfNoneMatch     string `json:"if_none_match"`
+	IfModifiedSince string `json:"if_modified_since"`
+
+	// Higher priority URLs are fetched first, default is 0.
+	Priority int `json:"priority"`
+}
+
+// parseLine accepts either a bare URL or a JSON object (see inputLine).
+// Returns request and its priority.
+func parseLine(line string) (*fetcher.Request, int, error) {
+	if line[0] != '{' {
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, 0, err
 		}
+		return &fetcher.Request{Url: u}, 0, nil
+	}
 
-		lineBytes = bytes.TrimSpace(lineBytes)
-		if len(lineBytes) == 0 {
-			goto Next
+	var input inputLine
+	if err := json.Unmarshal([]byte(line), &input); err != nil {
+		return nil, 0, err
+	}
+	u, err := url.Parse(input.Url)
+	if err != nil {
+		return nil, 0, err
+	}
+	if input.Base != "" {
+		base, err := url.Parse(input.Base)
+		if err != nil {
+			return nil, 0, err
+		}
+		u = base.ResolveReference(u)
+	}
+	r := &fetcher.Request{
+		Url:       u,
+		Method:    input.Method,
+		Body:      input.Body,
+		BodyFile:  input.BodyFile,
+		ConnectTo: input.ConnectTo,
+
+		IfNoneMatch:     input.IfNoneMatch,
+		IfModifiedSince: input.IfModifiedSince,
+
+		ExpectStatus:       input.ExpectStatus,
+		ExpectBodyContains: input.ExpectBodyContains,
+	}
+	if len(input.Headers) != 0 {
+		r.Header = make(http.Header, len(input.Headers))
+		for k, v := range input.Headers {
+			r.Header.Set(k, v)
 		}
-		line = string(lineBytes)
+	}
+	return r, input.Priority, nil
+}
 
-		u, err = url.Parse(line)
+// inputReader pushes requests from lines of input files to urls. "-" or
+// no inputs at all means stdin. If expand is not nil, requests it returns are
+// sent instead of each parsed one, with the same priority. If seen is not nil, repeated GET requests of
+// same normalized URL are reported as skipped instead of sent.
+// Input that can't be opened or read is reported as error, then next one is read.
+func inputReader(stop chan bool, inputs []string, expand func(*fetcher.Request) []*fetcher.Request, seen *urlSet) {
+	defer func() { stop <- true }()
+
+	send := func(r *fetcher.Request, priority int) {
+		index := addInput(r.Url.String(), r.Url)
+		if seen != nil && (r.Method == "" || r.Method == "GET") && len(r.Body) == 0 && r.BodyFile == "" {
+			key := fetcher.NormalizeURL(r.Url).String()
+			if !seen.Add(key) {
+				result := heroshi.ErrorKindResult(r.Url, heroshi.ErrorKindDuplicate, "Duplicate URL")
+				result.Skipped = true
+				result.SkipReason = "Duplicate of " + key
+				reportJson, _ := encodeResult(r.Url.String(), result)
+				sendReport(index, reportJson)
+				return
+			}
+		}
+		if !urls.Push(r, priority, index) {
+			sendReport(index, nil)
+		}
+	}
+	handleLine := func(line string) {
+		r, priority, err := parseLine(line)
 		if err != nil {
-			u = &url.URL{
+			u := &url.URL{
 				Host: line,
 			}
-			result := heroshi.ErrorResult(u, err.Error())
+			index := addInput(line, u)
+			result := heroshi.ErrorKindResult(u, heroshi.ErrorKindInvalidURL, err.Error())
 			reportJson, _ := encodeResult(line, result)
-			reports <- reportJson
+			sendReport(index, reportJson)
+		} else if expand != nil {
+			for _, r2 := range expand(r) {
+				send(r2, priority)
+			}
 		} else {
-			urls <- u
+			send(r, priority)
 		}
-
-	Next:
-		if readErr == io.EOF {
+	}
+	reportError := func(name string, err error) {
+		log.Printf("Input %s: %s\n", name, err.Error())
+		u := &url.URL{Path: name}
+		index := addInput(name, u)
+		result := heroshi.ErrorKindResult(u, heroshi.ErrorKindInput, "Input error: "+err.Error())
+		reportJson, _ := encodeResult(name, result)
+		sendReport(index, reportJson)
+	}
+	read := func(name string, r io.Reader) {
+		partial, err := readLines(r, handleLine)
+		if err == nil {
 			return
 		}
+		reportError(name, err)
+		if partial != "" {
+			// Line may be cut anywhere, don't guess what URL was meant.
+			u := &url.URL{Host: partial}
+			index := addInput(partial, u)
+			result := heroshi.ErrorKindResult(u, heroshi.ErrorKindInput, "Incomplete input line: "+err.Error())
+			reportJson, _ := encodeResult(partial, result)
+			sendReport(index, reportJson)
+		}
+	}
+
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	for _, name := range inputs {
+		if name == "-" {
+			read("stdin", os.Stdin)
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			reportError(name, err)
+			continue
+		}
+		read(name, f)
+		f.Close()
 	}
 }
 
-func encodeResult(key string, result *heroshi.FetchResult) (encoded []byte, err error) {
-	// Copy of FetchResult struct with new field Key and base64-encoded Body.
-	// This is ugly and violates DRY principle.
-	// But also, it allows to extract fetcher as separate package.
-	var report struct {
-		Key        string              `json:"key"`
-		Url        string              `json:"url"`
-		Success    bool                `json:"success"`
-		Status     string              `json:"status"`
-		StatusCode int                 `json:"status_code"`
-		Headers    map[string][]string `json:"headers,omitempty"`
-		Content    string              `json:"content,omitempty"`
-		Length     int64               `json:"length,omitempty"`
-		Cached     bool                `json:"cached"`
-		FetchTime  uint                `json:"fetch_time,omitempty"`
-		TotalTime  uint                `json:"total_time,omitempty"`
-		// new
-		RemoteAddr     string `json:"address,omitempty"`
-		Started        string `json:"started"`
-		ConnectionAge  uint   `json:"connection_age"`
-		ConnectionUse  uint   `json:"connection_use"`
-		ConnectTime    uint   `json:"connect_time"`
-		WriteTime      uint   `json:"write_time,omitempty"`
-		ReadHeaderTime uint   `json:"read_header_time,omitempty"`
-		ReadBodyTime   uint   `json:"read_body_time,omitempty"`
+// addInput returns index of next input for -ordered, see reorderBuffer.
+// Without -ordered it is always 0.
+func addInput(key string, u *url.URL) uint64 {
+	if order == nil {
+		return 0
+	}
+	return order.Add(key, u)
+}
+
+// sendReport passes report of input index to reportWriter, in input order
+// with -ordered. nil report tells that input has no report.
+func sendReport(index uint64, report []byte) {
+	if order != nil {
+		order.Put(index, report)
+	} else if report != nil {
+		queueReport(report)
+	}
+}
+
+// queueReport sends report to reportWriter, waiting for -max-report-memory
+// budget first, so fetching slows down to speed of writing.
+func queueReport(report []byte) {
+	if reportMemory != nil {
+		reportMemory.AcquireN(reportCost(report))
+	}
+	reports <- report
+}
+
+// reportCost is part of -max-report-memory taken by report. Report larger
+// than the whole budget takes all of it and waits to be written alone.
+func reportCost(report []byte) uint {
+	if n := uint(len(report)); n < maxReportMemory {
+		return n
+	}
+	return maxReportMemory
+}
+
+// readLines calls handle for each non-empty line of r with spaces trimmed.
+// Stops at first read error other than EOF and returns it along with
+// incomplete line read before error, if any.
+func readLines(r io.Reader, handle func(line string)) (partial string, err error) {
+	reader := bufio.NewReader(r)
+	for {
+		lineBytes, err := reader.ReadBytes('\n')
+		lineBytes = bytes.TrimSpace(lineBytes)
+		if err != nil && err != io.EOF {
+			return string(lineBytes), err
+		}
+		if len(lineBytes) != 0 {
+			handle(string(lineBytes))
+		}
+		if err == io.EOF {
+			return "", nil
+		}
 	}
+}
+
+// stringList is flag.Value collecting all values of repeated flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+type redirectReport struct {
+	Url        string   `json:"url"`
+	StatusCode int      `json:"status_code"`
+	Location   string   `json:"location,omitempty"`
+	SetCookie  []string `json:"set_cookie,omitempty"`
+}
+
+// Copy of FetchResult struct with new field Key and base64-encoded Body.
+// This is ugly and violates DRY principle.
+// But also, it allows to extract fetcher as separate package.
+type resultReport struct {
+	Key             string              `json:"key"`
+	Url             string              `json:"url"`
+	ErrorKind       string              `json:"error_kind,omitempty"`
+	RequestedUrl    string              `json:"requested_url,omitempty"`
+	FinalUrl        string              `json:"final_url,omitempty"`
+	RedirectChain   []redirectReport    `json:"redirect_chain,omitempty"`
+	Method          string              `json:"method,omitempty"`
+	Success         bool                `json:"success"`
+	Status          string              `json:"status"`
+	StatusCode      int                 `json:"status_code"`
+	Headers         map[string][]string `json:"headers,omitempty"`
+	RequestHeaders  map[string][]string `json:"request_headers,omitempty"`
+	Content         string              `json:"content,omitempty"`
+	BodyLength      *int                `json:"body_length,omitempty"`
+	BodyPath        string              `json:"body_path,omitempty"`
+	Truncated       bool                `json:"truncated,omitempty"`
+	Incomplete      bool                `json:"incomplete,omitempty"`
+	Skipped         bool                `json:"skipped,omitempty"`
+	SkipReason      string              `json:"skip_reason,omitempty"`
+	NotModified     bool                `json:"not_modified,omitempty"`
+	ETag            string              `json:"etag,omitempty"`
+	LastModified    string              `json:"last_modified,omitempty"`
+	Charset         string              `json:"charset,omitempty"`
+	TranscodeFailed bool                `json:"transcode_failed,omitempty"`
+	ContentHash     string              `json:"content_hash,omitempty"`
+	DuplicateOf     string              `json:"duplicate_of,omitempty"`
+	SniffedGzip     bool                `json:"sniffed_gzip,omitempty"`
+	Malformed       bool                `json:"malformed,omitempty"`
+	Length          int64               `json:"length,omitempty"`
+	EncodedLength   int64               `json:"encoded_length,omitempty"`
+	Cached          bool                `json:"cached"`
+	CookiesUsed     bool                `json:"cookies_used,omitempty"`
+	FetchTime       uint                `json:"fetch_time,omitempty"`
+	TotalTime       uint                `json:"total_time,omitempty"`
+	CrawlDelay      uint                `json:"crawl_delay,omitempty"`
+	RobotsRule      string              `json:"robots_rule,omitempty"`
+	RobotsStatus    string              `json:"robots_status,omitempty"`
+	ValidationError string              `json:"validation_error,omitempty"`
+	Depth           int                 `json:"depth,omitempty"`
+	// new
+	Host            string `json:"host,omitempty"`
+	DialAddr        string `json:"dial_addr,omitempty"`
+	RemoteAddr      string `json:"address,omitempty"`
+	IPVersion       string `json:"ip_version,omitempty"`
+	Started         string `json:"started"`
+	ConnectionAge   uint   `json:"connection_age"`
+	ConnectionUse   uint   `json:"connection_use"`
+	ConnectTime     uint   `json:"connect_time"`
+	DNSTime         uint   `json:"dns_time,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	TLSVersion      string `json:"tls_version,omitempty"`
+	TLSPeerSubject  string `json:"tls_peer_subject,omitempty"`
+	CertNotAfter    string `json:"cert_not_after,omitempty"`
+	CertExpiresSoon bool   `json:"cert_expires_soon,omitempty"`
+	WriteTime       uint   `json:"write_time,omitempty"`
+	ReadHeaderTime  uint   `json:"read_header_time,omitempty"`
+	ReadBodyTime    uint   `json:"read_body_time,omitempty"`
+	ReadBodyRate    int64  `json:"read_body_rate,omitempty"`
+	BytesSent       int64  `json:"bytes_sent,omitempty"`
+	BytesReceived   int64  `json:"bytes_received,omitempty"`
+	ProbeTime       uint   `json:"probe_time,omitempty"`
+	RawRequest      []byte `json:"raw_request,omitempty"`
+	RawResponseHead []byte `json:"raw_response_head,omitempty"`
+}
+
+func encodeResult(key string, result *heroshi.FetchResult) (encoded []byte, err error) {
+	var report resultReport
 	report.Key = key
 	report.Url = result.Url.String()
+	if result.RequestedUrl != nil {
+		report.RequestedUrl = result.RequestedUrl.String()
+	}
+	if result.FinalUrl != nil {
+		report.FinalUrl = result.FinalUrl.String()
+	}
+	for _, r := range result.RedirectChain {
+		report.RedirectChain = append(report.RedirectChain, redirectReport{r.Url.String(), r.StatusCode, r.Location, r.SetCookie})
+	}
+	report.Method = result.Method
+	report.ErrorKind = result.ErrorKind
 	report.Success = result.Success
 	report.Status = result.Status
 	report.StatusCode = result.StatusCode
 	report.Headers = result.Headers
+	report.RequestHeaders = redactHeaders(result.RequestHeaders)
 	report.Cached = result.Cached
+	report.CookiesUsed = result.CookiesUsed
 	report.FetchTime = result.FetchTime
 	report.TotalTime = result.TotalTime
-	contentEncoded := make([]byte, base64.StdEncoding.EncodedLen(len(result.Body)))
-	base64.StdEncoding.Encode(contentEncoded, result.Body)
-	report.Content = string(contentEncoded)
+	report.CrawlDelay = result.CrawlDelay
+	report.RobotsRule = result.RobotsRule
+	report.RobotsStatus = result.RobotsStatus
+	report.ValidationError = result.ValidationError
+	report.Depth = result.Depth
+	report.CertExpiresSoon = result.CertExpiresSoon
+	body := result.Body
+	if rawBody {
+		bodyLength := len(body)
+		report.BodyLength = &bodyLength
+	} else {
+		contentEncoded := make([]byte, base64.StdEncoding.EncodedLen(len(result.Body)))
+		base64.StdEncoding.Encode(contentEncoded, result.Body)
+		report.Content = string(contentEncoded)
+	}
+	report.BodyPath = result.BodyPath
+	report.Truncated = result.Truncated
+	report.Incomplete = result.Incomplete
+	report.Skipped = result.Skipped
+	report.SkipReason = result.SkipReason
+	report.NotModified = result.NotModified
+	report.ETag = result.ETag
+	report.LastModified = result.LastModified
+	report.Charset = result.Charset
+	report.TranscodeFailed = result.TranscodeFailed
+	report.ContentHash = result.ContentHash
+	report.DuplicateOf = result.DuplicateOf
+	report.SniffedGzip = result.SniffedGzip
+	report.Malformed = result.Malformed
 	report.Length = result.Length
+	report.EncodedLength = result.EncodedLength
 	// new
 	if result.Stat != nil {
+		report.Host = result.Stat.Host
+		report.DialAddr = result.Stat.DialAddr
 		if result.Stat.RemoteAddr != nil {
 			report.RemoteAddr = result.Stat.RemoteAddr.String()
 		}
+		report.IPVersion = result.Stat.IPVersion
 		report.Started = result.Stat.Started.UTC().Format(time.RFC3339)
 		report.ConnectionAge = uint(result.Stat.ConnectionAge / time.Millisecond)
 		report.ConnectionUse = result.Stat.ConnectionUse
 		report.ConnectTime = uint(result.Stat.ConnectTime / time.Millisecond)
+		report.DNSTime = uint(result.Stat.DNSTime / time.Millisecond)
+		report.Protocol = result.Stat.Protocol
+		report.TLSVersion = result.Stat.TLSVersion
+		report.TLSPeerSubject = result.Stat.TLSPeerSubject
+		if !result.Stat.TLSCertExpires.IsZero() {
+			report.CertNotAfter = result.Stat.TLSCertExpires.UTC().Format(time.RFC3339)
+		}
 		report.WriteTime = uint(result.Stat.WriteTime / time.Millisecond)
 		report.ReadHeaderTime = uint(result.Stat.ReadHeaderTime / time.Millisecond)
 		report.ReadBodyTime = uint(result.Stat.ReadBodyTime / time.Millisecond)
+		report.ReadBodyRate = result.Stat.ReadBodyRate
+		report.BytesSent = result.Stat.BytesSent
+		report.BytesReceived = result.Stat.BytesReceived
+		report.ProbeTime = uint(result.Stat.ProbeTime / time.Millisecond)
+		report.RawRequest = result.Stat.RawRequest
+		report.RawResponseHead = result.Stat.RawResponseHead
 	}
 
-	encoded, err = json.Marshal(report)
+	encoded, err = marshalReport(&report)
 	if err != nil {
 		encoded = nil
 		log.Printf("Url: %s, error encoding report: %s\n",
@@ -122,61 +444,479 @@ func encodeResult(key string, result *heroshi.FetchResult) (encoded []byte, err
 
 		// Most encoding errors happen in content. Try to recover.
 		report.Content = ""
+		if rawBody {
+			body = nil
+			bodyLength := 0
+			report.BodyLength = &bodyLength
+		}
 		report.Status = err.Error()
 		report.Success = false
 		report.StatusCode = 0
-		encoded, err = json.Marshal(report)
+		encoded, err = marshalReport(&report)
 		if err != nil {
 			encoded = nil
 			log.Printf("Url: %s, error encoding recovery report: %s\n",
 				result.Url, err.Error())
 		}
 	}
+	if encoded != nil {
+		// One report per line, written at once.
+		encoded = append(encoded, '\n')
+		if rawBody {
+			encoded = append(encoded, body...)
+		}
+	}
 	return
 }
 
-func reportWriter(done chan bool) {
-	for r := range reports {
-		if r != nil {
-			os.Stdout.Write(r)
-			os.Stdout.Write([]byte("\n"))
+// marshalReport encodes report in one line or indented with -pretty.
+func marshalReport(report *resultReport) ([]byte, error) {
+	if prettyJson {
+		return json.MarshalIndent(report, "", "  ")
+	}
+	return json.Marshal(report)
+}
+
+// Headers with credentials, their values are not shown in reports.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactHeaders returns copy of h with credential values replaced.
+func redactHeaders(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	redacted := make(http.Header, len(h))
+	for k, v := range h {
+		redacted[k] = v
+	}
+	for _, k := range secretHeaders {
+		if _, ok := redacted[k]; ok {
+			redacted[k] = []string{"<redacted>"}
 		}
 	}
-	done <- true
+	return redacted
+}
+
+// reportOutput is buffered stdout or rotatingWriter.
+type reportOutput interface {
+	io.Writer
+	Flush() error
+}
+
+// reportWriter writes reports to out and flushes it every
+// flushInterval. 0 flushes after each report.
+func reportWriter(out reportOutput, done chan bool, flushInterval time.Duration) {
+	var tick <-chan time.Time
+	if flushInterval > 0 {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case r, ok := <-reports:
+			if !ok {
+				out.Flush()
+				done <- true
+				return
+			}
+			if r != nil {
+				if _, err := out.Write(r); err != nil {
+					log.Println("Write report:", err.Error())
+				}
+				if reportMemory != nil {
+					// Written to buffer, report itself is free.
+					reportMemory.ReleaseN(reportCost(r))
+				}
+			}
+			if flushInterval <= 0 {
+				out.Flush()
+			}
+		case <-tick:
+			out.Flush()
+		}
+	}
+}
+
+// parseConnectTo parses HOST:PORT:CONNECT_HOST:CONNECT_PORT of -connect-to
+// into two host:port addresses. IPv6 addresses are in brackets.
+func parseConnectTo(s string) (from, to string, err error) {
+	var fields []string
+	brackets := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '[':
+			brackets = true
+		case c == ']':
+			brackets = false
+		case c == ':' && !brackets:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	fields = append(fields, s[start:])
+	if len(fields) != 4 {
+		return "", "", errors.New("expected HOST:PORT:CONNECT_HOST:CONNECT_PORT, got " + s)
+	}
+	for i := range fields {
+		fields[i] = strings.Trim(fields[i], "[]")
+		if fields[i] == "" {
+			return "", "", errors.New("empty field in " + s)
+		}
+	}
+	return net.JoinHostPort(fields[0], fields[1]), net.JoinHostPort(fields[2], fields[3]), nil
+}
+
+// parseHeader parses "Name: value" of -header into canonical name and value.
+func parseHeader(s string) (name, value string, err error) {
+	i := strings.IndexByte(s, ':')
+	if i == -1 {
+		return "", "", errors.New("expected Name: value, got " + s)
+	}
+	name = strings.TrimSpace(s[:i])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", errors.New("invalid header name in " + s)
+	}
+	return http.CanonicalHeaderKey(name), strings.TrimSpace(s[i+1:]), nil
+}
+
+// splitList returns non-empty items of comma separated list.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// compileRegex returns nil for empty expr.
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// urlFilter returns Worker.Allow that passes URLs matching allow (if not nil)
+// and not matching deny (if not nil).
+func urlFilter(allow, deny *regexp.Regexp) func(*url.URL) bool {
+	return func(u *url.URL) bool {
+		s := u.String()
+		return (allow == nil || allow.MatchString(s)) && (deny == nil || !deny.MatchString(s))
+	}
 }
 
 func main() {
-	worker := newWorker()
-	urls = make(chan *url.URL)
+	worker := fetcher.NewWorker()
 
 	// Process command line arguments.
 	var maxConcurrency uint
+	var queueSize int
+	var maxIdleConns int
+	var maxDNSConcurrency uint
+	var maxConns uint
+	var resolverAddr string
+	var http1Only bool
+	var checkRobotsOnly bool
+	var maxUrls uint64
+	var maxDuration time.Duration
+	var cacheSize int
+	var flushInterval time.Duration
+	var proxyAddr string
+	var seedSitemaps bool
+	var noDedup bool
+	var crawlLinks bool
+	var maxDepth int
+	var crawlAllow string
+	var metricsAddr string
+	var printSummary bool
+	var insecure bool
+	var caFile string
+	var certWarnDays uint
+	var drainTimeout time.Duration
+	var ordered bool
+	var reorderWindow int
+	var redirectCodes string
+	var outputDir string
+	var rotateSize int64
+	var rotateInterval time.Duration
+	var shareCookies bool
+	var inputs stringList
+	var connectTo stringList
+	var headers stringList
+	var outputFormat string
+	var contentTypes, skipContentTypes string
+	var allowRegex, denyRegex string
 	flag.UintVar(&maxConcurrency, "jobs", 1000, "Try to crawl this many URLs in parallel.")
-	flag.UintVar(&worker.HostConcurrency, "host-jobs", 1, "Per-host concurrency. RFC2616 tells it SHOULD NOT be > 2.")
+	flag.Uint64Var(&maxUrls, "max-urls", 0, "Stop reading input after this many URLs, finish requests in progress and exit. 0 means no limit.")
+	flag.DurationVar(&maxDuration, "max-duration", 0, "Stop reading input after this time, finish requests in progress and exit. 0 means no limit.")
+	flag.IntVar(&queueSize, "queue-size", 1000, "Read ahead this many input URLs to fetch ones with higher priority first.")
+	flag.UintVar(&worker.HostConcurrency, "host-jobs", 1, "Per-host concurrency. RFC2616 tells it SHOULD NOT be > 2. 0 means unlimited.")
+	flag.Float64Var(&worker.RateLimit, "rate", 0, "Start at most this many requests per second in total. 0 means unlimited.")
+	flag.Float64Var(&worker.MaxBandwidth, "max-bandwidth", 0, "Receive response bodies at most this many bytes per second in total. 0 means unlimited. "+
+		"Reported read_body_rate is bytes per second of each body.")
+	flag.Float64Var(&worker.HostRateLimit, "host-rate", 0, "Start at most this many requests per second to each host. 0 means unlimited.")
 	flag.UintVar(&worker.FollowRedirects, "redirects", 10, "How many redirects to follow. Can be 0.")
+	flag.StringVar(&redirectCodes, "redirect-codes", "301,302,303,307,308", "Comma separated status codes to follow Location of. Method and body are repeated for 307 and 308.")
+	flag.UintVar(&worker.BreakerThreshold, "breaker-threshold", 0, "After this many failures in a row from one host, report its URLs with error_kind circuit_open for -breaker-cooldown. 0 disables.")
+	flag.DurationVar(&worker.BreakerCooldown, "breaker-cooldown", 30*time.Second, "How long host stays blocked by -breaker-threshold before one URL is tried again.")
+	flag.UintVar(&worker.MaxPerHost, "max-per-host", 0, "Fetch at most this many URLs of each host, report others with error_kind host_limit. 0 means unlimited.")
+	flag.StringVar(&allowRegex, "allow-regex", "", "Fetch only URLs matching this regular expression, report others with error_kind filtered. Applies to redirects too.")
+	flag.StringVar(&denyRegex, "deny-regex", "", "Don't fetch URLs matching this regular expression, report them with error_kind filtered. Applies to redirects too.")
+	flag.Var(&inputs, "input", "Read URLs from this file, - means stdin. May be repeated. Positional arguments are inputs too.")
+	flag.StringVar(&outputFormat, "output-format", "json", "json: body is base64 in content field. multipart: JSON line with body_length field is followed by that many bytes of raw body.")
+	flag.StringVar(&outputDir, "output-dir", "", "Write reports to results-0001.jsonl and following files in this directory instead of stdout. See -rotate-size and -rotate-interval.")
+	flag.Int64Var(&rotateSize, "rotate-size", 0, "With -output-dir, start next file before it grows over this many bytes. 0 means no limit.")
+	flag.DurationVar(&rotateInterval, "rotate-interval", 0, "With -output-dir, start next file when current one is this old. 0 means no limit.")
+	flag.BoolVar(&ordered, "ordered", false, "Write reports in order of input instead of completion. See -reorder-window.")
+	flag.IntVar(&reorderWindow, "reorder-window", 10000, "With -ordered, keep at most this many reports in memory waiting for a slow earlier one, "+
+		"then report it as timeout. Larger window uses more memory and delays output more, should be larger than -jobs.")
+	flag.UintVar(&maxReportMemory, "max-report-memory", 0, "Keep at most this many bytes of reports waiting to be written, fetching waits when output falls behind. "+
+		"0 means unlimited: up to -jobs reports may wait, each with whole body. With -ordered, reports held by -reorder-window are not counted.")
+	flag.BoolVar(&prettyJson, "pretty", false, "Write indented multi-line JSON reports for reading by humans. Default is one report per line.")
+	flag.BoolVar(&shareCookies, "share-cookies", false, "Keep cookies for whole run. By default cookies live only through redirects of one URL.")
+	flag.BoolVar(&worker.ProbeFirst, "probe", false, "Send HEAD before GET and skip URL if its size exceeds -max-body or type doesn't pass -content-types and -skip-content-types.")
+	flag.BoolVar(&worker.SameHostRedirects, "same-host-redirects", false, "Don't follow redirects to other hosts or from https to http, report redirect response instead.")
+	flag.BoolVar(&checkRobotsOnly, "check-robots-only", false, "Don't fetch URLs, report whether robots.txt allows them along with deciding rule as robots_rule.")
 	flag.BoolVar(&worker.SkipRobots, "skip-robots", false, "Don't request and obey robots.txt.")
-	flag.BoolVar(&worker.SkipBody, "skip-body", false, "Don't return response body in results.")
-	flag.DurationVar(&worker.ConnectTimeout, "connect-timeout", 15*time.Second, "Timeout to query DNS and establish TCP connection.")
+	flag.DurationVar(&worker.MaxCrawlDelay, "max-crawl-delay", 30*time.Second, "Honor robots.txt Crawl-delay up to this value. 0 ignores Crawl-delay.")
+	flag.DurationVar(&worker.RobotsTTL, "robots-ttl", 10*time.Minute, "How long to cache robots.txt of each host.")
+	flag.StringVar(&worker.RobotsUnavailable, "robots-unavailable", fetcher.RobotsUnavailableDeny, "When robots.txt can't be fetched: "+
+		"deny - report URL as disallowed, error_kind is of robots.txt failure, robots_5xx for 5xx; allow - fetch URL as if robots.txt was empty; "+
+		"error - report robots.txt download error. robots_status is unavailable in all cases.")
+	flag.DurationVar(&worker.RobotsTimeout, "robots-timeout", 10*time.Second, "Timeout for robots.txt download, including its redirects. 0 means -total-timeout.")
+	flag.BoolVar(&worker.StrictLength, "strict-length", false, "Report body shorter than Content-Length as error_kind truncated. "+
+		"By default it's reported as incomplete with content received so far.")
+	flag.BoolVar(&worker.LenientParse, "lenient-parse", false, "Report HTTP/1 responses that can't be parsed, like HTTP/0.9 without status line, "+
+		"as status 200 with malformed and all received bytes as content instead of error.")
+	flag.BoolVar(&worker.Dump, "dump", false, "Report request and response headers as sent and received, base64 encoded in raw_request and raw_response_head.")
+	flag.BoolVar(&worker.SkipBody, "skip-body", false, "Don't download response body, only status and headers.")
+	flag.BoolVar(&worker.TranscodeUTF8, "transcode-utf8", false, "Convert text bodies to UTF-8 from charset of Content-Type or HTML meta tag, report it as charset.")
+	flag.BoolVar(&worker.SniffGzip, "sniff-gzip", false, "Decompress HTML or untyped body starting with gzip magic even without Content-Encoding, report it as sniffed_gzip.")
+	flag.BoolVar(&worker.HashBodies, "hash-bodies", false, "Report SHA-256 of decompressed body as content_hash, and first URL with the same body as duplicate_of.")
+	flag.BoolVar(&worker.NoDecompress, "no-decompress", false, "Don't ask for compressed response and return body as is.")
+	flag.DurationVar(&worker.ConnectTimeout, "connect-timeout", 15*time.Second, "Timeout to query DNS, establish TCP connection and TLS handshake.")
 	flag.DurationVar(&worker.FetchTimeout, "total-timeout", 60*time.Second, "Total timeout for crawling one URL. Includes all network IO, fetching and checking robots.txt.")
 	flag.DurationVar(&worker.IOTimeout, "io-timeout", 30*time.Second, "Timeout for sending request and receiving response (applied for each, so total time is twice this timeout).")
+	flag.DurationVar(&worker.ReadTimeout, "read-timeout", 0, "Timeout for receiving response. 0 means -io-timeout.")
+	flag.DurationVar(&worker.WriteTimeout, "write-timeout", 0, "Timeout for sending request. 0 means -io-timeout.")
+	flag.IntVar(&worker.TCP.Linger, "tcp-linger", 0, "Seconds to send unsent data after closing connection. 0 resets connection at once, -1 closes gracefully in background.")
+	flag.DurationVar(&worker.TCP.KeepAlivePeriod, "tcp-keepalive-period", 0, "Interval between TCP keep-alive probes. 0 means OS default, negative disables keep-alive.")
+	flag.BoolVar(&worker.TCP.NoDelay, "tcp-nodelay", true, "Disable Nagle's algorithm, send small writes at once.")
+	flag.UintVar(&maxConns, "max-conns", 0, "Keep at most this many connections open to all hosts together, idle ones included. "+
+		"New connections wait for free slot. 0 means unlimited.")
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 0, "Keep this many idle connections to each host for reuse. 0 means same as -host-jobs.")
+	flag.BoolVar(&http1Only, "http1-only", false, "Use only HTTP/1.1, don't negotiate HTTP/2 with https servers.")
+	flag.UintVar(&worker.Transport().MaxConnReuse, "max-conn-reuse", 0, "Close connection after this many requests instead of keeping it alive. 0 means unlimited.")
 	flag.DurationVar(&worker.KeepaliveTimeout, "keepalive-timeout", 120*time.Second, "Timeout for keeping persistent connections to servers since last operation.")
-	flag.Uint64Var(&worker.ReadLimit, "read-limit", DefaultReadLimit, "Limit size of response (including headers and body) in bytes.")
-	flag.StringVar(&worker.UserAgent, "user-agent", DefaultUserAgent, "User-Agent header. It is highly recommended to replace unknown_owner with your contact email.")
+	flag.DurationVar(&worker.ReapInterval, "reap-interval", 0, "How often to close connections idle longer than -keepalive-timeout. 0 means half of it, at least 1s.")
+	flag.Uint64Var(&worker.ReadLimit, "read-limit", fetcher.DefaultReadLimit, "Limit size of response (including headers and body) in bytes.")
+	flag.Int64Var(&worker.MaxHeaderBytes, "max-header-bytes", fetcher.DefaultMaxHeaderBytes, "Fail response with status line and headers larger than this many bytes. 0 means no limit.")
+	flag.IntVar(&worker.MaxHeaderLines, "max-header-lines", fetcher.DefaultMaxHeaderLines, "Fail response with more than this many lines of status and headers. 0 means no limit.")
+	flag.Int64Var(&worker.MaxBodySize, "max-body", 0, "Truncate response body at this size in bytes and report truncated=true. 0 means no limit.")
+	flag.Int64Var(&worker.RedirectBodyLimit, "redirect-body", 4096, "Truncate body of redirect responses at this size in bytes when following redirects. 0 means same as -max-body.")
+	flag.StringVar(&contentTypes, "content-types", "", "Comma separated list of media types (text/html) or prefixes (text/) to download body of. Empty allows all.")
+	flag.StringVar(&skipContentTypes, "skip-content-types", "", "Comma separated list of media types (video/mp4) or prefixes (video/) not to download body of.")
+	flag.StringVar(&worker.BodyDir, "body-dir", "", "Store response bodies larger than -body-inline-limit in files in this directory. Report has body_path instead of content.")
+	flag.Int64Var(&worker.BodyInlineLimit, "body-inline-limit", fetcher.DefaultBodyInlineLimit, "Bodies up to this size in bytes stay in report content when -body-dir is set.")
+	flag.Var(&headers, "header", "\"Name: value\" header to send with every request, like Accept-Language. May be repeated. "+
+		"User-Agent is the same as -user-agent. Overrides built-in Accept-Encoding, headers of input line override it.")
+	flag.StringVar(&worker.UserAgent, "user-agent", fetcher.DefaultUserAgent, "User-Agent header. It is highly recommended to replace unknown_owner with your contact email.")
+	flag.IntVar(&cacheSize, "cache-size", 0, "Keep this many results of GET requests in memory and reply from cache for repeated URLs. 0 disables cache.")
+	flag.DurationVar(&flushInterval, "flush-interval", 1*time.Second, "Flush buffered results to stdout or -output-dir this often. 0 flushes after each result.")
+	flag.StringVar(&worker.IPVersion, "ip-version", "any", "Connect to servers over ipv4, ipv6 or any. With any, both are tried in parallel.")
+	flag.DurationVar(&worker.DNSTTL, "dns-ttl", 0, "Cache resolved addresses of hosts for this long. 0 disables cache.")
+	flag.UintVar(&maxDNSConcurrency, "max-dns-concurrency", 0, "Resolve at most this many host names at once. 0 means unlimited.")
+	flag.StringVar(&resolverAddr, "resolver", "", "Send DNS queries to this server, udp://host[:port] or tcp://host[:port], instead of system resolver. "+
+		"Lookup time is reported as dns_time.")
+	flag.Var(&connectTo, "connect-to", "HOST:PORT:CONNECT_HOST:CONNECT_PORT: connect to CONNECT_HOST:CONNECT_PORT for URLs of HOST:PORT, "+
+		"keeping Host header and TLS server name, like curl --connect-to. May be repeated. Reported as host and dial_addr.")
+	flag.StringVar(&proxyAddr, "proxy", "", "Send all requests via proxy: http://[user:password@]host:port or socks5://[user:password@]host:port.")
+	flag.BoolVar(&insecure, "insecure", false, "Don't verify server certificates of https URLs.")
+	flag.UintVar(&certWarnDays, "cert-warn-days", 0, "Report cert_expires_soon for https URLs with server certificate expiring within this many days. 0 disables.")
+	flag.StringVar(&caFile, "ca-file", "", "Verify server certificates against CA certificates in this PEM file instead of system ones.")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 0, "After SIGINT wait this long for requests in progress, then abort them. 0 waits until second SIGINT.")
+	flag.BoolVar(&printSummary, "summary", false, "At the end print one line to stderr with counts by error_kind, total_time percentiles and bytes received.")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve metrics in Prometheus text format at http://<addr>/metrics, e.g. localhost:9100.")
+	flag.BoolVar(&noDedup, "no-dedup", false, "Fetch repeated URLs again. By default repeated GET of same normalized URL is reported as skipped.")
+	flag.BoolVar(&crawlLinks, "crawl", false, "Follow <a href> links of HTML pages to the same host, see -max-depth and -crawl-allow. Reports have depth of each URL.")
+	flag.IntVar(&maxDepth, "max-depth", 1, "With -crawl, follow links this many steps from input URLs.")
+	flag.StringVar(&crawlAllow, "crawl-allow", "", "With -crawl, follow links matching this regular expression instead of links to the same host.")
+	flag.BoolVar(&seedSitemaps, "seed-sitemaps", false, "Read hosts on stdin and fetch URLs listed in their sitemaps.")
 	showHelp := flag.Bool("help", false, "")
 	cpuprofile := flag.String("cpuprofile", "", "Write CPU profile to file")
 	memprofile := flag.String("memprofile", "", "Write memory profile to file")
 
 	flag.Parse()
+	inputs = append(inputs, flag.Args()...)
+	switch outputFormat {
+	case "json":
+	case "multipart":
+		rawBody = true
+		if prettyJson {
+			log.Println("-pretty is not supported with multipart output")
+			os.Exit(1)
+		}
+	default:
+		log.Println("Invalid output format:", outputFormat)
+		os.Exit(1)
+	}
+	for _, s := range headers {
+		name, value, err := parseHeader(s)
+		if err != nil {
+			log.Println("Invalid -header:", err.Error())
+			os.Exit(1)
+		}
+		if name == "User-Agent" {
+			// robots.txt agent is derived from it too.
+			worker.UserAgent = value
+			continue
+		}
+		if worker.DefaultHeaders == nil {
+			worker.DefaultHeaders = make(http.Header)
+		}
+		worker.DefaultHeaders.Add(name, value)
+	}
+	worker.SetUserAgent(worker.UserAgent)
+	if cacheSize > 0 {
+		worker.Cache = fetcher.NewLRUCache(cacheSize)
+	}
+	for _, item := range splitList(redirectCodes) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 300 || code > 399 {
+			log.Println("Invalid -redirect-codes item:", item)
+			os.Exit(1)
+		}
+		worker.RedirectCodes = append(worker.RedirectCodes, code)
+	}
+	if worker.RedirectCodes == nil {
+		// Empty list follows nothing.
+		worker.RedirectCodes = []int{}
+	}
+	worker.ContentTypes = splitList(contentTypes)
+	worker.SkipContentTypes = splitList(skipContentTypes)
+	worker.SetMaxIdleConns(maxIdleConns)
+	worker.SetMaxDNSConcurrency(maxDNSConcurrency)
+	worker.SetMaxConns(maxConns)
+	worker.Transport().HTTP2 = !http1Only
+	worker.CertWarnWindow = time.Duration(certWarnDays) * 24 * time.Hour
+	if shareCookies {
+		worker.CookieJar, _ = cookiejar.New(nil)
+	}
+	if insecure || caFile != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+		if caFile != "" {
+			pem, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				log.Println("Read CA file:", err.Error())
+				os.Exit(1)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				log.Println("No certificates in CA file:", caFile)
+				os.Exit(1)
+			}
+		}
+		worker.SetTLSConfig(tlsConfig)
+	}
+	if resolverAddr != "" {
+		resolver, err := fetcher.NewResolver(resolverAddr)
+		if err != nil {
+			log.Println("Invalid -resolver:", err.Error())
+			os.Exit(1)
+		}
+		worker.Resolver = resolver
+	}
+	if proxyAddr != "" {
+		proxyUrl, err := url.Parse(proxyAddr)
+		if err == nil {
+			err = worker.SetProxy(proxyUrl)
+		}
+		if err != nil {
+			log.Println("Invalid proxy:", err.Error())
+			os.Exit(1)
+		}
+	}
+	for _, s := range connectTo {
+		from, to, err := parseConnectTo(s)
+		if err != nil {
+			log.Println("Invalid -connect-to:", err.Error())
+			os.Exit(1)
+		}
+		if worker.ConnectTo == nil {
+			worker.ConnectTo = make(map[string]string)
+		}
+		worker.ConnectTo[from] = to
+	}
+	var crawl *crawler
+	if crawlLinks {
+		allow, err := compileRegex(crawlAllow)
+		if err != nil {
+			log.Println("Invalid -crawl-allow:", err.Error())
+			os.Exit(1)
+		}
+		crawl = &crawler{maxDepth: maxDepth, allow: allow, seen: newURLSet()}
+	}
+	if allowRegex != "" || denyRegex != "" {
+		allow, err := compileRegex(allowRegex)
+		if err == nil {
+			var deny *regexp.Regexp
+			if deny, err = compileRegex(denyRegex); err == nil {
+				worker.Allow = urlFilter(allow, deny)
+			}
+		}
+		if err != nil {
+			log.Println("Invalid URL filter:", err.Error())
+			os.Exit(1)
+		}
+	}
+	switch worker.IPVersion {
+	case "any":
+		worker.IPVersion = ""
+	case "ipv4", "ipv6":
+	default:
+		log.Println("Invalid -ip-version:", worker.IPVersion)
+		os.Exit(1)
+	}
+	switch worker.RobotsUnavailable {
+	case fetcher.RobotsUnavailableDeny, fetcher.RobotsUnavailableAllow, fetcher.RobotsUnavailableError:
+	default:
+		log.Println("Invalid -robots-unavailable:", worker.RobotsUnavailable)
+		os.Exit(1)
+	}
 	if maxConcurrency <= 0 {
 		log.Println("Invalid concurrency limit:", maxConcurrency)
 		os.Exit(1)
 	}
 	if *showHelp {
 		os.Stderr.WriteString(`HTTP client.
-Reads URLs on stdin, fetches them and writes results as JSON on stdout.
+Reads URLs from files given as arguments or -input flags or stdin
+(also named -), fetches them and writes results as JSON on stdout.
+Input line is either a URL or a JSON object:
+  {"url": "http://...", "method": "POST", "body": "<base64>", "headers": {"Name": "value"}}
+Instead of "body", "body_file": "/path" streams request body from file.
+"connect_to": "host:port" connects there instead of URL host, see -connect-to.
+"base": "http://host/dir/" resolves relative "url" against it.
+With "expect_status" (integer) and/or "expect_body_contains" (text) response
+not meeting them is reported with error_kind validation and validation_error.
+For conditional request add "if_none_match" and/or "if_modified_since"
+with etag and last_modified of previous result. Lines with higher "priority"
+(integer, default 0) are fetched first among next -queue-size input lines.
+Reports are written as requests complete, with -ordered in order of input,
+to stdout or with -output-dir to rotated files.
+
+With -seed-sitemaps input lines are hosts, URLs from their sitemaps are fetched.
+With -crawl links of fetched HTML pages are fetched too, each new URL once.
+
+SIGUSR1 pauses taking new URLs, requests in progress complete. SIGUSR2 resumes.
 
-Follows up to 10 redirects.
-Fetches /robots.txt first and obeys rules there using first word of User-Agent to test against rules.
+Follows up to 10 redirects, see -redirects and -redirect-codes.
+Fetches /robots.txt first and obeys rules there using product token of User-Agent (before slash) to test against rules.
+Status 4xx of robots.txt allows everything. Network error or 5xx makes robots.txt unavailable, see -robots-unavailable.
 
 Try 'echo http://localhost/ |http-client' to see sample of result JSON.
 
@@ -211,70 +951,224 @@ Run 'http-client -h' for flags description.
 		defer f.Close()
 	}
 
+	var out reportOutput = bufio.NewWriter(os.Stdout)
+	var rotating *rotatingWriter
+	if outputDir != "" {
+		var err error
+		if rotating, err = newRotatingWriter(outputDir, rotateSize, rotateInterval); err != nil {
+			log.Println("Output dir:", err.Error())
+			os.Exit(1)
+		}
+		out = rotating
+	}
 	reports = make(chan []byte, maxConcurrency)
+	if maxReportMemory > 0 {
+		reportMemory = limitmap.NewSemaphore(maxReportMemory)
+	}
+	if ordered {
+		order = newReorderBuffer(reorderWindow, queueReport)
+	}
 	stop := make(chan bool)
 	doneWriting := make(chan bool)
 
 	sigIntChan := make(chan os.Signal, 1)
 	signal.Notify(sigIntChan, syscall.SIGINT)
+	// First SIGINT, -max-duration or -max-urls stops reading input,
+	// second SIGINT or drain timeout aborts requests in progress.
+	interrupted := make(chan bool)
+	finish := make(chan string, 1) // reason to stop reading input
+	if maxDuration > 0 {
+		time.AfterFunc(maxDuration, func() {
+			select {
+			case finish <- "Max duration reached":
+			default:
+			}
+		})
+	}
 	go func() {
-		<-sigIntChan
+		select {
+		case <-sigIntChan:
+		case reason := <-finish:
+			log.Println(reason + ".")
+		}
 		log.Println("Waiting for remaining requests to complete.")
-		stop <- true
+		close(interrupted)
+
+		var deadline <-chan time.Time
+		if drainTimeout > 0 {
+			deadline = time.After(drainTimeout)
+		}
+		select {
+		case <-sigIntChan:
+			log.Println("Interrupted again, aborting remaining requests.")
+		case <-deadline:
+			log.Println("Drain timeout, aborting remaining requests.")
+		}
+		worker.Abort()
+	}()
+
+	// SIGUSR1 pauses taking new URLs from queue, SIGUSR2 resumes.
+	pause := &pauseGate{}
+	sigPauseChan := make(chan os.Signal, 1)
+	signal.Notify(sigPauseChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigPauseChan {
+			if sig == syscall.SIGUSR1 {
+				pause.Pause()
+				log.Println("Paused, requests in progress continue. Send SIGUSR2 to resume.")
+			} else {
+				pause.Resume()
+				log.Println("Resumed.")
+			}
+		}
 	}()
 
-	go stdinReader(stop)
-	go reportWriter(doneWriting)
+	var expand func(*fetcher.Request) []*fetcher.Request
+	if seedSitemaps {
+		expand = func(r *fetcher.Request) []*fetcher.Request {
+			host := r.Url
+			if host.Host == "" {
+				// Bare host name.
+				host = &url.URL{Scheme: "http", Host: host.Path}
+			}
+			var seeds []*fetcher.Request
+			for _, u := range worker.SitemapSeed(host) {
+				seeds = append(seeds, &fetcher.Request{Url: u})
+			}
+			return seeds
+		}
+	}
+	var metricsServer *http.Server
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+			worker.ServeMetrics(rw, req)
+			paused := 0
+			if pause.Paused() {
+				paused = 1
+			}
+			fmt.Fprintf(rw, "# HELP heroshi_paused 1 while paused by SIGUSR1.\n# TYPE heroshi_paused gauge\nheroshi_paused %d\n", paused)
+		})
+		metricsServer = &http.Server{Addr: metricsAddr, Handler: mux}
+		listener, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			log.Println("Metrics listen:", err.Error())
+			os.Exit(1)
+		}
+		go metricsServer.Serve(listener)
+	}
+
+	urls = newRequestQueue(queueSize)
+	var seen *urlSet
+	if !noDedup {
+		seen = newURLSet()
+	}
+	if crawl != nil {
+		urls.TrackDone()
+		if seen != nil {
+			// Input URLs are not fetched again as links.
+			crawl.seen = seen
+		}
+	}
+	go func() {
+		<-stop
+		urls.Close()
+	}()
+	stopped := make(chan bool)
+	go func() {
+		<-interrupted
+		for _, index := range urls.Stop() {
+			sendReport(index, nil)
+		}
+		close(stopped)
+	}()
+	go inputReader(stop, inputs, expand, seen)
+	go worker.CleanIdleConnections(nil)
+	go reportWriter(out, doneWriting, flushInterval)
 
 	limit := make(chan bool, maxConcurrency)
 	var urlCount uint64 = 0
 	busy := sync.WaitGroup{}
+	var summary *runSummary
+	if printSummary {
+		summary = newRunSummary()
+	}
+	started := time.Now()
 
-	processUrl := func(url *url.URL) {
-		result := worker.Fetch(url)
-		reportJson, _ := encodeResult(url.String(), result)
+	processUrl := func(r *fetcher.Request, index uint64) {
+		var result *heroshi.FetchResult
+		if checkRobotsOnly {
+			result = worker.CheckRobots(r.Url)
+		} else {
+			result = worker.FetchRequest(r)
+		}
+		if summary != nil {
+			summary.Add(result)
+		}
+		if crawl != nil {
+			crawl.follow(r, result)
+			urls.Done()
+		}
+		reportJson, _ := encodeResult(r.Url.String(), result)
 
 		// nil report is really unrecoverable error. Check stderr.
-		if reportJson != nil {
-			reports <- reportJson
-		}
+		sendReport(index, reportJson)
 
 		busy.Done()
 		<-limit
 	}
 
-readUrlsLoop:
+dispatch:
 	for {
+		// Wait for free fetcher first, so that queue keeps filling meanwhile
+		// and highest priority URL is taken at the last moment.
+		pause.Wait(interrupted)
 		select {
-		case u, ok := <-urls:
-			if !ok {
-				break readUrlsLoop
-			}
-			limit <- true
-			urlCount++
-			busy.Add(1)
-			go processUrl(u)
-
-			if urlCount%20 == 0 {
-				nHosts, nConns := worker.hostLimits.Size()
-				println("--- URL #", urlCount, "Open", nConns, "connections to", nHosts, "hosts.")
+		case limit <- true:
+		case <-interrupted:
+			// Without a slot, URLs left in queue are only reported as not fetched.
+			<-stopped
+			break dispatch
+		}
+		r, index, ok := urls.Pop()
+		if !ok {
+			break
+		}
+		// Pause may come while waiting for input.
+		pause.Wait(interrupted)
+		urlCount++
+		busy.Add(1)
+		go processUrl(r, index)
+		if maxUrls != 0 && urlCount >= maxUrls {
+			select {
+			case finish <- "Max URLs reached":
+			default:
 			}
-		case <-stop:
-			close(urls)
-			break readUrlsLoop
+			break
 		}
 	}
 
-	go func() {
-		for {
-			time.Sleep(1 * time.Second)
-			nHosts, nConns := worker.hostLimits.Size()
-			println("--- URL #", urlCount, "Open", nConns, "connections to", nHosts, "hosts.")
-			runtime.GC()
-		}
-	}()
-
 	busy.Wait()
+	if n := urls.Dropped(); n != 0 {
+		log.Printf("Ignored %d input URLs.\n", n)
+	}
+	if metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		metricsServer.Shutdown(ctx)
+		cancel()
+	}
+	worker.Close()
+	if order != nil {
+		order.Close()
+	}
 	close(reports)
 	<-doneWriting
+	if rotating != nil {
+		if err := rotating.Close(); err != nil {
+			log.Println("Close output file:", err.Error())
+		}
+	}
+	if summary != nil {
+		log.Println(summary.Format(time.Since(started)))
+	}
 }
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/temoto/http-client.go/fetcher"  // Temporary location
+	"github.com/temoto/http-client.go/heroshi"  // Temporary location
+	"github.com/temoto/http-client.go/limitmap" // Temporary location
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal("url.Parse:", err.Error())
+	}
+	return u
+}
+
+func TestAllow(t *testing.T) {
+	var hits []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+		if r.URL.Path == "/in" {
+			http.Redirect(w, r, "/out", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	worker := fetcher.NewWorker()
+	worker.Allow = urlFilter(nil, regexp.MustCompile("/out|/robots"))
+	for _, path := range []string{"/in", "/out"} {
+		result := worker.Fetch(mustParse(t, server.URL+path))
+		if result.ErrorKind != heroshi.ErrorKindFiltered || result.Status != "Filtered" {
+			t.Fatal("Expected filtered", path, "got:", result.Status)
+		}
+	}
+	// robots.txt is exempt.
+	if strings.Join(hits, " ") != "/robots.txt /in" {
+		t.Fatal("Unexpected requests:", hits)
+	}
+}
+
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadLinesError(t *testing.T) {
+	readErr := errors.New("broken pipe")
+	var lines []string
+	partial, err := readLines(&failingReader{"http://a/\n\n http://b/ \nhttp://par", readErr}, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != readErr || partial != "http://par" {
+		t.Fatal("Expected error with partial line, got:", err, partial)
+	}
+	if len(lines) != 2 || lines[0] != "http://a/" || lines[1] != "http://b/" {
+		t.Fatal("Expected lines before error, got:", lines)
+	}
+}
+
+// Input which fails to read must be reported and next input must still be read.
+func TestInputReaderReadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "urls.txt")
+	if err = ioutil.WriteFile(good, []byte("http://example.com/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	urls = newRequestQueue(10)
+	reports = make(chan []byte, 10)
+	stop := make(chan bool, 1)
+	// Reading directory fails after successful open.
+	inputReader(stop, []string{dir, good}, nil, newURLSet())
+
+	select {
+	case <-stop:
+	default:
+		t.Fatal("inputReader did not signal stop")
+	}
+	if len(reports) != 1 || !strings.Contains(string(<-reports), `"error_kind":"input"`) {
+		t.Fatal("Expected one input error report")
+	}
+	if urls.Len() != 1 {
+		t.Fatal("Expected URL from second input")
+	}
+	if r, _, _ := urls.Pop(); r.Url.String() != "http://example.com/" {
+		t.Fatal("Expected URL from second input")
+	}
+}
+
+func TestParseLineBase(t *testing.T) {
+	r, _, err := parseLine(`{"url": "../b?q=1", "base": "http://example.com/dir/a"}`)
+	if err != nil || r.Url.String() != "http://example.com/b?q=1" {
+		t.Fatal("Expected URL resolved against base, got:", r, err)
+	}
+	r, _, _ = parseLine(`{"url": "https://other.com/", "base": "http://example.com/"}`)
+	if r.Url.String() != "https://other.com/" {
+		t.Fatal("Expected absolute URL to ignore base, got:", r.Url)
+	}
+	// No base, relative URL stays relative and Fetch rejects it as before.
+	r, _, _ = parseLine("b")
+	if r.Url.Host != "" {
+		t.Fatal("Expected bare relative URL as is, got:", r.Url)
+	}
+	if _, _, err = parseLine(`{"url": "b", "base": "%zz"}`); err == nil {
+		t.Fatal("Expected error for invalid base")
+	}
+}
+
+func TestEncodeResultMultipart(t *testing.T) {
+	rawBody = true
+	defer func() { rawBody = false }()
+
+	body := []byte("raw\nbody")
+	encoded, err := encodeResult("k", &heroshi.FetchResult{Url: mustParse(t, "http://a/"), Success: true, Body: body})
+	if err != nil {
+		t.Fatal("encodeResult:", err)
+	}
+	i := strings.IndexByte(string(encoded), '\n')
+	if i == -1 || !strings.Contains(string(encoded[:i]), `"body_length":8`) || strings.Contains(string(encoded[:i]), `"content"`) {
+		t.Fatal("Expected header line with body_length, got:", string(encoded))
+	}
+	if string(encoded[i+1:]) != string(body) {
+		t.Fatal("Expected raw body after header, got:", string(encoded[i+1:]))
+	}
+}
+
+func TestRequestQueuePriority(t *testing.T) {
+	q := newRequestQueue(10)
+	for i, priority := range []int{0, 5, 0, 5, -1} {
+		q.Push(&fetcher.Request{Url: &url.URL{Path: fmt.Sprint(i)}}, priority, 0)
+	}
+	q.Close()
+	var order []string
+	for {
+		r, _, ok := q.Pop()
+		if !ok {
+			break
+		}
+		order = append(order, r.Url.Path)
+	}
+	if strings.Join(order, " ") != "1 3 0 2 4" {
+		t.Fatal("Expected priority then FIFO order, got:", order)
+	}
+}
+
+func TestRequestQueueBackpressure(t *testing.T) {
+	q := newRequestQueue(1)
+	q.Push(&fetcher.Request{Url: &url.URL{Path: "a"}}, 0, 0)
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(&fetcher.Request{Url: &url.URL{Path: "b"}}, 0, 0) }()
+	select {
+	case <-pushed:
+		t.Fatal("Push to full queue did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.Pop()
+	if !<-pushed {
+		t.Fatal("Expected Push after Pop to succeed")
+	}
+	q.Stop()
+	if _, _, ok := q.Pop(); ok {
+		t.Fatal("Expected nothing from stopped queue")
+	}
+	if q.Push(&fetcher.Request{Url: &url.URL{Path: "c"}}, 0, 0) || q.Dropped() != 2 {
+		t.Fatal("Expected b and c dropped, got:", q.Dropped())
+	}
+}
+
+func TestEncodeResultPretty(t *testing.T) {
+	defer func() { prettyJson = false }()
+	result := &heroshi.FetchResult{
+		Url:        mustParse(t, "http://a/"),
+		Success:    true,
+		Status:     "200 OK",
+		StatusCode: 200,
+		Headers:    http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte("body"),
+	}
+	for _, prettyJson = range []bool{false, true} {
+		encoded, err := encodeResult("k", result)
+		if err != nil {
+			t.Fatal("encodeResult:", err)
+		}
+		lines := strings.Count(string(encoded), "\n")
+		if (prettyJson && lines < 3) || (!prettyJson && lines != 1) || encoded[len(encoded)-1] != '\n' {
+			t.Fatal("Unexpected layout, pretty", prettyJson, "got:", string(encoded))
+		}
+		var report resultReport
+		if err = json.Unmarshal(encoded, &report); err != nil {
+			t.Fatal("Unmarshal:", err, string(encoded))
+		}
+		if report.Key != "k" || report.StatusCode != 200 || report.Content != "Ym9keQ==" || report.Headers["Content-Type"][0] != "text/plain" {
+			t.Fatal("Report did not survive round trip:", report)
+		}
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	var written []string
+	b := newReorderBuffer(2, func(report []byte) {
+		written = append(written, string(report))
+	})
+	indices := make([]uint64, 9)
+	for i := range indices {
+		indices[i] = b.Add(fmt.Sprint("k", i), &url.URL{Host: fmt.Sprint("h", i)})
+	}
+	b.Put(indices[1], []byte("1"))
+	b.Skip(indices[2])
+	if len(written) != 0 {
+		t.Fatal("Report written before earlier one:", written)
+	}
+	b.Put(indices[0], []byte("0"))
+	if strings.Join(written, " ") != "0 1" {
+		t.Fatal("Expected reports in input order, got:", written)
+	}
+
+	// 3 is slow, 2 later reports fit in window.
+	b.Put(indices[4], []byte("4"))
+	b.Put(indices[5], []byte("5"))
+	if len(written) != 2 {
+		t.Fatal("Report written before earlier one:", written)
+	}
+	b.Put(indices[6], []byte("6"))
+	if len(written) != 6 || !strings.Contains(written[2], `"key":"k3"`) || !strings.Contains(written[2], `"error_kind":"timeout"`) ||
+		strings.Join(written[3:], " ") != "4 5 6" {
+		t.Fatal("Expected timeout report in place of 3, got:", written)
+	}
+	b.Put(indices[3], []byte("3"))
+	if len(written) != 6 {
+		t.Fatal("Late report must be dropped, got:", written[6:])
+	}
+
+	// 7 never comes.
+	b.Put(indices[8], []byte("8"))
+	b.Close()
+	if len(written) != 7 || written[6] != "8" {
+		t.Fatal("Expected waiting report written on Close, got:", written[6:])
+	}
+}
+
+func TestReportMemory(t *testing.T) {
+	defer func(r chan []byte, m *limitmap.Semaphore, max uint) {
+		reports, reportMemory, maxReportMemory = r, m, max
+	}(reports, reportMemory, maxReportMemory)
+	reports = make(chan []byte, 10)
+	maxReportMemory = 10
+	reportMemory = limitmap.NewSemaphore(maxReportMemory)
+
+	queueReport([]byte("123456"))
+	queued := make(chan bool)
+	go func() {
+		queueReport([]byte("123456"))
+		queued <- true
+	}()
+	select {
+	case <-queued:
+		t.Fatal("Report over budget did not wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// What reportWriter does after writing.
+	reportMemory.ReleaseN(reportCost(<-reports))
+	<-queued
+	reportMemory.ReleaseN(reportCost(<-reports))
+
+	if cost := reportCost(make([]byte, 100)); cost != 10 {
+		t.Fatal("Expected large report to take whole budget, got:", cost)
+	}
+}
+
+func TestParseConnectTo(t *testing.T) {
+	from, to, err := parseConnectTo("example.com:443:[::1]:8443")
+	if err != nil || from != "example.com:443" || to != "[::1]:8443" {
+		t.Fatal("Unexpected parse result:", from, to, err)
+	}
+	if _, _, err = parseConnectTo("example.com:443:10.0.0.1"); err == nil {
+		t.Fatal("Expected error for 3 fields")
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	name, value, err := parseHeader("accept-language:  de-DE, de;q=0.9 ")
+	if err != nil || name != "Accept-Language" || value != "de-DE, de;q=0.9" {
+		t.Fatal("Unexpected parse result:", name, value, err)
+	}
+	if name, value, err = parseHeader("X-Empty:"); err != nil || name != "X-Empty" || value != "" {
+		t.Fatal("Expected empty value, got:", name, value, err)
+	}
+	for _, s := range []string{"Accept-Language de", ": de", "Accept Language: de"} {
+		if _, _, err = parseHeader(s); err == nil {
+			t.Fatal("Expected error for", s)
+		}
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	s := newRunSummary()
+	for ms := uint(1); ms <= 100; ms++ {
+		s.Add(&heroshi.FetchResult{Success: true, TotalTime: ms, Stat: &heroshi.RequestStat{BytesReceived: 10}})
+	}
+	s.Add(&heroshi.FetchResult{ErrorKind: heroshi.ErrorKindTimeout, TotalTime: 5000})
+	line := s.Format(time.Second)
+	if !strings.HasPrefix(line, "Summary: 101 URLs, ok 100, timeout 1; ") || !strings.HasSuffix(line, "; received 1000 bytes, 1000 bytes/s") {
+		t.Fatal("Unexpected summary:", line)
+	}
+	// Estimates are upper bounds of exponential buckets.
+	if p50 := s.percentile(0.5); p50 < 51 || p50 > 61 {
+		t.Fatal("Expected p50 near 51ms, got:", p50)
+	}
+	if p99 := s.percentile(0.99); p99 < 100 || p99 > 119 {
+		t.Fatal("Expected p99 near 100ms, got:", p99)
+	}
+	if max := s.percentile(1); max != 5000 {
+		t.Fatal("Expected p100 equal to largest, got:", max)
+	}
+}
+
+func TestPauseGate(t *testing.T) {
+	g := &pauseGate{}
+	g.Wait(nil) // not paused, doesn't block
+
+	g.Pause()
+	g.Pause()
+	passed := make(chan bool)
+	go func() {
+		g.Wait(nil)
+		passed <- true
+	}()
+	select {
+	case <-passed:
+		t.Fatal("Wait did not block while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if !g.Paused() {
+		t.Fatal("Expected Paused")
+	}
+	g.Resume()
+	<-passed
+
+	g.Pause()
+	cancel := make(chan bool)
+	close(cancel)
+	g.Wait(cancel) // returns on cancel while paused
+}
+
+func TestRotatingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate-test")
+	if err != nil {
+		t.Fatal("TempDir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	// File of previous run is kept.
+	if err = ioutil.WriteFile(filepath.Join(dir, "results-0001.jsonl"), []byte("old\n"), 0644); err != nil {
+		t.Fatal("WriteFile:", err.Error())
+	}
+
+	rw, err := newRotatingWriter(dir, 10, 0)
+	if err != nil {
+		t.Fatal("newRotatingWriter:", err.Error())
+	}
+	for _, report := range []string{"aaaa\n", "bbbb\n", "c\n", "large report\n", "d\n"} {
+		if _, err = rw.Write([]byte(report)); err != nil {
+			t.Fatal("Write:", err.Error())
+		}
+	}
+	if err = rw.Close(); err != nil {
+		t.Fatal("Close:", err.Error())
+	}
+
+	var files []string
+	for i := 1; i <= 4; i++ {
+		content, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("results-%04d.jsonl", i)))
+		if err != nil {
+			t.Fatal("ReadFile:", err.Error())
+		}
+		files = append(files, string(content))
+	}
+	if expected := []string{"old\n", "aaaa\nbbbb\n", "c\n", "large report\n"}; fmt.Sprint(files) != fmt.Sprint(expected) {
+		t.Fatalf("Expected files %q, got %q", expected, files)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "results-0005.jsonl")); string(content) != "d\n" {
+		t.Fatalf("Expected last report flushed on Close, got %q", content)
+	}
+
+	rw, err = newRotatingWriter(dir, 0, time.Millisecond)
+	if err != nil {
+		t.Fatal("newRotatingWriter:", err.Error())
+	}
+	rw.Write([]byte("e\n"))
+	time.Sleep(5 * time.Millisecond)
+	rw.Write([]byte("f\n"))
+	rw.Close()
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "results-0007.jsonl")); string(content) != "f\n" {
+		t.Fatalf("Expected rotation by interval, got %q", content)
+	}
+}
+
+func TestCrawlFollow(t *testing.T) {
+	urls = newRequestQueue(1)
+	urls.TrackDone()
+	crawl := &crawler{maxDepth: 2, seen: newURLSet()}
+	page := &fetcher.Request{Url: mustParse(t, "http://example.com/dir/")}
+	result := &heroshi.FetchResult{
+		Url:        page.Url,
+		Success:    true,
+		StatusCode: 200,
+		Headers:    http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body: []byte(`<a href="a">A</a> <a href="a#top">A again</a> <a href="http://EXAMPLE.com:80/b">B</a>
+			<a href="http://other.com/">Other</a>`),
+	}
+
+	urls.Push(page, 0, 0)
+	urls.Close()
+	if r, _, ok := urls.Pop(); !ok || r != page {
+		t.Fatal("Expected page from queue")
+	}
+	// Links of page are added beyond queue size and after Close.
+	crawl.follow(page, result)
+	urls.Done()
+	var found []string
+	for {
+		r, _, ok := urls.Pop()
+		if !ok {
+			break
+		}
+		if r.Depth != 1 {
+			t.Error("Expected depth 1, got:", r.Depth)
+		}
+		found = append(found, r.Url.String())
+		urls.Done()
+	}
+	if strings.Join(found, " ") != "http://example.com/dir/a http://EXAMPLE.com:80/b" {
+		t.Fatal("Unexpected links:", found)
+	}
+
+	// Seen links and pages at max depth give nothing.
+	urls = newRequestQueue(10)
+	crawl.follow(page, result)
+	deep := &fetcher.Request{Url: mustParse(t, "http://example.com/deep/"), Depth: 2}
+	deepResult := *result
+	deepResult.Body = []byte(`<a href="new">New</a>`)
+	crawl.follow(deep, &deepResult)
+	if urls.Len() != 0 {
+		t.Fatal("Expected no links, got:", urls.Len())
+	}
+
+	crawl.allow = regexp.MustCompile(`^http://other\.com/`)
+	crawl.follow(&fetcher.Request{Url: mustParse(t, "http://example.com/x/")}, result)
+	if r, _, _ := urls.Pop(); urls.Len() != 0 || r.Url.String() != "http://other.com/" {
+		t.Fatal("Expected only allowed link, got:", r.Url)
+	}
+}